@@ -15,4 +15,11 @@ kubectl create secret generic db-credentials \
   --from-literal=password="$DB_PASSWORD" \
   --dry-run=client -o yaml | kubectl apply -f -
 
-echo "✅ Secret created!"
+echo "🔐 Creating 'auth-credentials' Secret in 'apps' namespace..."
+JWT_SECRET=${JWT_SECRET:-$(openssl rand -base64 48)}
+kubectl create secret generic auth-credentials \
+  --namespace apps \
+  --from-literal=jwt-secret="$JWT_SECRET" \
+  --dry-run=client -o yaml | kubectl apply -f -
+
+echo "✅ Secrets created!"
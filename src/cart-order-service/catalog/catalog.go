@@ -0,0 +1,308 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cart-order-service/auth"
+	"cart-order-service/db"
+	"cart-order-service/money"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Client calls product-service. Requests are traced with otelhttp so the
+// trace context of the caller is propagated to product-service. Reads carry
+// the caller's access token (see auth.Transport); reservations are made with
+// a service token, since product-service only lets services hold stock.
+//
+// Reads are retried up to MaxAttempts times with exponential backoff starting
+// at RetryBackoff when product-service cannot be reached or answers with 5xx.
+// Writes are not retried since they are not idempotent.
+type Client struct {
+	BaseURL           string
+	HTTPClient        *http.Client
+	ServiceHTTPClient *http.Client
+	MaxAttempts       int
+	RetryBackoff      time.Duration
+}
+
+// NewClient creates a product-service client from PRODUCT_SERVICE_URL
+func NewClient() *Client {
+	return &Client{
+		BaseURL: db.GetEnvOrDefault("PRODUCT_SERVICE_URL", "http://localhost:8001"),
+		HTTPClient: &http.Client{
+			Transport: otelhttp.NewTransport(auth.NewTransport("cart-order-service", http.DefaultTransport)),
+			Timeout:   5 * time.Second,
+		},
+		ServiceHTTPClient: &http.Client{
+			Transport: otelhttp.NewTransport(auth.NewServiceTransport("cart-order-service", http.DefaultTransport)),
+			Timeout:   5 * time.Second,
+		},
+		MaxAttempts:  3,
+		RetryBackoff: 100 * time.Millisecond,
+	}
+}
+
+// Product is the part of a product-service product that carts need
+type Product struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Price      money.Money `json:"price"`
+	Sizes      []string    `json:"sizes"`
+	Colors     []string    `json:"colors"`
+	InStock    bool        `json:"inStock"`
+	ArchivedAt string      `json:"archivedAt"`
+	// ExchangeRate is set when product-service converted the price
+	ExchangeRate *db.ExchangeRate `json:"exchangeRate"`
+}
+
+// HasVariant reports whether the product is offered in size and color.
+// Products without sizes or colors only accept the empty value.
+func (p *Product) HasVariant(size, color string) bool {
+	return hasOption(p.Sizes, size) && hasOption(p.Colors, color)
+}
+
+func hasOption(options []string, value string) bool {
+	if len(options) == 0 {
+		return value == ""
+	}
+	for _, o := range options {
+		if o == value {
+			return true
+		}
+	}
+	return false
+}
+
+type stockLevel struct {
+	Size      string `json:"size"`
+	Color     string `json:"color"`
+	Available int    `json:"available"`
+}
+
+// GetProduct looks up a product with its price in currency. It returns
+// "product not found" for unknown IDs and "unsupported currency" if
+// product-service has no rate for currency.
+func (c *Client) GetProduct(ctx context.Context, productID, currency string) (*Product, error) {
+	var p Product
+	path := "/api/products/" + url.PathEscape(productID) + "?currency=" + url.QueryEscape(currency)
+	if err := c.get(ctx, path, &p); err != nil {
+		return nil, err
+	}
+	if p.Price.Currency != currency {
+		return nil, fmt.Errorf("product-service priced %s in %s instead of %s", productID, p.Price.Currency, currency)
+	}
+	return &p, nil
+}
+
+// SupportsCurrency reports whether product-service can price products in
+// currency
+func (c *Client) SupportsCurrency(ctx context.Context, currency string) (bool, error) {
+	var res struct {
+		Currencies []string `json:"currencies"`
+	}
+	if err := c.get(ctx, "/api/currencies", &res); err != nil {
+		return false, err
+	}
+	for _, supported := range res.Currencies {
+		if supported == currency {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Resolve returns the catalog product for a cart line, priced in currency,
+// after checking that the variant exists and has quantity units available. It
+// fails with "product not found", "product unavailable" for archived
+// products, "invalid product variant" or "insufficient stock".
+func (c *Client) Resolve(ctx context.Context, productID, size, color, currency string, quantity int) (*Product, error) {
+	p, err := c.GetProduct(ctx, productID, currency)
+	if err != nil {
+		return nil, err
+	}
+	if p.ArchivedAt != "" {
+		return nil, fmt.Errorf("product unavailable")
+	}
+	if !p.HasVariant(size, color) {
+		return nil, fmt.Errorf("invalid product variant")
+	}
+
+	var levels []stockLevel
+	if err := c.get(ctx, "/api/products/"+url.PathEscape(productID)+"/stock", &levels); err != nil {
+		return nil, err
+	}
+	for _, level := range levels {
+		if level.Size == size && level.Color == color {
+			if level.Available < quantity {
+				return nil, fmt.Errorf("insufficient stock")
+			}
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("insufficient stock")
+}
+
+type reservationItem struct {
+	ProductID string `json:"productId"`
+	Size      string `json:"size"`
+	Color     string `json:"color"`
+	Quantity  int    `json:"quantity"`
+}
+
+type reservation struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Reserve holds stock for the given items and returns the reservation ID.
+// It returns "insufficient stock" when product-service cannot cover an item.
+func (c *Client) Reserve(ctx context.Context, reference string, items []db.CartItem) (string, error) {
+	req := struct {
+		Reference string            `json:"reference"`
+		Items     []reservationItem `json:"items"`
+	}{Reference: reference}
+	for _, item := range items {
+		req.Items = append(req.Items, reservationItem{
+			ProductID: item.ProductID,
+			Size:      item.SelectedSize,
+			Color:     item.SelectedColor,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	var res reservation
+	if err := c.post(ctx, "/api/reservations", req, &res); err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
+// Release gives the stock held by a reservation back to inventory
+func (c *Client) Release(ctx context.Context, reservationID string) error {
+	return c.post(ctx, "/api/reservations/"+reservationID+"/release", nil, nil)
+}
+
+// Extend holds the stock of a reservation until ttl from now. It returns
+// "reservation expired" if the hold already lapsed.
+func (c *Client) Extend(ctx context.Context, reservationID string, ttl time.Duration) error {
+	req := struct {
+		TTLSeconds int `json:"ttlSeconds"`
+	}{int(ttl.Seconds())}
+	return c.post(ctx, "/api/reservations/"+reservationID+"/extend", req, nil)
+}
+
+// Confirm turns a reservation into a permanent stock decrement. It returns
+// "reservation expired" if the hold lapsed before it could be confirmed.
+func (c *Client) Confirm(ctx context.Context, reservationID string) error {
+	return c.post(ctx, "/api/reservations/"+reservationID+"/confirm", nil, nil)
+}
+
+// get decodes the response to a GET of path into out, retrying transient
+// failures. Each attempt is its own otelhttp client span; retries are
+// recorded as events on the caller's span.
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	backoff := c.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := c.getOnce(ctx, path, out)
+		if err == nil || !retry || attempt >= c.MaxAttempts {
+			return err
+		}
+
+		trace.SpanFromContext(ctx).AddEvent("product_service.retry", trace.WithAttributes(
+			attribute.String("http.url.path", path),
+			attribute.Int("retry.attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// getOnce performs a single GET and reports whether a failure is worth
+// retrying
+func (c *Client) getOnce(ctx context.Context, path string, out interface{}) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, fmt.Errorf("product not found")
+	case resp.StatusCode == http.StatusBadRequest && strings.Contains(path, "currency="):
+		return false, fmt.Errorf("unsupported currency")
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("product-service %s returned %d", path, resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("product-service %s returned %d", path, resp.StatusCode)
+	}
+
+	return false, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// post sends body as JSON to path with a service token and decodes the
+// response into out
+func (c *Client) post(ctx context.Context, path string, body, out interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.ServiceHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode == http.StatusConflict {
+			switch e.Error {
+			case "Insufficient stock":
+				return fmt.Errorf("insufficient stock")
+			case "reservation expired":
+				return fmt.Errorf("reservation expired")
+			case "reservation is not active":
+				return fmt.Errorf("reservation is not active")
+			}
+		}
+		return fmt.Errorf("product-service %s returned %d: %s", path, resp.StatusCode, e.Error)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+
+	"cart-order-service/db"
+	"cart-order-service/money"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PriceChange is a cart line whose catalog price changed after it was added
+type PriceChange struct {
+	ProductID     string      `json:"productId"`
+	ProductName   string      `json:"productName"`
+	SelectedSize  string      `json:"selectedSize"`
+	SelectedColor string      `json:"selectedColor"`
+	Quantity      int         `json:"quantity"`
+	OldPrice      money.Money `json:"oldPrice"`
+	NewPrice      money.Money `json:"newPrice"`
+}
+
+// Repricing describes how re-pricing changed a cart. Difference is NewTotal
+// minus OldTotal.
+type Repricing struct {
+	Changes    []PriceChange `json:"changes"`
+	OldTotal   money.Money   `json:"oldTotal"`
+	NewTotal   money.Money   `json:"newTotal"`
+	Difference money.Money   `json:"difference"`
+}
+
+// Reprice updates every line of a cart to the current catalog name and price
+// in the cart's currency. It returns the changes, or nil if no price changed,
+// and the exchange rates the current prices were converted with. Changes are
+// recorded as a cart.repriced event on the span in ctx. It fails with
+// "product unavailable" if a product was deleted or archived or a variant is
+// no longer offered.
+func (c *Client) Reprice(ctx context.Context, cartID string) (*Repricing, []db.ExchangeRate, error) {
+	cart, err := db.GetCart(ctx, cartID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	products := map[string]*Product{}
+	repricing := &Repricing{OldTotal: cart.Total}
+	var rates []db.ExchangeRate
+	var updated []db.CartItem
+	for _, item := range cart.Items {
+		p, ok := products[item.ProductID]
+		if !ok {
+			p, err = c.GetProduct(ctx, item.ProductID, cart.Currency)
+			if err != nil {
+				if err.Error() == "product not found" {
+					return nil, nil, fmt.Errorf("product unavailable")
+				}
+				return nil, nil, err
+			}
+			products[item.ProductID] = p
+			if p.ExchangeRate != nil && !hasRate(rates, *p.ExchangeRate) {
+				rates = append(rates, *p.ExchangeRate)
+			}
+		}
+		if p.ArchivedAt != "" || !p.HasVariant(item.SelectedSize, item.SelectedColor) {
+			return nil, nil, fmt.Errorf("product unavailable")
+		}
+
+		if p.Price == item.Price && p.Name == item.ProductName {
+			continue
+		}
+		if p.Price != item.Price {
+			repricing.Changes = append(repricing.Changes, PriceChange{
+				ProductID:     item.ProductID,
+				ProductName:   p.Name,
+				SelectedSize:  item.SelectedSize,
+				SelectedColor: item.SelectedColor,
+				Quantity:      item.Quantity,
+				OldPrice:      item.Price,
+				NewPrice:      p.Price,
+			})
+		}
+		item.ProductName = p.Name
+		item.Price = p.Price
+		updated = append(updated, item)
+	}
+
+	if len(updated) == 0 {
+		return nil, rates, nil
+	}
+	if err = db.UpdateCartItemPrices(ctx, cartID, updated); err != nil {
+		return nil, nil, err
+	}
+	if len(repricing.Changes) == 0 {
+		return nil, rates, nil
+	}
+
+	cart, err = db.GetCart(ctx, cartID)
+	if err != nil {
+		return nil, nil, err
+	}
+	repricing.NewTotal = cart.Total
+	repricing.Difference = repricing.NewTotal.Sub(repricing.OldTotal)
+
+	trace.SpanFromContext(ctx).AddEvent("cart.repriced", trace.WithAttributes(
+		attribute.String("cart.id", cartID),
+		attribute.Int("cart.price_changes", len(repricing.Changes)),
+		attribute.Float64("cart.price_difference", repricing.Difference.Float64()),
+		attribute.String("cart.currency", cart.Currency),
+	))
+	return repricing, rates, nil
+}
+
+func hasRate(rates []db.ExchangeRate, rate db.ExchangeRate) bool {
+	for _, r := range rates {
+		if r == rate {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,422 @@
+package checkout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cart-order-service/catalog"
+	"cart-order-service/db"
+	"cart-order-service/payments"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Saga steps, in execution order
+const (
+	StepCreateOrder  = "create_order"
+	StepReserveStock = "reserve_stock"
+	StepCharge       = "charge"
+	StepConfirm      = "confirm"
+	StepCapture      = "capture"
+	StepDone         = "done"
+)
+
+// Saga statuses
+const (
+	StatusRunning      = "running"
+	StatusCompensating = "compensating"
+	StatusHeld         = "held"
+	StatusCompleted    = "completed"
+	StatusFailed       = "failed"
+)
+
+var tracer = otel.Tracer("cart-order-service/checkout")
+
+// Orchestrator runs checkouts as sagas: create order -> reserve stock ->
+// authorize the payment -> confirm the stock -> capture the payment. Every
+// step is persisted before it runs so that a saga interrupted by a restart
+// can be resumed, and a failing step up to confirm triggers the compensating
+// actions of all steps completed before it. Once the stock is confirmed it
+// cannot be released anymore, so a failed capture is retried on the next
+// Resume instead of being compensated.
+type Orchestrator struct {
+	Products *catalog.Client
+	Payments *payments.Client
+	// IdleAfter is how long a running or compensating saga must go without
+	// progress before Resume takes it over from the process running it
+	IdleAfter time.Duration
+	// HoldTTL is how long the stock of a saga held for fraud review stays
+	// reserved
+	HoldTTL time.Duration
+}
+
+// Result is the outcome of a checkout
+type Result struct {
+	Saga    *db.CheckoutSaga  `json:"checkout"`
+	Order   *db.Order         `json:"order,omitempty"`
+	Payment *payments.Payment `json:"payment,omitempty"`
+	// Repricing is set when catalog prices changed since the items were
+	// added; the order is charged at the new prices
+	Repricing *catalog.Repricing `json:"repricing,omitempty"`
+}
+
+// Run checks out a cart. The returned error describes the step that failed;
+// the saga has already been compensated when Run returns.
+func (o *Orchestrator) Run(ctx context.Context, cartID string, card payments.Card) (*Result, error) {
+	ctx, span := tracer.Start(ctx, "checkout", trace.WithAttributes(attribute.String("cart.id", cartID)))
+	defer span.End()
+
+	saga, err := db.CreateCheckoutSaga(ctx, cartID, StepCreateOrder, StatusRunning)
+	if err != nil {
+		return nil, fail(span, err)
+	}
+	span.SetAttributes(attribute.String("checkout.id", saga.ID))
+	result := &Result{Saga: saga}
+
+	// Step 1 + 2: bring the cart up to current catalog prices and create the
+	// order; CreateOrder reserves stock through sagaReserver just before it
+	// writes the order
+	err = o.step(ctx, saga, StepCreateOrder, func(ctx context.Context) error {
+		repricing, rates, err := o.Products.Reprice(ctx, cartID)
+		if err != nil {
+			return err
+		}
+		result.Repricing = repricing
+
+		order, err := db.CreateOrder(ctx, cartID, rates, &sagaReserver{products: o.Products, saga: saga})
+		if err != nil {
+			return err
+		}
+		result.Order = order
+		saga.OrderID = order.ID
+		return nil
+	})
+	if err != nil {
+		// CreateOrder rolls back and releases its own reservation
+		saga.Status = StatusFailed
+		saga.Error = err.Error()
+		o.save(ctx, saga)
+		return result, fail(span, err)
+	}
+	span.SetAttributes(attribute.String("order.id", saga.OrderID))
+
+	// Step 3: authorize the order total
+	saga.Step = StepCharge
+	if err = o.save(ctx, saga); err != nil {
+		return result, fail(span, o.compensate(ctx, saga, err))
+	}
+	err = o.step(ctx, saga, StepCharge, func(ctx context.Context) error {
+		payment, err := o.Payments.Authorize(ctx, result.Order.ID, result.Order.Total, card)
+		if err != nil {
+			return err
+		}
+		result.Payment = payment
+		saga.PaymentID = payment.ID
+		return nil
+	})
+	if err != nil {
+		return result, fail(span, o.compensate(ctx, saga, err))
+	}
+	if result.Payment.Held() {
+		if err = o.hold(ctx, saga); err != nil {
+			return result, fail(span, err)
+		}
+		return result, nil
+	}
+
+	// Step 4: confirm the reservation
+	if err = o.confirm(ctx, saga); err != nil {
+		return result, fail(span, o.compensate(ctx, saga, err))
+	}
+
+	// Step 5: capture the payment and mark the order paid
+	if err = o.capture(ctx, saga); err != nil {
+		return result, fail(span, err)
+	}
+
+	result.Order, _ = db.GetOrder(ctx, saga.OrderID)
+	return result, nil
+}
+
+// Resume continues every saga left running or compensating without progress
+// for IdleAfter, whether its process stopped or a step failed and has to be
+// retried. Card details are never persisted, so a saga interrupted before
+// its charge is known to have succeeded is compensated rather than retried.
+func (o *Orchestrator) Resume(ctx context.Context) {
+	sagas, err := db.ClaimIdleCheckoutSagas(ctx, o.IdleAfter, StatusRunning, StatusCompensating)
+	if err != nil {
+		slog.ErrorContext(ctx, "Checkout: Failed to load in-flight sagas", "error", err)
+		return
+	}
+
+	for i := range sagas {
+		saga := &sagas[i]
+		ctx, span := tracer.Start(ctx, "checkout.resume", trace.WithAttributes(
+			attribute.String("checkout.id", saga.ID),
+			attribute.String("checkout.step", saga.Step),
+			attribute.String("checkout.status", saga.Status),
+		))
+		if err := o.resume(ctx, saga); err != nil {
+			slog.WarnContext(ctx, "Checkout: Resumed saga failed", "checkout_id", saga.ID, "status", saga.Status, "error", err)
+			fail(span, err)
+		} else {
+			slog.InfoContext(ctx, "Checkout: Resumed saga", "checkout_id", saga.ID, "status", saga.Status)
+		}
+		span.End()
+	}
+}
+
+func (o *Orchestrator) resume(ctx context.Context, saga *db.CheckoutSaga) error {
+	// The order may have been committed without the saga learning its ID
+	if saga.OrderID == "" && saga.ReservationID != "" {
+		if order, err := db.GetOrderByReservationID(ctx, saga.ReservationID); err == nil {
+			saga.OrderID = order.ID
+		}
+	}
+
+	if saga.Status == StatusCompensating {
+		return o.compensate(ctx, saga, errors.New(saga.Error))
+	}
+
+	switch saga.Step {
+	case StepCharge:
+		// Only continue if payment-service recorded a successful
+		// authorization
+		if saga.PaymentID == "" {
+			payment, err := o.Payments.GetByOrderID(ctx, saga.OrderID)
+			if err != nil || (payment.Status != payments.StatusAuthorized && payment.Status != payments.StatusCompleted) {
+				return o.compensate(ctx, saga, fmt.Errorf("checkout interrupted during %s", saga.Step))
+			}
+			saga.PaymentID = payment.ID
+			if payment.Held() {
+				return o.hold(ctx, saga)
+			}
+		}
+		fallthrough
+	case StepConfirm:
+		if err := o.confirm(ctx, saga); err != nil {
+			return o.compensate(ctx, saga, err)
+		}
+		fallthrough
+	case StepCapture:
+		return o.capture(ctx, saga)
+	default:
+		return o.compensate(ctx, saga, fmt.Errorf("checkout interrupted during %s", saga.Step))
+	}
+}
+
+// hold parks a saga whose payment is held for fraud review. payment-service
+// settles the payment once it is reviewed and moves the order to paid or
+// cancelled, and Settle then finishes the saga. Until then Resume leaves the
+// saga alone, and its reservation is extended to HoldTTL so that the sweeper
+// does not release the stock during the review. A reservation that cannot be
+// extended is compensated, which voids the held payment. An approval that
+// comes after HoldTTL finds the stock released, and payment-service voids
+// the payment then.
+func (o *Orchestrator) hold(ctx context.Context, saga *db.CheckoutSaga) error {
+	if err := o.Products.Extend(ctx, saga.ReservationID, o.HoldTTL); err != nil {
+		return o.compensate(ctx, saga, err)
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("checkout.held", trace.WithAttributes(
+		attribute.String("checkout.id", saga.ID),
+		attribute.String("payment.id", saga.PaymentID),
+	))
+	saga.Status = StatusHeld
+	return o.save(ctx, saga)
+}
+
+// Settle finishes the held saga of an order once the order was paid or
+// cancelled after its payment was reviewed. The reservation has already been
+// confirmed or released along with the order's status, so a paid order
+// completes the saga and a cancelled one rolls back what is left. Orders
+// without a held saga are ignored.
+func (o *Orchestrator) Settle(ctx context.Context, order *db.Order) {
+	saga, err := db.GetCheckoutSagaByOrderID(ctx, order.ID)
+	if err != nil {
+		if err.Error() != "checkout not found" {
+			slog.ErrorContext(ctx, "Checkout: Failed to load saga of order", "order_id", order.ID, "error", err)
+		}
+		return
+	}
+	if saga.Status != StatusHeld {
+		return
+	}
+
+	switch order.Status {
+	case db.OrderPaid:
+		saga.Step = StepDone
+		saga.Status = StatusCompleted
+		o.save(ctx, saga)
+	case db.OrderCancelled:
+		o.compensate(ctx, saga, errors.New("payment declined in review"))
+	}
+}
+
+// confirm runs the confirm step, which turns the stock reservation into a
+// permanent decrement
+func (o *Orchestrator) confirm(ctx context.Context, saga *db.CheckoutSaga) error {
+	saga.Step = StepConfirm
+	if err := o.save(ctx, saga); err != nil {
+		return err
+	}
+
+	return o.step(ctx, saga, StepConfirm, func(ctx context.Context) error {
+		return o.Products.Confirm(ctx, saga.ReservationID)
+	})
+}
+
+// capture runs the capture step and completes the saga. If it fails the saga
+// stays running at this step with the error recorded, to be retried by the
+// next Resume.
+func (o *Orchestrator) capture(ctx context.Context, saga *db.CheckoutSaga) error {
+	saga.Step = StepCapture
+	if err := o.save(ctx, saga); err != nil {
+		return err
+	}
+
+	err := o.step(ctx, saga, StepCapture, func(ctx context.Context) error {
+		if err := o.Payments.Capture(ctx, saga.PaymentID); err != nil {
+			return err
+		}
+		return db.UpdateOrderStatus(ctx, saga.OrderID, db.OrderPaid, "checkout", "payment "+saga.PaymentID+" captured")
+	})
+	if err != nil {
+		saga.Error = err.Error()
+		o.save(ctx, saga)
+		return err
+	}
+
+	saga.Step = StepDone
+	saga.Status = StatusCompleted
+	return o.save(ctx, saga)
+}
+
+// compensate undoes the completed steps of a saga in reverse order: void
+// (or refund) the payment, release the stock, cancel the order and put the
+// items back in the cart. If any action fails the saga stays compensating so that the next
+// Resume retries it. The returned error is cause.
+func (o *Orchestrator) compensate(ctx context.Context, saga *db.CheckoutSaga, cause error) error {
+	saga.Status = StatusCompensating
+	saga.Error = cause.Error()
+	o.save(ctx, saga)
+
+	var failed bool
+	run := func(name string, action func(ctx context.Context) error) {
+		ctx, span := tracer.Start(ctx, "checkout.compensate."+name)
+		defer span.End()
+		if err := action(ctx); err != nil {
+			slog.ErrorContext(ctx, "Checkout: Compensation failed", "checkout_id", saga.ID, "step", name, "error", err)
+			fail(span, err)
+			failed = true
+		}
+	}
+
+	if saga.OrderID != "" {
+		run("cancel_payment", func(ctx context.Context) error {
+			// The authorization may have succeeded even if its response was
+			// lost, so the payment is looked up rather than taken from the saga
+			payment, err := o.Payments.GetByOrderID(ctx, saga.OrderID)
+			if err != nil {
+				if err.Error() == "payment not found" {
+					return nil
+				}
+				return err
+			}
+			switch payment.Status {
+			case payments.StatusAuthorized, payments.StatusRequiresAction, payments.StatusProcessing:
+				return o.Payments.Void(ctx, payment.ID)
+			case payments.StatusCompleted, payments.StatusPartiallyRefunded:
+				return o.Payments.Refund(ctx, payment.ID)
+			}
+			return nil
+		})
+	}
+
+	if saga.ReservationID != "" {
+		run("release_stock", func(ctx context.Context) error {
+			return o.Products.Release(ctx, saga.ReservationID)
+		})
+	}
+
+	if saga.OrderID != "" {
+		run("cancel_order", func(ctx context.Context) error {
+			order, err := db.GetOrder(ctx, saga.OrderID)
+			if err != nil {
+				return err
+			}
+			if order.Status == db.OrderCancelled {
+				return nil
+			}
+			if err := db.UpdateOrderStatus(ctx, order.ID, db.OrderCancelled, "checkout", "checkout "+saga.ID+" failed: "+saga.Error); err != nil {
+				return err
+			}
+			return db.RestoreCartItems(ctx, saga.CartID, order.Items)
+		})
+	}
+
+	if !failed {
+		saga.Status = StatusFailed
+		o.save(ctx, saga)
+	}
+	return cause
+}
+
+// step runs fn in a child span named after the saga step
+func (o *Orchestrator) step(ctx context.Context, saga *db.CheckoutSaga, name string, fn func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "checkout."+name, trace.WithAttributes(attribute.String("checkout.id", saga.ID)))
+	defer span.End()
+
+	if err := fn(ctx); err != nil {
+		return fail(span, err)
+	}
+	return nil
+}
+
+func (o *Orchestrator) save(ctx context.Context, saga *db.CheckoutSaga) error {
+	if err := db.SaveCheckoutSaga(ctx, saga); err != nil {
+		slog.ErrorContext(ctx, "Checkout: Failed to persist saga", "checkout_id", saga.ID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// sagaReserver reserves stock for CreateOrder in its own child span and
+// persists the reservation ID on the saga as soon as the hold exists
+type sagaReserver struct {
+	products *catalog.Client
+	saga     *db.CheckoutSaga
+}
+
+func (r *sagaReserver) Reserve(ctx context.Context, reference string, items []db.CartItem) (string, error) {
+	ctx, span := tracer.Start(ctx, "checkout."+StepReserveStock, trace.WithAttributes(attribute.String("checkout.id", r.saga.ID)))
+	defer span.End()
+
+	reservationID, err := r.products.Reserve(ctx, reference, items)
+	if err != nil {
+		return "", fail(span, err)
+	}
+
+	r.saga.ReservationID = reservationID
+	r.saga.Step = StepReserveStock
+	db.SaveCheckoutSaga(ctx, r.saga)
+	span.SetAttributes(attribute.String("reservation.id", reservationID))
+	return reservationID, nil
+}
+
+func (r *sagaReserver) Release(ctx context.Context, reservationID string) error {
+	return r.products.Release(ctx, reservationID)
+}
+
+// fail records err on span and returns it
+func fail(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CheckoutSaga is the persisted state of a server-side checkout. Step is the
+// step currently being executed; Status tells whether the saga is still
+// moving forward, rolling back, or finished.
+type CheckoutSaga struct {
+	ID            string `json:"id"`
+	CartID        string `json:"cartId"`
+	OrderID       string `json:"orderId,omitempty"`
+	ReservationID string `json:"reservationId,omitempty"`
+	PaymentID     string `json:"paymentId,omitempty"`
+	Step          string `json:"step"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     string `json:"createdAt"`
+	UpdatedAt     string `json:"updatedAt"`
+}
+
+const checkoutSagaColumns = `id, cart_id, COALESCE(order_id, ''), COALESCE(reservation_id, ''), COALESCE(payment_id, ''), step, status, COALESCE(error, ''), created_at, updated_at`
+
+// CreateCheckoutSaga persists a new saga for a cart
+func CreateCheckoutSaga(ctx context.Context, cartID, step, status string) (*CheckoutSaga, error) {
+	query := `
+		INSERT INTO checkout_sagas (id, cart_id, step, status)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + checkoutSagaColumns
+
+	return scanCheckoutSaga(DB.QueryRowContext(ctx, query, "chk_"+generateID(), cartID, step, status))
+}
+
+// GetCheckoutSaga retrieves a saga by its ID
+func GetCheckoutSaga(ctx context.Context, id string) (*CheckoutSaga, error) {
+	query := `SELECT ` + checkoutSagaColumns + ` FROM checkout_sagas WHERE id = $1`
+
+	saga, err := scanCheckoutSaga(DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("checkout not found")
+		}
+		return nil, err
+	}
+	return saga, nil
+}
+
+// GetCheckoutSagaByOrderID retrieves the saga that created an order
+func GetCheckoutSagaByOrderID(ctx context.Context, orderID string) (*CheckoutSaga, error) {
+	query := `SELECT ` + checkoutSagaColumns + ` FROM checkout_sagas WHERE order_id = $1`
+
+	saga, err := scanCheckoutSaga(DB.QueryRowContext(ctx, query, orderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("checkout not found")
+		}
+		return nil, err
+	}
+	return saga, nil
+}
+
+// SaveCheckoutSaga persists the current state of a saga
+func SaveCheckoutSaga(ctx context.Context, saga *CheckoutSaga) error {
+	query := `
+		UPDATE checkout_sagas
+		SET order_id = NULLIF($2, ''), reservation_id = NULLIF($3, ''), payment_id = NULLIF($4, ''),
+		    step = $5, status = $6, error = NULLIF($7, '')
+		WHERE id = $1
+		RETURNING updated_at`
+
+	return DB.QueryRowContext(ctx, query, saga.ID, saga.OrderID, saga.ReservationID, saga.PaymentID,
+		saga.Step, saga.Status, saga.Error).Scan(&saga.UpdatedAt)
+}
+
+// ClaimIdleCheckoutSagas retrieves the sagas in one of the given statuses
+// that were not updated for idle, i.e. that are no longer being run by any
+// process, oldest first. Claiming touches them, so that other replicas leave
+// them alone for another idle period.
+func ClaimIdleCheckoutSagas(ctx context.Context, idle time.Duration, statuses ...string) ([]CheckoutSaga, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE checkout_sagas SET updated_at = CURRENT_TIMESTAMP
+			WHERE id IN (
+				SELECT id FROM checkout_sagas
+				WHERE status = ANY($1) AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *
+		)
+		SELECT ` + checkoutSagaColumns + ` FROM claimed ORDER BY created_at`
+
+	rows, err := DB.QueryContext(ctx, query, pq.Array(statuses), idle.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sagas []CheckoutSaga
+	for rows.Next() {
+		saga, err := scanCheckoutSaga(rows)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, *saga)
+	}
+
+	return sagas, rows.Err()
+}
+
+// GetOrderByReservationID retrieves the order that holds a stock reservation
+func GetOrderByReservationID(ctx context.Context, reservationID string) (*Order, error) {
+	var orderID string
+	err := DB.QueryRowContext(ctx, `SELECT id FROM orders WHERE reservation_id = $1`, reservationID).Scan(&orderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("order not found")
+		}
+		return nil, err
+	}
+	return GetOrder(ctx, orderID)
+}
+
+// RestoreCartItems puts the items of an order back into a cart, e.g. after
+// a failed checkout emptied it. Items merge into lines the user added in the
+// meantime; the quantity limit is not enforced since the items were already
+// in the cart.
+func RestoreCartItems(ctx context.Context, cartID string, items []CartItem) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, item := range items {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO cart_items (cart_id, product_id, product_name, price, quantity, selected_size, selected_color)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (cart_id, product_id, selected_size, selected_color)
+			DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity`,
+			cartID, item.ProductID, item.ProductName, item.Price, item.Quantity, item.SelectedSize, item.SelectedColor)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return updateCartTotal(ctx, cartID)
+}
+
+// rowScanner is satisfied by both *telemetry.Row and *telemetry.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCheckoutSaga(row rowScanner) (*CheckoutSaga, error) {
+	var saga CheckoutSaga
+	err := row.Scan(
+		&saga.ID, &saga.CartID, &saga.OrderID, &saga.ReservationID, &saga.PaymentID,
+		&saga.Step, &saga.Status, &saga.Error, &saga.CreatedAt, &saga.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &saga, nil
+}
@@ -1,17 +1,22 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
+	"cart-order-service/money"
+	"cart-order-service/telemetry"
+
 	_ "github.com/lib/pq"
 )
 
 // DB is the global database connection
-var DB *sql.DB
+var DB *telemetry.DB
 
 // InitDB initializes the database connection
 func InitDB() {
@@ -28,17 +33,19 @@ func InitDB() {
 
 	// Open database connection
 	var err error
-	DB, err = sql.Open("postgres", psqlInfo)
+	DB, err = telemetry.OpenDB("postgres", psqlInfo, dbname)
 	if err != nil {
-		log.Fatal("Failed to open database:", err)
+		slog.Error("Failed to open database", "error", err)
+		os.Exit(1)
 	}
 
 	// Test the connection
-	if err = DB.Ping(); err != nil {
-		log.Fatal("Failed to ping database:", err)
+	if err = DB.PingContext(context.Background()); err != nil {
+		slog.Error("Failed to ping database", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Successfully connected to database!")
+	slog.Info("Successfully connected to database!")
 }
 
 // GetEnvOrDefault returns the environment variable value or a default value
@@ -59,29 +66,47 @@ func CloseDB() {
 type User struct {
 	ID           string `json:"id"`
 	Email        string `json:"email"`
-	PasswordHash string `json:"password,omitempty"`
+	PasswordHash string `json:"-"`
 	Name         string `json:"name"`
+	Role         string `json:"role"`
 	CreatedAt    string `json:"createdAt"`
 	UpdatedAt    string `json:"updatedAt"`
 }
 
 // CreateUser creates a new user
-func CreateUser(user User) error {
+func CreateUser(ctx context.Context, user User) error {
 	query := `
-		INSERT INTO users (id, email, password_hash, name)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO users (id, email, password_hash, name, role)
+		VALUES ($1, $2, $3, $4, $5)`
 
-	_, err := DB.Exec(query, user.ID, user.Email, user.PasswordHash, user.Name)
+	_, err := DB.ExecContext(ctx, query, user.ID, user.Email, user.PasswordHash, user.Name, user.Role)
 	return err
 }
 
 // GetUserByEmail retrieves a user by email
-func GetUserByEmail(email string) (*User, error) {
-	query := `SELECT id, email, password_hash, name, created_at, updated_at FROM users WHERE email = $1`
+func GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	query := `SELECT id, email, password_hash, name, role, created_at, updated_at FROM users WHERE email = $1`
+
+	var user User
+	err := DB.QueryRowContext(ctx, query, email).Scan(
+		&user.ID, &user.Email, &user.PasswordHash, &user.Name, &user.Role, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByID retrieves a user by ID
+func GetUserByID(ctx context.Context, id string) (*User, error) {
+	query := `SELECT id, email, password_hash, name, role, created_at, updated_at FROM users WHERE id = $1`
 
 	var user User
-	err := DB.QueryRow(query, email).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.Name, &user.CreatedAt, &user.UpdatedAt,
+	err := DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID, &user.Email, &user.PasswordHash, &user.Name, &user.Role, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -92,61 +117,120 @@ func GetUserByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// UpdateUserPasswordHash replaces the stored password hash of a user
+func UpdateUserPasswordHash(ctx context.Context, userID, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`
+	_, err := DB.ExecContext(ctx, query, passwordHash, userID)
+	return err
+}
+
 type CartItem struct {
-	ProductID     string  `json:"productId"`
-	ProductName   string  `json:"productName"`
-	Price         float64 `json:"price"`
-	Quantity      int     `json:"quantity"`
-	SelectedSize  string  `json:"selectedSize"`
-	SelectedColor string  `json:"selectedColor"`
+	LineID        int         `json:"lineId,omitempty"`
+	ProductID     string      `json:"productId"`
+	ProductName   string      `json:"productName"`
+	Price         money.Money `json:"price"`
+	Quantity      int         `json:"quantity"`
+	SelectedSize  string      `json:"selectedSize"`
+	SelectedColor string      `json:"selectedColor"`
 }
 
+// Cart is priced in Currency, which is chosen when the cart is created
 type Cart struct {
-	ID        string     `json:"id"`
-	UserID    string     `json:"userId"`
-	Items     []CartItem `json:"items"`
-	Total     float64    `json:"total"`
-	CreatedAt string     `json:"createdAt"`
-	UpdatedAt string     `json:"updatedAt"`
+	ID        string      `json:"id"`
+	UserID    string      `json:"userId"`
+	Currency  string      `json:"currency"`
+	Items     []CartItem  `json:"items"`
+	Total     money.Money `json:"total"`
+	CreatedAt string      `json:"createdAt"`
+	UpdatedAt string      `json:"updatedAt"`
 }
 
 type Order struct {
-	ID        string     `json:"id"`
-	UserID    string     `json:"userId"`
-	Items     []CartItem `json:"items"`
-	Total     float64    `json:"total"`
-	Status    string     `json:"status"`
-	CreatedAt string     `json:"createdAt"`
-	UpdatedAt string     `json:"updatedAt"`
+	ID            string      `json:"id"`
+	UserID        string      `json:"userId"`
+	Items         []CartItem  `json:"items"`
+	Total         money.Money `json:"total"`
+	Status        string      `json:"status"`
+	ReservationID string      `json:"reservationId,omitempty"`
+	// RefundedAmount is the total refunded by payment-service so far
+	RefundedAmount money.Money `json:"refundedAmount"`
+	// ExchangeRates are the rates product-service converted the catalog
+	// prices of the order with
+	ExchangeRates []ExchangeRate `json:"exchangeRates,omitempty"`
+	CreatedAt     string         `json:"createdAt"`
+	UpdatedAt     string         `json:"updatedAt"`
+}
+
+// ExchangeRate is a rate product-service converted catalog prices with
+type ExchangeRate struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Rate   float64 `json:"rate"`
+	Source string  `json:"source"`
+	AsOf   string  `json:"asOf"`
 }
 
-// CreateCart creates a new cart for a user
-func CreateCart(userID string) (*Cart, error) {
+// CreateCart creates a new cart for a user, priced in currency
+func CreateCart(ctx context.Context, userID, currency string) (*Cart, error) {
 	cartID := generateID()
 	query := `
-		INSERT INTO carts (id, user_id)
-		VALUES ($1, $2)
-		RETURNING id, user_id, total, created_at, updated_at`
+		INSERT INTO carts (id, user_id, currency)
+		VALUES ($1, $2, $3)
+		RETURNING id, user_id, currency, total, created_at, updated_at`
 
 	var cart Cart
-	err := DB.QueryRow(query, cartID, userID).Scan(
-		&cart.ID, &cart.UserID, &cart.Total, &cart.CreatedAt, &cart.UpdatedAt,
+	var total string
+	err := DB.QueryRowContext(ctx, query, cartID, userID, currency).Scan(
+		&cart.ID, &cart.UserID, &cart.Currency, &total, &cart.CreatedAt, &cart.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if cart.Total, err = money.Parse(total, cart.Currency); err != nil {
+		return nil, err
+	}
 
 	cart.Items = []CartItem{}
+	cartsCreated.Add(ctx, 1, currencyAttr(cart.Currency))
 	return &cart, nil
 }
 
+// GetCartOwner returns the ID of the user a cart belongs to
+func GetCartOwner(ctx context.Context, cartID string) (string, error) {
+	var userID string
+	err := DB.QueryRowContext(ctx, `SELECT user_id FROM carts WHERE id = $1`, cartID).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("cart not found")
+		}
+		return "", err
+	}
+	return userID, nil
+}
+
+// queryer is satisfied by both the database and a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*telemetry.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *telemetry.Row
+}
+
 // GetCart retrieves a cart by its ID
-func GetCart(cartID string) (*Cart, error) {
-	query := `SELECT id, user_id, total, created_at, updated_at FROM carts WHERE id = $1`
+func GetCart(ctx context.Context, cartID string) (*Cart, error) {
+	return getCart(ctx, DB, cartID, false)
+}
+
+// getCart reads a cart and its items through q. With lock the cart row is
+// locked until the transaction ends, so its items cannot be changed.
+func getCart(ctx context.Context, q queryer, cartID string, lock bool) (*Cart, error) {
+	query := `SELECT id, user_id, currency, total, created_at, updated_at FROM carts WHERE id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
 
 	var cart Cart
-	err := DB.QueryRow(query, cartID).Scan(
-		&cart.ID, &cart.UserID, &cart.Total, &cart.CreatedAt, &cart.UpdatedAt,
+	var total string
+	err := q.QueryRowContext(ctx, query, cartID).Scan(
+		&cart.ID, &cart.UserID, &cart.Currency, &total, &cart.CreatedAt, &cart.UpdatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -154,15 +238,18 @@ func GetCart(cartID string) (*Cart, error) {
 		}
 		return nil, err
 	}
+	if cart.Total, err = money.Parse(total, cart.Currency); err != nil {
+		return nil, err
+	}
 
 	// Get cart items
 	itemsQuery := `
-		SELECT product_id, product_name, price, quantity, selected_size, selected_color
+		SELECT id, product_id, product_name, price, quantity, selected_size, selected_color
 		FROM cart_items
 		WHERE cart_id = $1
-		ORDER BY created_at`
+		ORDER BY created_at, id`
 
-	rows, err := DB.Query(itemsQuery, cartID)
+	rows, err := q.QueryContext(ctx, itemsQuery, cartID)
 	if err != nil {
 		return nil, err
 	}
@@ -171,13 +258,17 @@ func GetCart(cartID string) (*Cart, error) {
 	var items []CartItem
 	for rows.Next() {
 		var item CartItem
+		var price string
 		err := rows.Scan(
-			&item.ProductID, &item.ProductName, &item.Price,
+			&item.LineID, &item.ProductID, &item.ProductName, &price,
 			&item.Quantity, &item.SelectedSize, &item.SelectedColor,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if item.Price, err = money.Parse(price, cart.Currency); err != nil {
+			return nil, err
+		}
 		items = append(items, item)
 	}
 
@@ -185,63 +276,219 @@ func GetCart(cartID string) (*Cart, error) {
 	return &cart, nil
 }
 
-// AddItemToCart adds an item to the cart
-func AddItemToCart(cartID string, item CartItem) error {
+// MaxItemQuantity is the largest quantity a single cart line may hold
+var MaxItemQuantity = 10
+
+// AddItemToCart adds an item to the cart. Adding a variant that is already in
+// the cart increases the quantity of its line and refreshes its name and
+// price; the merged quantity may not exceed MaxItemQuantity.
+func AddItemToCart(ctx context.Context, cartID string, item CartItem) error {
 	query := `
 		INSERT INTO cart_items (cart_id, product_id, product_name, price, quantity, selected_size, selected_color)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (cart_id, product_id, selected_size, selected_color)
+		DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity,
+		              product_name = EXCLUDED.product_name, price = EXCLUDED.price
+		WHERE cart_items.quantity + EXCLUDED.quantity <= $8`
 
-	_, err := DB.Exec(query, cartID, item.ProductID, item.ProductName, item.Price, item.Quantity, item.SelectedSize, item.SelectedColor)
+	res, err := DB.ExecContext(ctx, query, cartID, item.ProductID, item.ProductName, item.Price, item.Quantity, item.SelectedSize, item.SelectedColor, MaxItemQuantity)
 	if err != nil {
 		return err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("quantity limit exceeded")
+	}
 
 	// Update cart total
-	return updateCartTotal(cartID)
+	if err := updateCartTotal(ctx, cartID); err != nil {
+		return err
+	}
+	cartItemsAdded.Add(ctx, int64(item.Quantity), currencyAttr(item.Price.Currency))
+	return nil
+}
+
+// GetCartItem retrieves a single line of a cart
+func GetCartItem(ctx context.Context, cartID string, lineID int) (*CartItem, error) {
+	query := `
+		SELECT i.id, i.product_id, i.product_name, i.price, c.currency, i.quantity, i.selected_size, i.selected_color
+		FROM cart_items i
+		JOIN carts c ON c.id = i.cart_id
+		WHERE i.cart_id = $1 AND i.id = $2`
+
+	var item CartItem
+	var price, currency string
+	err := DB.QueryRowContext(ctx, query, cartID, lineID).Scan(
+		&item.LineID, &item.ProductID, &item.ProductName, &price, &currency,
+		&item.Quantity, &item.SelectedSize, &item.SelectedColor,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("cart item not found")
+		}
+		return nil, err
+	}
+	if item.Price, err = money.Parse(price, currency); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// SetCartItemQuantity sets the quantity of a cart line. A quantity of 0
+// removes the line.
+func SetCartItemQuantity(ctx context.Context, cartID string, lineID, quantity int) error {
+	var res sql.Result
+	var err error
+	if quantity == 0 {
+		res, err = DB.ExecContext(ctx, `DELETE FROM cart_items WHERE cart_id = $1 AND id = $2`, cartID, lineID)
+	} else {
+		res, err = DB.ExecContext(ctx, `UPDATE cart_items SET quantity = $3 WHERE cart_id = $1 AND id = $2`, cartID, lineID, quantity)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("cart item not found")
+	}
+
+	return updateCartTotal(ctx, cartID)
+}
+
+// UpdateCartItemPrices sets the name and price of cart lines and
+// recalculates the cart total
+func UpdateCartItemPrices(ctx context.Context, cartID string, items []CartItem) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, item := range items {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE cart_items
+			SET product_name = $3, price = $4
+			WHERE cart_id = $1 AND id = $2`,
+			cartID, item.LineID, item.ProductName, item.Price)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return updateCartTotal(ctx, cartID)
 }
 
-// RemoveItemFromCart removes an item from the cart
-func RemoveItemFromCart(cartID, productID string) error {
+// RemoveItemFromCart removes every variant of a product from the cart
+func RemoveItemFromCart(ctx context.Context, cartID, productID string) error {
 	query := `DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2`
-	_, err := DB.Exec(query, cartID, productID)
+	_, err := DB.ExecContext(ctx, query, cartID, productID)
 	if err != nil {
 		return err
 	}
 
 	// Update cart total
-	return updateCartTotal(cartID)
+	return updateCartTotal(ctx, cartID)
+}
+
+// RemoveVariantFromCart removes the line of a single product variant
+func RemoveVariantFromCart(ctx context.Context, cartID, productID, size, color string) error {
+	query := `DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2 AND selected_size = $3 AND selected_color = $4`
+	_, err := DB.ExecContext(ctx, query, cartID, productID, size, color)
+	if err != nil {
+		return err
+	}
+
+	return updateCartTotal(ctx, cartID)
+}
+
+// StockReserver holds inventory for an order while it is being created
+type StockReserver interface {
+	Reserve(ctx context.Context, reference string, items []CartItem) (string, error)
+	Release(ctx context.Context, reservationID string) error
 }
 
-// CreateOrder creates an order from a cart
-func CreateOrder(cartID string) (*Order, error) {
-	// First, get the cart
-	cart, err := GetCart(cartID)
+// CreateOrder creates an order from a cart in the cart's currency, recording
+// the exchange rates its prices were converted with. Stock for every item is
+// reserved before the order transaction begins, so no transaction is held
+// open across the call to product-service, and released again if the order
+// is not committed. The transaction locks the cart and fails with "cart
+// changed" if its items are no longer the ones that were reserved.
+func CreateOrder(ctx context.Context, cartID string, exchangeRates []ExchangeRate, stock StockReserver) (*Order, error) {
+	cart, err := GetCart(ctx, cartID)
 	if err != nil {
 		return nil, err
 	}
+	if len(cart.Items) == 0 {
+		return nil, fmt.Errorf("cart is empty")
+	}
 
 	orderID := generateID()
+	if exchangeRates == nil {
+		exchangeRates = []ExchangeRate{}
+	}
+	rates, err := json.Marshal(exchangeRates)
+	if err != nil {
+		return nil, err
+	}
+
+	reservationID, err := stock.Reserve(ctx, orderID, cart.Items)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := stock.Release(context.WithoutCancel(ctx), reservationID); err != nil {
+				slog.ErrorContext(ctx, "CreateOrder: Failed to release reservation", "reservation_id", reservationID, "error", err)
+			}
+		}
+	}()
 
 	// Begin transaction
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
+	locked, err := getCart(ctx, tx, cartID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !sameItems(locked.Items, cart.Items) {
+		return nil, fmt.Errorf("cart changed")
+	}
+	cart = locked
+
 	// Insert order
 	orderQuery := `
-		INSERT INTO orders (id, user_id, total, status)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO orders (id, user_id, total, currency, exchange_rates, status, reservation_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, user_id, total, status, created_at, updated_at`
 
 	var order Order
-	err = tx.QueryRow(orderQuery, orderID, cart.UserID, cart.Total, "pending").Scan(
-		&order.ID, &order.UserID, &order.Total, &order.Status, &order.CreatedAt, &order.UpdatedAt,
+	var total string
+	err = tx.QueryRowContext(ctx, orderQuery, orderID, cart.UserID, cart.Total, cart.Currency, string(rates), OrderPending, reservationID).Scan(
+		&order.ID, &order.UserID, &total, &order.Status, &order.CreatedAt, &order.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if order.Total, err = money.Parse(total, cart.Currency); err != nil {
+		return nil, err
+	}
+	order.RefundedAmount = money.Zero(cart.Currency)
+	order.ExchangeRates = exchangeRates
+
+	if err = recordOrderStatusChange(ctx, tx, order.ID, "", OrderPending, cart.UserID, "order created"); err != nil {
+		return nil, err
+	}
 
 	// Insert order items
 	for _, item := range cart.Items {
@@ -249,14 +496,14 @@ func CreateOrder(cartID string) (*Order, error) {
 			INSERT INTO order_items (order_id, product_id, product_name, price, quantity, selected_size, selected_color)
 			VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-		_, err = tx.Exec(itemQuery, order.ID, item.ProductID, item.ProductName, item.Price, item.Quantity, item.SelectedSize, item.SelectedColor)
+		_, err = tx.ExecContext(ctx, itemQuery, order.ID, item.ProductID, item.ProductName, item.Price, item.Quantity, item.SelectedSize, item.SelectedColor)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// Clear cart items
-	_, err = tx.Exec("DELETE FROM cart_items WHERE cart_id = $1", cartID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM cart_items WHERE cart_id = $1", cartID)
 	if err != nil {
 		return nil, err
 	}
@@ -266,20 +513,52 @@ func CreateOrder(cartID string) (*Order, error) {
 	if err != nil {
 		return nil, err
 	}
+	committed = true
+
+	cartValue.Record(ctx, cart.Total.Float64(), currencyAttr(cart.Currency))
+	ordersCreated.Add(ctx, 1, currencyAttr(cart.Currency))
+	recordOrderStatus(ctx, OrderPending, order.Total)
 
 	// Get the order with items
 	order.Items = cart.Items
+	order.ReservationID = reservationID
 	return &order, nil
 }
 
+// sameItems reports whether two reads of a cart hold the same lines, with
+// the same variants, quantities and prices
+func sameItems(a, b []CartItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].LineID != b[i].LineID || a[i].ProductID != b[i].ProductID ||
+			a[i].SelectedSize != b[i].SelectedSize || a[i].SelectedColor != b[i].SelectedColor ||
+			a[i].Quantity != b[i].Quantity || a[i].Price != b[i].Price {
+			return false
+		}
+	}
+	return true
+}
+
+// GetOrderOwner returns the ID of the user an order belongs to
+func GetOrderOwner(ctx context.Context, orderID string) (string, error) {
+	var userID string
+	err := DB.QueryRowContext(ctx, `SELECT user_id FROM orders WHERE id = $1`, orderID).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("order not found")
+		}
+		return "", err
+	}
+	return userID, nil
+}
+
 // GetOrder retrieves an order by its ID
-func GetOrder(orderID string) (*Order, error) {
-	query := `SELECT id, user_id, total, status, created_at, updated_at FROM orders WHERE id = $1`
+func GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE id = $1`
 
-	var order Order
-	err := DB.QueryRow(query, orderID).Scan(
-		&order.ID, &order.UserID, &order.Total, &order.Status, &order.CreatedAt, &order.UpdatedAt,
-	)
+	order, err := scanOrder(DB.QueryRowContext(ctx, query, orderID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("order not found")
@@ -294,7 +573,7 @@ func GetOrder(orderID string) (*Order, error) {
 		WHERE order_id = $1
 		ORDER BY created_at`
 
-	rows, err := DB.Query(itemsQuery, orderID)
+	rows, err := DB.QueryContext(ctx, itemsQuery, orderID)
 	if err != nil {
 		return nil, err
 	}
@@ -303,32 +582,29 @@ func GetOrder(orderID string) (*Order, error) {
 	var items []CartItem
 	for rows.Next() {
 		var item CartItem
+		var price string
 		err := rows.Scan(
-			&item.ProductID, &item.ProductName, &item.Price,
+			&item.ProductID, &item.ProductName, &price,
 			&item.Quantity, &item.SelectedSize, &item.SelectedColor,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if item.Price, err = money.Parse(price, order.Total.Currency); err != nil {
+			return nil, err
+		}
 		items = append(items, item)
 	}
 
 	order.Items = items
-	return &order, nil
-}
-
-// UpdateOrderStatus updates the status of an order
-func UpdateOrderStatus(orderID, status string) error {
-	query := `UPDATE orders SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`
-	_, err := DB.Exec(query, status, orderID)
-	return err
+	return order, nil
 }
 
 // GetUserOrders retrieves all orders for a user
-func GetUserOrders(userID string) ([]Order, error) {
-	query := `SELECT id, user_id, total, status, created_at, updated_at FROM orders WHERE user_id = $1 ORDER BY created_at DESC`
+func GetUserOrders(ctx context.Context, userID string) ([]Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE user_id = $1 ORDER BY created_at DESC`
 
-	rows, err := DB.Query(query, userID)
+	rows, err := DB.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -336,22 +612,44 @@ func GetUserOrders(userID string) ([]Order, error) {
 
 	var orders []Order
 	for rows.Next() {
-		var order Order
-		err := rows.Scan(
-			&order.ID, &order.UserID, &order.Total, &order.Status, &order.CreatedAt, &order.UpdatedAt,
-		)
+		order, err := scanOrder(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		orders = append(orders, order)
+		orders = append(orders, *order)
 	}
 
 	return orders, nil
 }
 
+const orderColumns = `id, user_id, total, currency, status, COALESCE(reservation_id, ''), refunded_amount, exchange_rates, created_at, updated_at`
+
+func scanOrder(row rowScanner) (*Order, error) {
+	var order Order
+	var total, currency, refunded string
+	var rates []byte
+	err := row.Scan(
+		&order.ID, &order.UserID, &total, &currency, &order.Status, &order.ReservationID, &refunded, &rates,
+		&order.CreatedAt, &order.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if order.Total, err = money.Parse(total, currency); err != nil {
+		return nil, err
+	}
+	if order.RefundedAmount, err = money.Parse(refunded, currency); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(rates, &order.ExchangeRates); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
 // updateCartTotal recalculates and updates the cart total
-func updateCartTotal(cartID string) error {
+func updateCartTotal(ctx context.Context, cartID string) error {
 	query := `
 		UPDATE carts
 		SET total = (
@@ -362,7 +660,7 @@ func updateCartTotal(cartID string) error {
 		updated_at = CURRENT_TIMESTAMP
 		WHERE id = $1`
 
-	_, err := DB.Exec(query, cartID)
+	_, err := DB.ExecContext(ctx, query, cartID)
 	return err
 }
 
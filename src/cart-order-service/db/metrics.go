@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+
+	"cart-order-service/money"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Business metrics are recorded where carts and orders change, once the
+// change is committed. Attributes are limited to currencies and order
+// statuses so that the number of series stays small.
+
+var meter = otel.Meter("cart-order-service/db")
+
+var (
+	cartsCreated, _ = meter.Int64Counter("carts.created",
+		metric.WithDescription("Carts created"))
+	cartItemsAdded, _ = meter.Int64Counter("cart.items.added",
+		metric.WithDescription("Units of products added to carts"))
+	cartValue, _ = meter.Float64Histogram("cart.value",
+		metric.WithDescription("Value of the carts orders are created from, in units of the currency"),
+		metric.WithExplicitBucketBoundaries(10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000))
+	ordersCreated, _ = meter.Int64Counter("orders.created",
+		metric.WithDescription("Orders created"))
+	orderStatusChanges, _ = meter.Int64Counter("orders.status_changes",
+		metric.WithDescription("Orders moved to a status, including pending when they are created"))
+	orderRevenue, _ = meter.Float64Counter("orders.revenue",
+		metric.WithDescription("Totals of orders that were paid, in units of the currency"))
+)
+
+func currencyAttr(currency string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String("currency", currency))
+}
+
+// recordOrderStatus counts an order moving to status, and its total as
+// revenue once it is paid
+func recordOrderStatus(ctx context.Context, status string, total money.Money) {
+	orderStatusChanges.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("status", status),
+		attribute.String("currency", total.Currency),
+	))
+	if status == OrderPaid {
+		orderRevenue.Add(ctx, total.Float64(), currencyAttr(total.Currency))
+	}
+}
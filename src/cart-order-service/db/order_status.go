@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"cart-order-service/money"
+	"cart-order-service/telemetry"
+)
+
+// Order statuses
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderFulfilled = "fulfilled"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Only pending orders can be cancelled; once paid, an order is refunded
+// through payment-service instead, which returns the money. Cancelled and
+// refunded orders are final.
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderFulfilled, OrderRefunded},
+	OrderFulfilled: {OrderShipped, OrderRefunded},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+	OrderCancelled: {},
+	OrderRefunded:  {},
+}
+
+type OrderStatusChange struct {
+	ID         int    `json:"id"`
+	OrderID    string `json:"orderId"`
+	FromStatus string `json:"fromStatus,omitempty"`
+	ToStatus   string `json:"toStatus"`
+	ChangedBy  string `json:"changedBy"`
+	Reason     string `json:"reason,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// CanTransitionOrder reports whether an order may move from one status to another
+func CanTransitionOrder(from, to string) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateOrderStatus moves an order to a new status and records the change in
+// the order's history. Setting the status an order already has is a no-op.
+// It returns "invalid order status" for unknown statuses and "invalid status
+// transition" if the lifecycle does not allow the move.
+func UpdateOrderStatus(ctx context.Context, orderID, status, changedBy, reason string) error {
+	if _, ok := orderTransitions[status]; !ok {
+		return fmt.Errorf("invalid order status")
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current, total, currency string
+	err = tx.QueryRowContext(ctx, `SELECT status, total, currency FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&current, &total, &currency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("order not found")
+		}
+		return err
+	}
+
+	if current == status {
+		return nil
+	}
+	if !CanTransitionOrder(current, status) {
+		return fmt.Errorf("invalid status transition")
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, status, orderID)
+	if err != nil {
+		return err
+	}
+
+	if err = recordOrderStatusChange(ctx, tx, orderID, current, status, changedBy, reason); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if amount, err := money.Parse(total, currency); err == nil {
+		recordOrderStatus(ctx, status, amount)
+	}
+	return nil
+}
+
+// RecordOrderRefund stores the total refunded for an order. Once the order is
+// fully refunded it moves to refunded, if its current status allows that;
+// otherwise only the amount is kept, e.g. for orders the checkout saga is
+// cancelling. It fails with "currency mismatch" unless the amount is in the
+// currency of the order.
+func RecordOrderRefund(ctx context.Context, orderID string, refundedAmount money.Money, fullyRefunded bool, changedBy, reason string) (*Order, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current, currency string
+	err = tx.QueryRowContext(ctx, `SELECT status, currency FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&current, &currency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("order not found")
+		}
+		return nil, err
+	}
+	if refundedAmount.Currency != currency {
+		return nil, fmt.Errorf("currency mismatch")
+	}
+
+	status := current
+	if fullyRefunded && CanTransitionOrder(current, OrderRefunded) {
+		status = OrderRefunded
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders SET refunded_amount = $1, status = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3`, refundedAmount, status, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != current {
+		if err = recordOrderStatusChange(ctx, tx, orderID, current, status, changedBy, reason); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	order, err := GetOrder(ctx, orderID)
+	if err == nil && status != current {
+		recordOrderStatus(ctx, status, order.Total)
+	}
+	return order, err
+}
+
+// GetOrderStatusHistory retrieves the status changes of an order, oldest first
+func GetOrderStatusHistory(ctx context.Context, orderID string) ([]OrderStatusChange, error) {
+	var exists bool
+	if err := DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM orders WHERE id = $1)`, orderID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("order not found")
+	}
+
+	query := `
+		SELECT id, order_id, COALESCE(from_status, ''), to_status, changed_by, COALESCE(reason, ''), created_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY created_at, id`
+
+	rows, err := DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var c OrderStatusChange
+		err := rows.Scan(&c.ID, &c.OrderID, &c.FromStatus, &c.ToStatus, &c.ChangedBy, &c.Reason, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+
+	return history, rows.Err()
+}
+
+// recordOrderStatusChange appends a status change to an order's history
+func recordOrderStatusChange(ctx context.Context, tx *telemetry.Tx, orderID, from, to, changedBy, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, reason)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''))`,
+		orderID, from, to, changedBy, reason)
+	return err
+}
@@ -0,0 +1,57 @@
+package db
+
+import "testing"
+
+func TestCanTransitionOrder(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{OrderPending, OrderPaid, true},
+		{OrderPending, OrderCancelled, true},
+		{OrderPending, OrderFulfilled, false},
+		{OrderPending, OrderRefunded, false},
+		{OrderPaid, OrderFulfilled, true},
+		{OrderPaid, OrderRefunded, true},
+		{OrderPaid, OrderCancelled, false},
+		{OrderPaid, OrderPending, false},
+		{OrderFulfilled, OrderShipped, true},
+		{OrderFulfilled, OrderRefunded, true},
+		{OrderFulfilled, OrderCancelled, false},
+		{OrderShipped, OrderDelivered, true},
+		{OrderShipped, OrderRefunded, false},
+		{OrderDelivered, OrderRefunded, true},
+		{OrderDelivered, OrderShipped, false},
+		{OrderCancelled, OrderPending, false},
+		{OrderCancelled, OrderPaid, false},
+		{OrderRefunded, OrderPaid, false},
+		{"unknown", OrderPaid, false},
+		{OrderPending, "unknown", false},
+	}
+	for _, tt := range tests {
+		if got := CanTransitionOrder(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransitionOrder(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestOrderTransitionsFinalStatuses(t *testing.T) {
+	for _, status := range []string{OrderCancelled, OrderRefunded} {
+		if next := orderTransitions[status]; len(next) != 0 {
+			t.Errorf("%s should be final, can move to %v", status, next)
+		}
+	}
+}
+
+func TestOrderTransitionsTargetsAreKnown(t *testing.T) {
+	for from, next := range orderTransitions {
+		for _, to := range next {
+			if _, ok := orderTransitions[to]; !ok {
+				t.Errorf("%s can move to unknown status %q", from, to)
+			}
+			if to == from {
+				t.Errorf("%s lists itself as a transition", from)
+			}
+		}
+	}
+}
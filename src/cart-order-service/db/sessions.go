@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CreateRefreshToken stores the hash of a newly issued refresh token
+func CreateRefreshToken(ctx context.Context, userID, familyID, tokenHash string, ttl time.Duration) error {
+	query := `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + $5 * INTERVAL '1 second')`
+
+	_, err := DB.ExecContext(ctx, query, "rt_"+generateID(), userID, familyID, tokenHash, int64(ttl.Seconds()))
+	return err
+}
+
+// RotateRefreshToken revokes the refresh token with oldHash and stores newHash
+// in its place, returning the ID of the user it belongs to. Presenting a token
+// that was already rotated or revoked revokes its whole family, since it means
+// the token was leaked. Errors are "invalid refresh token", "refresh token
+// expired" and "refresh token reuse detected".
+func RotateRefreshToken(ctx context.Context, oldHash, newHash string, ttl time.Duration) (string, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id, userID, familyID string
+	var expired, revoked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, user_id, family_id, expires_at < CURRENT_TIMESTAMP, revoked_at IS NOT NULL
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE`, oldHash).Scan(&id, &userID, &familyID, &expired, &revoked)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("invalid refresh token")
+		}
+		return "", err
+	}
+
+	if revoked {
+		if _, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL`, familyID); err != nil {
+			return "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("refresh token reuse detected")
+	}
+	if expired {
+		return "", fmt.Errorf("refresh token expired")
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1`, id); err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + $5 * INTERVAL '1 second')`,
+		"rt_"+generateID(), userID, familyID, newHash, int64(ttl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// RevokeRefreshTokenFamily revokes the refresh token with tokenHash and every
+// token rotated from the same login
+func RevokeRefreshTokenFamily(ctx context.Context, tokenHash string) error {
+	query := `
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE revoked_at IS NULL
+		  AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)`
+
+	_, err := DB.ExecContext(ctx, query, tokenHash)
+	return err
+}
@@ -4,24 +4,52 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"cart-order-service/auth"
+	"cart-order-service/catalog"
+	"cart-order-service/checkout"
 	"cart-order-service/db"
+	"cart-order-service/idempotency"
+	"cart-order-service/money"
+	"cart-order-service/password"
+	"cart-order-service/payments"
 	"cart-order-service/telemetry"
 
 	"github.com/gorilla/mux"
 	flagd "github.com/open-feature/go-sdk-contrib/providers/flagd/pkg"
 	"github.com/open-feature/go-sdk/openfeature"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// products is the product-service client used to price cart items and
+// reserve stock
+var products *catalog.Client
+
+// checkouts runs server-side checkouts as sagas
+var checkouts *checkout.Orchestrator
+
+var (
+	passwordHasher = password.NewHasher()
+	passwordPolicy = password.NewPolicy()
 )
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -39,62 +67,138 @@ func createCart(w http.ResponseWriter, r *http.Request) {
 	client := openfeature.NewClient("cart-order-service")
 	failureEnabled, err := client.BooleanValue(context.Background(), "cartServiceFailure", false, openfeature.EvaluationContext{})
 	if err == nil && failureEnabled {
-		log.Println("Simulated Cart Service Failure triggered")
+		slog.WarnContext(r.Context(), "Simulated Cart Service Failure triggered")
 		http.Error(w, "Simulated Cart Service Failure", http.StatusInternalServerError)
 		return
 	}
 
-	var req map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("CreateCart: Invalid request body: %v", err)
+	// The cart is priced in the currency asked for in the body or the
+	// Accept-Currency header, which cannot be changed later
+	var req struct {
+		Currency string `json:"currency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	currency, ok := cartCurrency(w, r, req.Currency)
+	if !ok {
+		return
+	}
 
-	userID := req["userId"]
-	log.Printf("CreateCart request for userID: %s", userID)
+	// The cart always belongs to the authenticated caller
+	userID := auth.UserID(r.Context())
+	slog.InfoContext(r.Context(), "CreateCart request", "user_id", userID, "currency", currency)
 
-	cart, err := db.CreateCart(userID)
+	cart, err := db.CreateCart(r.Context(), userID, currency)
 	if err != nil {
-		log.Printf("CreateCart: DB error: %v", err)
+		slog.ErrorContext(r.Context(), "CreateCart: DB error", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("CreateCart successful. CartID: %s", cart.ID)
+	slog.InfoContext(r.Context(), "CreateCart successful", "cart_id", cart.ID)
 	json.NewEncoder(w).Encode(cart)
 }
 
+// cartCurrency checks the currency a cart is created in, which defaults to
+// the preferred currency of the Accept-Currency header and then to
+// money.DefaultCurrency. It writes 400 for currencies product-service cannot
+// price in.
+func cartCurrency(w http.ResponseWriter, r *http.Request, currency string) (string, bool) {
+	if currency == "" {
+		currency, _, _ = strings.Cut(r.Header.Get("Accept-Currency"), ",")
+		currency, _, _ = strings.Cut(currency, ";")
+	}
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" || currency == money.DefaultCurrency {
+		return money.DefaultCurrency, true
+	}
+
+	// Carts are stored with two decimals, whatever product-service offers
+	supported := money.Storable(currency)
+	if supported {
+		var err error
+		supported, err = products.SupportsCurrency(r.Context(), currency)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "CreateCart: Failed to look up currencies", "error", err)
+			writeCatalogError(w, err)
+			return "", false
+		}
+	}
+	if !supported {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported currency " + currency})
+		return "", false
+	}
+	return currency, true
+}
+
 func addItemToCart(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	vars := mux.Vars(r)
 	cartID := vars["cartId"]
 
+	if !authorizeCart(w, r, cartID) {
+		return
+	}
+
 	var item db.CartItem
 	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		log.Printf("AddItemToCart: Invalid request body for cart %s: %v", cartID, err)
+		slog.WarnContext(r.Context(), "AddItemToCart: Invalid request body", "cart_id", cartID, "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("AddItemToCart request for cart %s. ProductID: %s, Quantity: %d", cartID, item.ProductID, item.Quantity)
+	slog.InfoContext(r.Context(), "AddItemToCart request", "cart_id", cartID, "product_id", item.ProductID, "quantity", item.Quantity)
 
-	err := db.AddItemToCart(cartID, item)
+	// The quantity is merged into the line of the same variant, if any
+	cart, err := db.GetCart(r.Context(), cartID)
 	if err != nil {
-		log.Printf("AddItemToCart: DB error for cart %s: %v", cartID, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	quantity := item.Quantity
+	for _, line := range cart.Items {
+		if line.ProductID == item.ProductID && line.SelectedSize == item.SelectedSize && line.SelectedColor == item.SelectedColor {
+			quantity += line.Quantity
+		}
+	}
+	if item.Quantity < 1 || quantity > db.MaxItemQuantity {
+		writeQuantityError(w)
+		return
+	}
+
+	// Name and price always come from the catalog, never from the client
+	product, err := products.Resolve(r.Context(), item.ProductID, item.SelectedSize, item.SelectedColor, cart.Currency, quantity)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AddItemToCart: Failed to resolve product", "cart_id", cartID, "product_id", item.ProductID, "error", err)
+		writeCatalogError(w, err)
+		return
+	}
+	item.ProductName = product.Name
+	item.Price = product.Price
 
-	cart, err := db.GetCart(cartID)
+	err = db.AddItemToCart(r.Context(), cartID, item)
 	if err != nil {
-		log.Printf("AddItemToCart: Failed to retrieve cart %s after adding item: %v", cartID, err)
+		if err.Error() == "quantity limit exceeded" {
+			writeQuantityError(w)
+			return
+		}
+		slog.ErrorContext(r.Context(), "AddItemToCart: DB error", "cart_id", cartID, "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("AddItemToCart successful for cart %s", cartID)
+	cart, err = db.GetCart(r.Context(), cartID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AddItemToCart: Failed to retrieve cart after adding item", "cart_id", cartID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AddItemToCart successful", "cart_id", cartID)
 	json.NewEncoder(w).Encode(cart)
 }
 
@@ -105,13 +209,23 @@ func removeItemFromCart(w http.ResponseWriter, r *http.Request) {
 	cartID := vars["cartId"]
 	productID := vars["productId"]
 
-	err := db.RemoveItemFromCart(cartID, productID)
+	if !authorizeCart(w, r, cartID) {
+		return
+	}
+
+	// size and color narrow the removal down to a single variant
+	var err error
+	if query := r.URL.Query(); query.Has("size") || query.Has("color") {
+		err = db.RemoveVariantFromCart(r.Context(), cartID, productID, query.Get("size"), query.Get("color"))
+	} else {
+		err = db.RemoveItemFromCart(r.Context(), cartID, productID)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	cart, err := db.GetCart(cartID)
+	cart, err := db.GetCart(r.Context(), cartID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -120,13 +234,90 @@ func removeItemFromCart(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(cart)
 }
 
+func updateCartItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	cartID := vars["cartId"]
+
+	if !authorizeCart(w, r, cartID) {
+		return
+	}
+
+	var req struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Quantity == nil || *req.Quantity < 0 || *req.Quantity > db.MaxItemQuantity {
+		writeQuantityError(w)
+		return
+	}
+
+	lineID, err := strconv.Atoi(vars["lineId"])
+	if err != nil {
+		writeCartItemNotFound(w)
+		return
+	}
+	item, err := db.GetCartItem(r.Context(), cartID, lineID)
+	if err != nil {
+		if err.Error() == "cart item not found" {
+			writeCartItemNotFound(w)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if *req.Quantity > item.Quantity {
+		_, err := products.Resolve(r.Context(), item.ProductID, item.SelectedSize, item.SelectedColor, item.Price.Currency, *req.Quantity)
+		if err != nil {
+			writeCatalogError(w, err)
+			return
+		}
+	}
+
+	if err := db.SetCartItemQuantity(r.Context(), cartID, lineID, *req.Quantity); err != nil {
+		if err.Error() == "cart item not found" {
+			writeCartItemNotFound(w)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cart, err := db.GetCart(r.Context(), cartID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(cart)
+}
+
+func writeQuantityError(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Quantity must be between 1 and %d", db.MaxItemQuantity)})
+}
+
+func writeCartItemNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Cart item not found"})
+}
+
 func getCart(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	vars := mux.Vars(r)
 	cartID := vars["cartId"]
 
-	cart, err := db.GetCart(cartID)
+	if !authorizeCart(w, r, cartID) {
+		return
+	}
+
+	cart, err := db.GetCart(r.Context(), cartID)
 	if err != nil {
 		if err.Error() == "cart not found" {
 			w.WriteHeader(http.StatusNotFound)
@@ -146,18 +337,186 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cartID := vars["cartId"]
 
-	order, err := db.CreateOrder(cartID)
+	if !authorizeCart(w, r, cartID) {
+		return
+	}
+
+	repricing, rates, err := products.Reprice(r.Context(), cartID)
 	if err != nil {
-		if err.Error() == "cart not found" {
+		writeCatalogError(w, err)
+		return
+	}
+
+	order, err := db.CreateOrder(r.Context(), cartID, rates, products)
+	if err != nil {
+		switch err.Error() {
+		case "cart not found":
 			w.WriteHeader(http.StatusNotFound)
 			json.NewEncoder(w).Encode(map[string]string{"error": "Cart not found"})
+		case "cart is empty":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Cart is empty"})
+		case "insufficient stock":
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient stock"})
+		case "cart changed":
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Cart changed during checkout, please try again"})
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		*db.Order
+		Repricing *catalog.Repricing `json:"repricing,omitempty"`
+	}{order, repricing})
+}
+
+// writeCatalogError maps product lookup errors to responses
+func writeCatalogError(w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case "cart not found":
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Cart not found"})
+	case "product not found":
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+	case "invalid product variant":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid size or color for this product"})
+	case "product unavailable":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product is no longer available"})
+	case "insufficient stock":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient stock"})
+	case "unsupported currency":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The currency of the cart is no longer supported"})
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product catalog unavailable"})
+	}
+}
+
+func checkoutCart(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	cartID := vars["cartId"]
+
+	if !authorizeCart(w, r, cartID) {
+		return
+	}
+
+	var req struct {
+		Currency string `json:"currency"`
+		payments.Card
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.PaymentMethodID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "paymentMethodId is required"})
+		return
+	}
+	// Carts are charged in the currency they were created in
+	if req.Currency != "" {
+		cart, err := db.GetCart(r.Context(), cartID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !strings.EqualFold(req.Currency, cart.Currency) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "The cart is charged in " + cart.Currency})
+			return
+		}
+	}
+
+	// A client that disconnects must not interrupt the saga between steps,
+	// which would leave it to be compensated by the next Resume
+	ctx := payments.WithClientIP(context.WithoutCancel(r.Context()), clientIP(r))
+	result, err := checkouts.Run(ctx, cartID, req.Card)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Checkout failed", "cart_id", cartID, "error", err)
+
+		status := http.StatusInternalServerError
+		switch {
+		case err.Error() == "cart not found":
+			status = http.StatusNotFound
+		case err.Error() == "cart is empty":
+			status = http.StatusBadRequest
+		case err.Error() == "insufficient stock", err.Error() == "product unavailable", err.Error() == "unsupported currency",
+			err.Error() == "cart changed", err.Error() == "reservation expired":
+			status = http.StatusConflict
+		case strings.HasPrefix(err.Error(), "payment failed"):
+			status = http.StatusPaymentRequired
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			*checkout.Result
+			Error string `json:"error"`
+		}{result, err.Error()})
+		return
+	}
+
+	// A payment held for fraud review completes the checkout once approved
+	if result.Saga.Status == checkout.StatusHeld {
+		slog.InfoContext(r.Context(), "Checkout held for review", "checkout_id", result.Saga.ID, "cart_id", cartID, "order_id", result.Order.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Checkout completed", "checkout_id", result.Saga.ID, "cart_id", cartID, "order_id", result.Order.ID)
+	json.NewEncoder(w).Encode(result)
+}
+
+// clientIP is the address the request came from. Behind the ingress that is
+// the last hop of X-Forwarded-For, which the load balancer appends; the hops
+// before it are whatever the client sent and cannot be trusted.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func getCheckout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	checkoutID := vars["checkoutId"]
+
+	saga, err := db.GetCheckoutSaga(r.Context(), checkoutID)
+	if err != nil {
+		if err.Error() == "checkout not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Checkout not found"})
 			return
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(order)
+	if !authorizeCart(w, r, saga.CartID) {
+		return
+	}
+
+	json.NewEncoder(w).Encode(saga)
 }
 
 func getOrder(w http.ResponseWriter, r *http.Request) {
@@ -166,7 +525,11 @@ func getOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["orderId"]
 
-	order, err := db.GetOrder(orderID)
+	if !authorizeOrder(w, r, orderID) {
+		return
+	}
+
+	order, err := db.GetOrder(r.Context(), orderID)
 	if err != nil {
 		if err.Error() == "order not found" {
 			w.WriteHeader(http.StatusNotFound)
@@ -186,31 +549,218 @@ func updateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["orderId"]
 
-	var req map[string]string
-	json.NewDecoder(r.Body).Decode(&req)
+	if !authorizeOrder(w, r, orderID) {
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Owners may cancel their order while it is pending, every other
+	// transition is made by checkout, fulfilment or an admin
+	if claims, _ := auth.FromContext(r.Context()); claims.Role == auth.RoleCustomer && req.Status != db.OrderCancelled {
+		auth.Forbid(w, r, "order", orderID)
+		return
+	}
 
-	err := db.UpdateOrderStatus(orderID, req["status"])
+	err := db.UpdateOrderStatus(r.Context(), orderID, req.Status, auth.UserID(r.Context()), req.Reason)
+	if err != nil {
+		switch err.Error() {
+		case "order not found":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+		case "invalid order status":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid order status: " + req.Status})
+		case "invalid status transition":
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order cannot move to status " + req.Status})
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	order, err := db.GetOrder(r.Context(), orderID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	settleReservation(r.Context(), order)
+	checkouts.Settle(r.Context(), order)
+
+	json.NewEncoder(w).Encode(order)
+}
 
-	order, err := db.GetOrder(orderID)
+// confirmOrderReservation takes the reserved stock of an order for good.
+// payment-service calls it before capturing a payment approved in fraud
+// review, so that a card is never charged for stock that was released
+// meanwhile. Orders without a reservation have nothing to confirm.
+func confirmOrderReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	order, err := db.GetOrder(r.Context(), vars["orderId"])
 	if err != nil {
+		if err.Error() == "order not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if order.Status == db.OrderCancelled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order is cancelled"})
+		return
+	}
+
+	if order.ReservationID != "" {
+		if err := products.Confirm(r.Context(), order.ReservationID); err != nil {
+			switch err.Error() {
+			case "reservation expired", "reservation is not active":
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
 
 	json.NewEncoder(w).Encode(order)
 }
 
+// settleReservation makes the stock reservation of an order follow its
+// status: a paid order's stock is taken for good, a cancelled order's is
+// given back, so that orders paid directly rather than through a checkout
+// are not released by the sweeper and sold twice. Confirming and releasing
+// are idempotent, so orders a checkout already settled are left as they
+// are. A failure is only logged, the status has changed either way.
+func settleReservation(ctx context.Context, order *db.Order) {
+	if order.ReservationID == "" {
+		return
+	}
+
+	var err error
+	switch order.Status {
+	case db.OrderPaid:
+		err = products.Confirm(ctx, order.ReservationID)
+	case db.OrderCancelled:
+		err = products.Release(ctx, order.ReservationID)
+	default:
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "UpdateOrderStatus: Failed to settle reservation", "order_id", order.ID, "reservation_id", order.ReservationID, "status", order.Status, "error", err)
+		trace.SpanFromContext(ctx).AddEvent("order.reservation_settle_failed", trace.WithAttributes(
+			attribute.String("order.id", order.ID),
+			attribute.String("reservation.id", order.ReservationID),
+			attribute.String("error", err.Error()),
+		))
+	}
+}
+
+// recordOrderRefund is called by payment-service after it refunded (part of)
+// the payment of an order
+func recordOrderRefund(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orderID := vars["orderId"]
+
+	var req struct {
+		PaymentID      string      `json:"paymentId"`
+		RefundID       string      `json:"refundId"`
+		RefundedAmount money.Money `json:"refundedAmount"`
+		FullyRefunded  bool        `json:"fullyRefunded"`
+		Reason         string      `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RefundedAmount.IsNegative() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Refunded amount must not be negative"})
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "refund " + req.RefundID
+	}
+
+	order, err := db.RecordOrderRefund(r.Context(), orderID, req.RefundedAmount, req.FullyRefunded, auth.UserID(r.Context()), reason)
+	if err != nil {
+		switch err.Error() {
+		case "order not found":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+		case "currency mismatch":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Refunded amount must be in the currency of the order"})
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).AddEvent("order.refund_recorded", trace.WithAttributes(
+		attribute.String("order.id", orderID),
+		attribute.String("payment.id", req.PaymentID),
+		attribute.String("refund.id", req.RefundID),
+		attribute.Float64("order.refunded_amount", order.RefundedAmount.Float64()),
+		attribute.String("order.currency", order.RefundedAmount.Currency),
+		attribute.String("order.status", order.Status),
+	))
+
+	json.NewEncoder(w).Encode(order)
+}
+
+func getOrderHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	orderID := vars["orderId"]
+
+	if !authorizeOrder(w, r, orderID) {
+		return
+	}
+
+	history, err := db.GetOrderStatusHistory(r.Context(), orderID)
+	if err != nil {
+		if err.Error() == "order not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
+
 func getUserOrders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	vars := mux.Vars(r)
 	userID := vars["userId"]
 
-	orders, err := db.GetUserOrders(userID)
+	if !auth.CanAccess(r.Context(), userID) {
+		auth.Forbid(w, r, "user", userID)
+		return
+	}
+
+	orders, err := db.GetUserOrders(r.Context(), userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -229,28 +779,38 @@ func handleSignup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Signup: Invalid request body: %v", err)
+		slog.WarnContext(r.Context(), "Signup: Invalid request body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Signup payload received - Email: '%s', Name: '%s', Password Length: %d", req.Email, req.Name, len(req.Password))
-	if len(req.Password) > 0 {
-		log.Printf("Signup password first char: '%c'", req.Password[0])
-	} else {
-		log.Println("Signup password is empty")
-	}
+	slog.InfoContext(r.Context(), "Signup attempt", "email", req.Email)
 
-	log.Printf("Signup attempt for email: %s", req.Email)
+	if problems := passwordPolicy.Validate(req.Password); len(problems) > 0 {
+		slog.InfoContext(r.Context(), "Signup: Password does not meet policy", "email", req.Email)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "Password does not meet requirements",
+			"details": problems,
+		})
+		return
+	}
 
 	// Check if user exists
-	existingUser, _ := db.GetUserByEmail(req.Email)
+	existingUser, _ := db.GetUserByEmail(r.Context(), req.Email)
 	if existingUser != nil {
-		log.Printf("Signup: User already exists: %s", req.Email)
+		slog.InfoContext(r.Context(), "Signup: User already exists", "email", req.Email)
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
 
+	passwordHash, err := passwordHasher.Hash(req.Password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Signup: Failed to hash password", "email", req.Email, "error", err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
 	// Create new user
 	// Generate ID
 	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
@@ -259,17 +819,25 @@ func handleSignup(w http.ResponseWriter, r *http.Request) {
 		ID:           userID,
 		Email:        req.Email,
 		Name:         req.Name,
-		PasswordHash: req.Password, // Insecure demo only
+		Role:         auth.RoleCustomer,
+		PasswordHash: passwordHash,
+	}
+
+	if err := db.CreateUser(r.Context(), user); err != nil {
+		slog.ErrorContext(r.Context(), "Signup: Failed to create user", "email", req.Email, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if err := db.CreateUser(user); err != nil {
-		log.Printf("Signup: Failed to create user %s: %v", req.Email, err)
+	session, err := newSession(r.Context(), &user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Signup: Failed to issue tokens", "user_id", user.ID, "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Signup successful for user: %s", req.Email)
-	json.NewEncoder(w).Encode(user)
+	slog.InfoContext(r.Context(), "Signup successful", "email", req.Email)
+	json.NewEncoder(w).Encode(session)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -281,38 +849,83 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Login: Invalid request body: %v", err)
+		slog.WarnContext(r.Context(), "Login: Invalid request body", "error", err)
+		recordLogin(r.Context(), loginInvalidRequest)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Login attempt for email: %s", req.Email)
+	slog.InfoContext(r.Context(), "Login attempt", "email", req.Email)
 
-	user, err := db.GetUserByEmail(req.Email)
+	user, err := db.GetUserByEmail(r.Context(), req.Email)
 	if err != nil {
-		log.Printf("Login: User not found or DB error for email %s: %v", req.Email, err)
+		slog.WarnContext(r.Context(), "Login: User not found or DB error", "email", req.Email, "error", err)
+		if err.Error() == "user not found" {
+			recordLogin(r.Context(), loginUnknownUser)
+		} else {
+			recordLogin(r.Context(), loginError)
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
 		return
 	}
 
-	// Simple password check (Insecure demo only)
-	if user.PasswordHash != req.Password {
-		log.Printf("Login: Password mismatch for email %s. Stored: '%s', Provided: '%s'", req.Email, user.PasswordHash, req.Password)
+	if !passwordHasher.Verify(req.Password, user.PasswordHash) {
+		slog.WarnContext(r.Context(), "Login: Password mismatch", "email", req.Email)
+		recordLogin(r.Context(), loginWrongPassword)
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
 		return
 	}
 
-	log.Printf("Login successful for email: %s", req.Email)
-	json.NewEncoder(w).Encode(user)
+	// Upgrade legacy plaintext passwords and outdated hashes now that we
+	// know the password
+	if passwordHasher.NeedsRehash(user.PasswordHash) {
+		if hash, err := passwordHasher.Hash(req.Password); err != nil {
+			slog.ErrorContext(r.Context(), "Login: Failed to rehash password", "user_id", user.ID, "error", err)
+		} else if err := db.UpdateUserPasswordHash(r.Context(), user.ID, hash); err != nil {
+			slog.ErrorContext(r.Context(), "Login: Failed to store rehashed password", "user_id", user.ID, "error", err)
+		} else {
+			slog.InfoContext(r.Context(), "Login: Rehashed password", "user_id", user.ID)
+		}
+	}
+
+	session, err := newSession(r.Context(), user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Login: Failed to issue tokens", "user_id", user.ID, "error", err)
+		recordLogin(r.Context(), loginError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Login successful", "email", req.Email)
+	recordLogin(r.Context(), "")
+	json.NewEncoder(w).Encode(session)
+}
+
+// resumeCheckouts resumes idle checkout sagas right away and then every
+// interval until ctx is cancelled
+func resumeCheckouts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checkouts.Resume(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func main() {
-	// Initialize OpenTelemetry
+	// Initialize OpenTelemetry. Logs are JSON from here on, and scrubbed of
+	// card numbers whatever ends up in a message.
 	ctx := context.Background()
-	shutdownTracer := telemetry.InitTracer(ctx)
-	defer shutdownTracer(ctx)
+	shutdownTelemetry := telemetry.Init(ctx)
+	defer shutdownTelemetry(ctx)
 
 	// Initialize OpenFeature provider
 	provider, err := flagd.NewProvider(
@@ -320,7 +933,7 @@ func main() {
 		flagd.WithPort(8013),
 	)
 	if err != nil {
-		log.Printf("Warning: Failed to create flagd provider: %v", err)
+		slog.Warn("Failed to create flagd provider", "error", err)
 	} else {
 		openfeature.SetProvider(provider)
 	}
@@ -328,23 +941,77 @@ func main() {
 	db.InitDB()
 	defer db.CloseDB()
 
+	if err := auth.Init(); err != nil {
+		slog.Error("Failed to initialize auth", "error", err)
+		os.Exit(1)
+	}
+	if ttl, err := time.ParseDuration(db.GetEnvOrDefault("AUTH_REFRESH_TOKEN_TTL", "168h")); err == nil {
+		refreshTokenTTL = ttl
+	} else {
+		slog.Warn("Invalid AUTH_REFRESH_TOKEN_TTL, using the default", "ttl", refreshTokenTTL.String(), "error", err)
+	}
+
+	if ttl, err := time.ParseDuration(db.GetEnvOrDefault("IDEMPOTENCY_KEY_TTL", "24h")); err == nil && ttl > 0 {
+		idempotency.TTL = ttl
+	} else {
+		slog.Warn("Invalid IDEMPOTENCY_KEY_TTL, using the default", "ttl", idempotency.TTL.String())
+	}
+
+	if limit, err := strconv.Atoi(db.GetEnvOrDefault("CART_MAX_ITEM_QUANTITY", "10")); err == nil && limit > 0 {
+		db.MaxItemQuantity = limit
+	} else {
+		slog.Warn("Invalid CART_MAX_ITEM_QUANTITY, using the default", "limit", db.MaxItemQuantity)
+	}
+
+	products = catalog.NewClient()
+	checkouts = &checkout.Orchestrator{Products: products, Payments: payments.NewClient(), IdleAfter: time.Minute, HoldTTL: 72 * time.Hour}
+	if idle, err := time.ParseDuration(db.GetEnvOrDefault("CHECKOUT_IDLE_AFTER", "1m")); err == nil && idle > 0 {
+		checkouts.IdleAfter = idle
+	} else {
+		slog.Warn("Invalid CHECKOUT_IDLE_AFTER, using the default", "idle", checkouts.IdleAfter.String())
+	}
+	if ttl, err := time.ParseDuration(db.GetEnvOrDefault("CHECKOUT_HOLD_TTL", "72h")); err == nil && ttl > 0 {
+		checkouts.HoldTTL = ttl
+	} else {
+		slog.Warn("Invalid CHECKOUT_HOLD_TTL, using the default", "ttl", checkouts.HoldTTL.String())
+	}
+	resumeInterval, err := time.ParseDuration(db.GetEnvOrDefault("CHECKOUT_RESUME_INTERVAL", "30s"))
+	if err != nil || resumeInterval <= 0 {
+		slog.Warn("Invalid CHECKOUT_RESUME_INTERVAL, using 30s", "error", err)
+		resumeInterval = 30 * time.Second
+	}
+
+	// Finish or roll back checkouts interrupted by a shutdown or a failed step
+	resumeCtx, stopResuming := context.WithCancel(ctx)
+	defer stopResuming()
+	go resumeCheckouts(resumeCtx, resumeInterval)
+
 	r := mux.NewRouter()
 
 	r.Use(enableCORS)
+	r.Use(auth.Middleware)
 
 	// Auth Routes
 	r.HandleFunc("/api/signup", handleSignup).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/login", handleLogin).Methods("POST", "OPTIONS")
-
-	r.HandleFunc("/api/carts", createCart).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/carts/{cartId}", getCart).Methods("GET", "OPTIONS")
-	r.HandleFunc("/api/carts/{cartId}/items", addItemToCart).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/carts/{cartId}/items/{productId}", removeItemFromCart).Methods("DELETE", "OPTIONS")
-
-	r.HandleFunc("/api/carts/{cartId}/orders", createOrder).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/orders/{orderId}", getOrder).Methods("GET", "OPTIONS")
-	r.HandleFunc("/api/orders/{orderId}/status", updateOrderStatus).Methods("PUT", "OPTIONS")
-	r.HandleFunc("/api/users/{userId}/orders", getUserOrders).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/token/refresh", handleRefreshToken).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/logout", handleLogout).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/api/carts", auth.Require(createCart)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/carts/{cartId}", auth.Require(getCart)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/carts/{cartId}/items", auth.Require(addItemToCart)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/carts/{cartId}/items/{productId}", auth.Require(removeItemFromCart)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/carts/{cartId}/items/{lineId}", auth.Require(updateCartItem)).Methods("PATCH")
+
+	r.HandleFunc("/api/carts/{cartId}/orders", auth.Require(idempotency.Middleware("orders", createOrder))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/carts/{cartId}/checkout", auth.Require(idempotency.Middleware("checkout", checkoutCart))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/checkouts/{checkoutId}", auth.Require(getCheckout)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/orders/{orderId}", auth.Require(getOrder)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/orders/{orderId}/status", auth.Require(updateOrderStatus)).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/api/orders/{orderId}/reservation/confirm", auth.RequireRole(confirmOrderReservation, auth.RoleService, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/orders/{orderId}/history", auth.Require(getOrderHistory)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/orders/{orderId}/refunds", auth.RequireRole(recordOrderRefund, auth.RoleService, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/users/{userId}/orders", auth.Require(getUserOrders)).Methods("GET", "OPTIONS")
 
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -352,7 +1019,25 @@ func main() {
 	}).Methods("GET", "OPTIONS")
 
 	port := "8002"
-	fmt.Printf("Cart & Order Service running on http://localhost:%s\n", port)
+	slog.Info("Cart & Order Service running", "url", "http://localhost:"+port)
 	handler := otelhttp.NewHandler(r, "cart-order-service")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), handler))
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGTERM finish the requests in flight, then flush logs, traces and
+	// metrics through the deferred shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down the server", "error", err)
+	}
 }
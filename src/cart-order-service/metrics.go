@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Cart and order metrics are recorded by the db package; logins are counted
+// here. Emails and user IDs are never attributes.
+
+var meter = otel.Meter("cart-order-service")
+
+var logins, _ = meter.Int64Counter("auth.logins",
+	metric.WithDescription("Login attempts by result, and reason for failures"))
+
+// Login failure reasons
+const (
+	loginInvalidRequest = "invalid_request"
+	loginUnknownUser    = "unknown_user"
+	loginWrongPassword  = "wrong_password"
+	loginError          = "error"
+)
+
+func recordLogin(ctx context.Context, failure string) {
+	result := "success"
+	if failure != "" {
+		result = "failure"
+	}
+	logins.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("result", result),
+		attribute.String("reason", failure),
+	))
+}
@@ -0,0 +1,271 @@
+// Package money represents amounts exactly, as an integer number of the
+// currency's minor unit (e.g. cents) together with the ISO 4217 currency
+// code, so that totals computed by one service match what another charges.
+//
+// In JSON an amount is an object holding a decimal string with exactly as
+// many decimals as the currency has:
+//
+//	{"amount": "19.99", "currency": "USD"}
+//
+// In the database amounts are DECIMAL columns with StoredDecimals decimals,
+// with the currency in a column of its own or implied by DefaultCurrency.
+// Currencies with more decimals, such as KWD, are known for parsing but
+// cannot be stored; see Storable.
+package money
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of amounts stored without one
+const DefaultCurrency = "USD"
+
+// exponents holds the number of decimals of the supported currencies
+var exponents = map[string]int{
+	"USD": 2, "EUR": 2, "GBP": 2, "CHF": 2, "CAD": 2, "AUD": 2, "NZD": 2,
+	"SEK": 2, "NOK": 2, "DKK": 2, "PLN": 2, "CZK": 2, "MXN": 2, "BRL": 2,
+	"INR": 2, "CNY": 2, "HKD": 2, "SGD": 2, "ZAR": 2, "AED": 2,
+	"JPY": 0, "KRW": 0, "CLP": 0, "VND": 0,
+	"BHD": 3, "KWD": 3, "JOD": 3, "OMR": 3,
+}
+
+// StoredDecimals is the scale of the DECIMAL columns amounts are stored in
+const StoredDecimals = 2
+
+// maxDigits keeps parsed amounts far away from overflowing int64
+const maxDigits = 15
+
+type Money struct {
+	// Amount is in the currency's minor unit
+	Amount   int64
+	Currency string
+}
+
+// New returns amount minor units of currency
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// Zero returns no money in currency
+func Zero(currency string) Money {
+	return New(0, currency)
+}
+
+// Supported reports whether currency is a known ISO 4217 code
+func Supported(currency string) bool {
+	_, ok := exponents[strings.ToUpper(currency)]
+	return ok
+}
+
+// Storable reports whether amounts in currency can be stored without
+// rounding, i.e. it is supported and has at most StoredDecimals decimals
+func Storable(currency string) bool {
+	return Supported(currency) && Exponent(currency) <= StoredDecimals
+}
+
+// Exponent returns the number of decimals of currency
+func Exponent(currency string) int {
+	if e, ok := exponents[strings.ToUpper(currency)]; ok {
+		return e
+	}
+	return 2
+}
+
+// Parse reads a decimal amount such as "19.99" or "-5" in currency. Decimals
+// beyond the currency's minor unit must be zero, so "1500.00" is a valid
+// JPY amount but "19.999" is no USD amount.
+func Parse(amount, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if !Supported(currency) {
+		return Money{}, fmt.Errorf("unsupported currency %q", currency)
+	}
+	exp := Exponent(currency)
+
+	s := strings.TrimSpace(amount)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("invalid amount %q", amount)
+	}
+	if len(frac) > exp {
+		if strings.Trim(frac[exp:], "0") != "" {
+			return Money{}, fmt.Errorf("amount %q has more than %d decimals for %s", amount, exp, currency)
+		}
+		frac = frac[:exp]
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	digits := strings.TrimLeft(whole+frac, "0")
+	if len(digits) > maxDigits {
+		return Money{}, fmt.Errorf("amount %q is too large", amount)
+	}
+	minor := int64(0)
+	if digits != "" {
+		minor, _ = strconv.ParseInt(digits, 10, 64)
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// FromFloat rounds amount, in major units, half away from zero to the
+// currency's minor unit. Only for amounts that are computed, e.g. converted
+// with an exchange rate, never for amounts that are stored or sent.
+func FromFloat(amount float64, currency string) Money {
+	// Round the shortest decimal that spells amount, so that 0.285 is 0.29
+	// even though the float is slightly less than that
+	exp := Exponent(currency)
+	s := strconv.FormatFloat(math.Abs(amount), 'f', -1, 64)
+	whole, frac, _ := strings.Cut(s, ".")
+	frac += strings.Repeat("0", exp+1)
+
+	minor, _ := strconv.ParseInt(whole+frac[:exp], 10, 64)
+	if frac[exp] >= '5' {
+		minor++
+	}
+	if amount < 0 {
+		minor = -minor
+	}
+	return New(minor, currency)
+}
+
+// Add returns m + o. Both must be in the same currency; the zero Money
+// takes the currency of the other.
+func (m Money) Add(o Money) Money {
+	currency := m.mustMatch(o)
+	return Money{Amount: m.Amount + o.Amount, Currency: currency}
+}
+
+// Sub returns m - o, see Add
+func (m Money) Sub(o Money) Money {
+	currency := m.mustMatch(o)
+	return Money{Amount: m.Amount - o.Amount, Currency: currency}
+}
+
+// Mul returns m times n, e.g. the price of a quantity
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than o,
+// see Add
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+	switch {
+	case m.Amount < o.Amount:
+		return -1
+	case m.Amount > o.Amount:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Mixing currencies is a bug in the caller, not bad input
+func (m Money) mustMatch(o Money) string {
+	switch {
+	case m.Currency == o.Currency:
+		return m.Currency
+	case m == Money{}:
+		return o.Currency
+	case o == Money{}:
+		return m.Currency
+	}
+	panic(fmt.Sprintf("money: mixing %s and %s", m.Currency, o.Currency))
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+// Decimal formats m in major units with the currency's decimals, e.g. "19.99"
+func (m Money) Decimal() string {
+	exp := Exponent(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	digits := fmt.Sprintf("%0*d", exp+1, amount)
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// Float64 returns m in major units, for metrics and span attributes only
+func (m Money) Float64() float64 {
+	return float64(m.Amount) / math.Pow10(Exponent(m.Currency))
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+type jsonMoney struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Currency})
+}
+
+// UnmarshalJSON reads the object written by MarshalJSON. The amount may also
+// be a JSON number, which is read as exactly the decimal it spells.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var in jsonMoney
+	if err := json.Unmarshal(data, &in); err != nil {
+		return fmt.Errorf("money must be an object with amount and currency: %w", err)
+	}
+	if in.Currency == "" {
+		return fmt.Errorf("money needs a currency")
+	}
+
+	amount := string(in.Amount)
+	if strings.HasPrefix(amount, `"`) {
+		if err := json.Unmarshal(in.Amount, &amount); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := Parse(amount, in.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount in a DECIMAL column; the currency is stored
+// separately. Amounts the column would round are refused.
+func (m Money) Value() (driver.Value, error) {
+	if !Storable(m.Currency) {
+		return nil, fmt.Errorf("%s amounts cannot be stored", m.Currency)
+	}
+	return m.Decimal(), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cart-order-service/auth"
+	"cart-order-service/db"
+)
+
+// authorizeCart reports whether the caller may access a cart. Otherwise it
+// has already written 404 or 403.
+func authorizeCart(w http.ResponseWriter, r *http.Request, cartID string) bool {
+	ownerID, err := db.GetCartOwner(r.Context(), cartID)
+	if err != nil {
+		if err.Error() == "cart not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Cart not found"})
+			return false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if !auth.CanAccess(r.Context(), ownerID) {
+		auth.Forbid(w, r, "cart", cartID)
+		return false
+	}
+	return true
+}
+
+// authorizeOrder reports whether the caller may access an order. Otherwise it
+// has already written 404 or 403.
+func authorizeOrder(w http.ResponseWriter, r *http.Request, orderID string) bool {
+	ownerID, err := db.GetOrderOwner(r.Context(), orderID)
+	if err != nil {
+		if err.Error() == "order not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if !auth.CanAccess(r.Context(), ownerID) {
+		auth.Forbid(w, r, "order", orderID)
+		return false
+	}
+	return true
+}
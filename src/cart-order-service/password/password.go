@@ -0,0 +1,246 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"cart-order-service/db"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes are stored in a self-describing, versioned format so that the
+// algorithm and its cost can change without invalidating existing rows:
+//
+//	argon2id: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//	bcrypt:   $2a$12$<salt+hash>
+//
+// Anything else is a legacy plaintext password from before hashing was
+// introduced; it still verifies, but NeedsRehash reports it so the caller can
+// replace it on the next successful login.
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// Hasher hashes and verifies passwords with the configured algorithm
+type Hasher struct {
+	Algorithm string
+
+	// argon2id parameters
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+
+	// bcrypt parameters
+	BcryptCost int
+}
+
+// NewHasher creates a Hasher configured from PASSWORD_HASH_ALGORITHM
+// (argon2id or bcrypt) and the argon2id/bcrypt cost variables
+func NewHasher() *Hasher {
+	return &Hasher{
+		Algorithm:   db.GetEnvOrDefault("PASSWORD_HASH_ALGORITHM", AlgorithmArgon2id),
+		Memory:      uint32(envInt("PASSWORD_ARGON2_MEMORY_KB", 64*1024)),
+		Iterations:  uint32(envInt("PASSWORD_ARGON2_ITERATIONS", 3)),
+		Parallelism: uint8(envInt("PASSWORD_ARGON2_PARALLELISM", 2)),
+		SaltLength:  16,
+		KeyLength:   32,
+		BcryptCost:  envInt("PASSWORD_BCRYPT_COST", 12),
+	}
+}
+
+// Hash returns the encoded hash of password
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether password matches the stored hash. Legacy plaintext
+// values are compared in constant time.
+func (h *Hasher) Verify(password, stored string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(stored)
+		if err != nil {
+			return false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	default:
+		return stored != "" && subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+	}
+}
+
+// NeedsRehash reports whether a stored value is plaintext, uses a different
+// algorithm than configured, or was hashed with weaker parameters
+func (h *Hasher) NeedsRehash(stored string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		if h.Algorithm != AlgorithmArgon2id {
+			return true
+		}
+		params, _, key, err := decodeArgon2id(stored)
+		if err != nil {
+			return true
+		}
+		return params.memory != h.Memory || params.iterations != h.Iterations ||
+			params.parallelism != h.Parallelism || uint32(len(key)) != h.KeyLength
+	case isBcrypt(stored):
+		if h.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		return err != nil || cost != h.BcryptCost
+	default:
+		return true
+	}
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// decodeArgon2id parses an encoded argon2id hash
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// Policy describes the requirements a new password must meet
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLetter bool
+	RequireDigit  bool
+	RequireUpper  bool
+	RequireSymbol bool
+}
+
+// NewPolicy creates a Policy from the PASSWORD_* environment variables
+func NewPolicy() Policy {
+	return Policy{
+		MinLength:     envInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:     envInt("PASSWORD_MAX_LENGTH", 128),
+		RequireLetter: envBool("PASSWORD_REQUIRE_LETTER", true),
+		RequireDigit:  envBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireUpper:  envBool("PASSWORD_REQUIRE_UPPER", false),
+		RequireSymbol: envBool("PASSWORD_REQUIRE_SYMBOL", false),
+	}
+}
+
+// Validate returns a user-facing description of every rule password breaks,
+// or nil if it satisfies the policy
+func (p Policy) Validate(password string) []string {
+	var problems []string
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d characters", p.MaxLength))
+	}
+
+	var letter, digit, upper, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+			if unicode.IsUpper(r) {
+				upper = true
+			}
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireLetter && !letter {
+		problems = append(problems, "must contain a letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.RequireUpper && !upper {
+		problems = append(problems, "must contain an uppercase letter")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+
+	return problems
+}
+
+func envInt(key string, defaultValue int) int {
+	if v, err := strconv.Atoi(db.GetEnvOrDefault(key, "")); err == nil {
+		return v
+	}
+	return defaultValue
+}
+
+func envBool(key string, defaultValue bool) bool {
+	if v, err := strconv.ParseBool(db.GetEnvOrDefault(key, "")); err == nil {
+		return v
+	}
+	return defaultValue
+}
@@ -0,0 +1,162 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHasher uses cheap parameters so the tests run quickly
+func testHasher(algorithm string) *Hasher {
+	return &Hasher{
+		Algorithm:   algorithm,
+		Memory:      1024,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+		BcryptCost:  bcrypt.MinCost,
+	}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmArgon2id, AlgorithmBcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			h := testHasher(algorithm)
+			hash, err := h.Hash("correct horse 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(hash, "correct horse") {
+				t.Fatalf("hash contains the password: %s", hash)
+			}
+			if !h.Verify("correct horse 1", hash) {
+				t.Error("the password does not verify against its hash")
+			}
+			if h.Verify("correct horse 2", hash) {
+				t.Error("a wrong password verifies")
+			}
+			if h.NeedsRehash(hash) {
+				t.Error("a fresh hash needs rehashing")
+			}
+		})
+	}
+}
+
+func TestHashFormat(t *testing.T) {
+	hash, err := testHasher(AlgorithmArgon2id).Hash("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("unexpected argon2id encoding: %s", hash)
+	}
+
+	hash, err = testHasher(AlgorithmBcrypt).Hash("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBcrypt(hash) {
+		t.Errorf("unexpected bcrypt encoding: %s", hash)
+	}
+}
+
+func TestHashIsSalted(t *testing.T) {
+	h := testHasher(AlgorithmArgon2id)
+	a, _ := h.Hash("secret123")
+	b, _ := h.Hash("secret123")
+	if a == b {
+		t.Error("hashing the same password twice gave the same hash")
+	}
+}
+
+func TestVerifyLegacyPlaintext(t *testing.T) {
+	h := testHasher(AlgorithmArgon2id)
+	if !h.Verify("secret123", "secret123") {
+		t.Error("a legacy plaintext password does not verify")
+	}
+	if h.Verify("secret124", "secret123") {
+		t.Error("a wrong password verifies against a legacy plaintext one")
+	}
+	if h.Verify("", "") {
+		t.Error("an empty password verifies against an empty stored value")
+	}
+	if !h.NeedsRehash("secret123") {
+		t.Error("a legacy plaintext password does not need rehashing")
+	}
+}
+
+func TestVerifyMalformedHash(t *testing.T) {
+	h := testHasher(AlgorithmArgon2id)
+	for _, stored := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$onlysalt",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$bad$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!$a2V5",
+	} {
+		if h.Verify("secret123", stored) {
+			t.Errorf("Verify accepted malformed hash %q", stored)
+		}
+		if !h.NeedsRehash(stored) {
+			t.Errorf("malformed hash %q does not need rehashing", stored)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon := testHasher(AlgorithmArgon2id)
+	argonHash, _ := argon.Hash("secret123")
+	bcryptHash, _ := testHasher(AlgorithmBcrypt).Hash("secret123")
+
+	if !argon.NeedsRehash(bcryptHash) {
+		t.Error("a bcrypt hash does not need rehashing when argon2id is configured")
+	}
+	if !testHasher(AlgorithmBcrypt).NeedsRehash(argonHash) {
+		t.Error("an argon2id hash does not need rehashing when bcrypt is configured")
+	}
+
+	stronger := testHasher(AlgorithmArgon2id)
+	stronger.Iterations = 2
+	if !stronger.NeedsRehash(argonHash) {
+		t.Error("a hash with fewer iterations does not need rehashing")
+	}
+	// It still verifies with the parameters it was created with
+	if !stronger.Verify("secret123", argonHash) {
+		t.Error("a hash with older parameters does not verify")
+	}
+
+	costlier := testHasher(AlgorithmBcrypt)
+	costlier.BcryptCost = bcrypt.MinCost + 1
+	if !costlier.NeedsRehash(bcryptHash) {
+		t.Error("a bcrypt hash with a lower cost does not need rehashing")
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	policy := Policy{MinLength: 8, MaxLength: 16, RequireLetter: true, RequireDigit: true}
+	tests := []struct {
+		password string
+		problems int
+	}{
+		{"secret123", 0},
+		{"short1", 1},
+		{"12345678", 1},
+		{"password", 1},
+		{"", 3},
+		{"averyveryverylongpassword1", 1},
+	}
+	for _, tt := range tests {
+		if got := policy.Validate(tt.password); len(got) != tt.problems {
+			t.Errorf("Validate(%q) = %v, want %d problems", tt.password, got, tt.problems)
+		}
+	}
+
+	strict := Policy{MinLength: 1, RequireUpper: true, RequireSymbol: true}
+	if got := strict.Validate("abc"); len(got) != 2 {
+		t.Errorf("Validate(%q) = %v, want 2 problems", "abc", got)
+	}
+	if got := strict.Validate("Abc!"); len(got) != 0 {
+		t.Errorf("Validate(%q) = %v, want none", "Abc!", got)
+	}
+}
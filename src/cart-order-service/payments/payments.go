@@ -0,0 +1,197 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cart-order-service/auth"
+	"cart-order-service/db"
+	"cart-order-service/money"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Client calls payment-service. Requests are traced with otelhttp so the
+// trace context of the caller is propagated to payment-service, and carry the
+// caller's access token (see auth.Transport).
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient creates a payment-service client from PAYMENT_SERVICE_URL
+func NewClient() *Client {
+	return &Client{
+		BaseURL: db.GetEnvOrDefault("PAYMENT_SERVICE_URL", "http://localhost:8003"),
+		HTTPClient: &http.Client{
+			Transport: otelhttp.NewTransport(auth.NewTransport("cart-order-service", http.DefaultTransport)),
+			Timeout:   15 * time.Second,
+		},
+	}
+}
+
+// Card is the Stripe PaymentMethod the browser tokenized the card into with
+// Stripe.js. Card details never reach cart-order-service; any sent with a
+// checkout are dropped. It is never persisted.
+type Card struct {
+	PaymentMethodID string `json:"paymentMethodId"`
+}
+
+type Payment struct {
+	ID            string      `json:"id"`
+	OrderID       string      `json:"orderId"`
+	Amount        money.Money `json:"amount"`
+	Status        string      `json:"status"`
+	TransactionID string      `json:"transactionId"`
+	ReviewStatus  string      `json:"reviewStatus"`
+}
+
+// Held reports whether the payment was authorized but held for fraud review.
+// payment-service captures it and marks the order paid if it is approved,
+// and voids it and cancels the order if it is declined.
+func (p *Payment) Held() bool {
+	return p.Status == StatusAuthorized && p.ReviewStatus == ReviewPending
+}
+
+// Payment statuses reported by payment-service
+const (
+	StatusRequiresAction    = "requires_action"
+	StatusProcessing        = "processing"
+	StatusAuthorized        = "authorized"
+	StatusCompleted         = "completed"
+	StatusPartiallyRefunded = "partially_refunded"
+
+	ReviewPending = "pending"
+)
+
+type clientIPKey struct{}
+
+// WithClientIP returns a context whose charges tell payment-service the
+// address the shopper checked out from, for its fraud rules
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// Authorize places a hold for an order's amount on the card without
+// capturing it; see Capture and Void. A payment held for fraud review is
+// returned too, see Payment.Held. A declined card, or one that needs
+// authentication the saga cannot complete, is returned as an error carrying
+// payment-service's message.
+func (c *Client) Authorize(ctx context.Context, orderID string, amount money.Money, card Card) (*Payment, error) {
+	req := struct {
+		OrderID       string      `json:"orderId"`
+		Amount        money.Money `json:"amount"`
+		CaptureMethod string      `json:"captureMethod"`
+		Card
+	}{orderID, amount, "manual", card}
+
+	var res struct {
+		Success bool    `json:"success"`
+		Message string  `json:"message"`
+		Payment Payment `json:"payment"`
+	}
+	// A retried charge for the same order is answered from payment-service's
+	// idempotency store instead of charging twice
+	header := http.Header{}
+	header.Set("Idempotency-Key", "order-"+orderID)
+	// payment-service scores the shopper's address, not ours
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok && ip != "" {
+		header.Set("X-Forwarded-For", ip)
+	}
+	status, err := c.do(ctx, http.MethodPost, "/api/payments", header, req, &res)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusAccepted && res.Payment.Held() {
+		return &res.Payment, nil
+	}
+	if status != http.StatusOK || !res.Success {
+		return nil, fmt.Errorf("payment failed: %s", res.Message)
+	}
+	return &res.Payment, nil
+}
+
+// Capture collects an authorized payment. Capturing a payment twice is not
+// an error.
+func (c *Client) Capture(ctx context.Context, paymentID string) error {
+	return c.post(ctx, paymentID, "capture")
+}
+
+// Void releases the hold of a payment that was authorized but not captured
+func (c *Client) Void(ctx context.Context, paymentID string) error {
+	return c.post(ctx, paymentID, "void")
+}
+
+// Refund refunds a completed payment
+func (c *Client) Refund(ctx context.Context, paymentID string) error {
+	return c.post(ctx, paymentID, "refund")
+}
+
+// post sends a bodiless POST to one of the action endpoints of a payment
+func (c *Client) post(ctx context.Context, paymentID, action string) error {
+	var res struct {
+		Error string `json:"error"`
+	}
+	status, err := c.do(ctx, http.MethodPost, "/api/payments/"+paymentID+"/"+action, nil, nil, &res)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("payment-service %s returned %d: %s", action, status, res.Error)
+	}
+	return nil
+}
+
+// GetByOrderID looks up the payment made for an order. It returns
+// "payment not found" if the order was never charged.
+func (c *Client) GetByOrderID(ctx context.Context, orderID string) (*Payment, error) {
+	var payment Payment
+	status, err := c.do(ctx, http.MethodGet, "/api/payments/order/"+orderID, nil, nil, &payment)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		return &payment, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("payment not found")
+	default:
+		return nil, fmt.Errorf("payment-service lookup returned %d", status)
+	}
+}
+
+// do sends body as JSON with the given extra headers and decodes the response
+// into out regardless of status, since payment-service reports failures in
+// the response body
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body, out interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, &buf)
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cart-order-service/auth"
+	"cart-order-service/db"
+)
+
+// refreshTokenTTL is how long a refresh token can be used before the user
+// has to log in again
+var refreshTokenTTL = 7 * 24 * time.Hour
+
+// Session is returned by signup, login and token refresh
+type Session struct {
+	User         *db.User `json:"user"`
+	AccessToken  string   `json:"accessToken"`
+	RefreshToken string   `json:"refreshToken"`
+	TokenType    string   `json:"tokenType"`
+	ExpiresIn    int      `json:"expiresIn"`
+}
+
+// newSession issues an access token and starts a new refresh token family
+func newSession(ctx context.Context, user *db.User) (*Session, error) {
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	familyID, err := generateFamilyID()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.CreateRefreshToken(ctx, user.ID, familyID, hashRefreshToken(refreshToken), refreshTokenTTL); err != nil {
+		return nil, err
+	}
+	return sessionWithRefreshToken(user, refreshToken)
+}
+
+// sessionWithRefreshToken issues an access token to go with refreshToken
+func sessionWithRefreshToken(user *db.User, refreshToken string) (*Session, error) {
+	accessToken, expiresAt, err := auth.IssueAccessToken(user.ID, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		User:         user,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expiresAt).Seconds()),
+	}, nil
+}
+
+func handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "refreshToken is required"})
+		return
+	}
+
+	newToken, err := generateRefreshToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := db.RotateRefreshToken(r.Context(), hashRefreshToken(req.RefreshToken), hashRefreshToken(newToken), refreshTokenTTL)
+	if err != nil {
+		switch err.Error() {
+		case "invalid refresh token", "refresh token expired", "refresh token reuse detected":
+			slog.WarnContext(r.Context(), "RefreshToken: Rejected", "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user, err := db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session, err := sessionWithRefreshToken(user, newToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(session)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "refreshToken is required"})
+		return
+	}
+
+	if err := db.RevokeRefreshTokenFamily(r.Context(), hashRefreshToken(req.RefreshToken)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// generateRefreshToken returns a random, URL-safe refresh token
+func generateRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// generateFamilyID returns a random refresh token family ID. It is
+// unrelated to the tokens of the family, so it reveals nothing about them.
+func generateFamilyID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "rtf_" + hex.EncodeToString(b), nil
+}
+
+// hashRefreshToken returns the SHA-256 hash stored in place of the token
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,65 @@
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/contrib/instrumentation/runtime"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// InitMeter initializes the OpenTelemetry meter provider with an OTLP
+// exporter, configured like that of traces (see otlp.go), that exports
+// every 60 seconds unless OTEL_METRIC_EXPORT_INTERVAL (in milliseconds)
+// says otherwise. Go runtime
+// and process metrics are collected from then on, and otelhttp handlers
+// and transports created afterwards record request counts, durations and
+// sizes. Returns a shutdown function that flushes pending metrics.
+func InitMeter(ctx context.Context) func(context.Context) error {
+	exporter, err := newMetricExporter(ctx)
+	if err != nil {
+		slog.Error("Failed to create OTLP metric exporter", "error", err)
+		return func(context.Context) error { return nil }
+	}
+
+	res, err := newResource()
+	if err != nil {
+		slog.Error("Failed to create resource", "error", err)
+		return func(context.Context) error { return nil }
+	}
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetMeterProvider(mp)
+
+	if err := runtime.Start(runtime.WithMeterProvider(mp)); err != nil {
+		slog.Error("Failed to start runtime metrics", "error", err)
+	}
+	if err := startProcessMetrics(mp); err != nil {
+		slog.Error("Failed to start process metrics", "error", err)
+	}
+
+	return mp.Shutdown
+}
+
+func newMetricExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	protocol := otlpProtocol("metrics")
+	endpoint := defaultEndpoint("metrics", protocol)
+	if protocol == protocolGRPC {
+		var opts []otlpmetricgrpc.Option
+		if endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpointURL(endpoint))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	}
+	var opts []otlpmetrichttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(endpoint))
+	}
+	return otlpmetrichttp.New(ctx, opts...)
+}
@@ -0,0 +1,86 @@
+package telemetry
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Process metrics follow the OpenTelemetry semantic conventions. Memory and
+// open files are read from /proc and left out where it does not exist.
+
+var (
+	cpuModeUser   = metric.WithAttributes(attribute.String("cpu.mode", "user"))
+	cpuModeSystem = metric.WithAttributes(attribute.String("cpu.mode", "system"))
+)
+
+// startProcessMetrics registers the process metrics with mp
+func startProcessMetrics(mp metric.MeterProvider) error {
+	meter := mp.Meter("telemetry/process")
+	started := time.Now()
+
+	cpuTime, err := meter.Float64ObservableCounter("process.cpu.time",
+		metric.WithUnit("s"), metric.WithDescription("CPU time used by the process"))
+	if err != nil {
+		return err
+	}
+	memory, err := meter.Int64ObservableUpDownCounter("process.memory.usage",
+		metric.WithUnit("By"), metric.WithDescription("Resident memory of the process"))
+	if err != nil {
+		return err
+	}
+	openFiles, err := meter.Int64ObservableUpDownCounter("process.open_file_descriptor.count",
+		metric.WithUnit("{file_descriptor}"), metric.WithDescription("File descriptors the process has open"))
+	if err != nil {
+		return err
+	}
+	uptime, err := meter.Float64ObservableGauge("process.uptime",
+		metric.WithUnit("s"), metric.WithDescription("Time since the process started"))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		var usage syscall.Rusage
+		if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err == nil {
+			o.ObserveFloat64(cpuTime, seconds(usage.Utime), cpuModeUser)
+			o.ObserveFloat64(cpuTime, seconds(usage.Stime), cpuModeSystem)
+		}
+		if rss, ok := residentMemory(); ok {
+			o.ObserveInt64(memory, rss)
+		}
+		if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+			o.ObserveInt64(openFiles, int64(len(fds)))
+		}
+		o.ObserveFloat64(uptime, time.Since(started).Seconds())
+		return nil
+	}, cpuTime, memory, openFiles, uptime)
+	return err
+}
+
+func seconds(t syscall.Timeval) float64 {
+	return float64(t.Sec) + float64(t.Usec)/1e6
+}
+
+// residentMemory reads the resident set size from /proc/self/statm
+func residentMemory() (int64, bool) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * int64(os.Getpagesize()), true
+}
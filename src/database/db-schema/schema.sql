@@ -13,24 +13,91 @@ CREATE TABLE IF NOT EXISTS products (
     sizes TEXT[],
     colors TEXT[],
     in_stock BOOLEAN DEFAULT true,
+    version INTEGER NOT NULL DEFAULT 1,
+    archived_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Product audit log: every change made through the admin catalog API. Rows are
+-- kept after the product is deleted.
+CREATE TABLE IF NOT EXISTS product_audit_log (
+    id SERIAL PRIMARY KEY,
+    product_id VARCHAR(50) NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    actor VARCHAR(50) NOT NULL,
+    version INTEGER NOT NULL,
+    before JSONB,
+    after JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Inventory table: stock per product variant (size + color)
+CREATE TABLE IF NOT EXISTS inventory (
+    product_id VARCHAR(50) NOT NULL,
+    size VARCHAR(20) NOT NULL DEFAULT '',
+    color VARCHAR(50) NOT NULL DEFAULT '',
+    on_hand INTEGER NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+    reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (product_id, size, color),
+    CHECK (reserved <= on_hand),
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+-- Stock reservations: temporary holds on inventory while an order is checked out
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id VARCHAR(50) PRIMARY KEY,
+    reference VARCHAR(100),
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Stock Reservation Items table
+CREATE TABLE IF NOT EXISTS stock_reservation_items (
+    id SERIAL PRIMARY KEY,
+    reservation_id VARCHAR(50) NOT NULL,
+    product_id VARCHAR(50) NOT NULL,
+    size VARCHAR(20) NOT NULL DEFAULT '',
+    color VARCHAR(50) NOT NULL DEFAULT '',
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    FOREIGN KEY (reservation_id) REFERENCES stock_reservations(id) ON DELETE CASCADE,
+    FOREIGN KEY (product_id, size, color) REFERENCES inventory(product_id, size, color) ON DELETE CASCADE
+);
+
 -- Users table
 CREATE TABLE IF NOT EXISTS users (
     id VARCHAR(50) PRIMARY KEY,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255),
     name VARCHAR(255),
+    role VARCHAR(20) NOT NULL DEFAULT 'customer',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Refresh Tokens table: server-side state of rotating refresh tokens. Only a
+-- SHA-256 hash of each token is stored; tokens issued from one login share a
+-- family so that reuse of a rotated token can revoke the whole chain.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id VARCHAR(50) PRIMARY KEY,
+    user_id VARCHAR(50) NOT NULL,
+    family_id VARCHAR(50) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
 -- Carts table
 CREATE TABLE IF NOT EXISTS carts (
     id VARCHAR(50) PRIMARY KEY,
     user_id VARCHAR(50) NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'USD',
     total DECIMAL(10, 2) DEFAULT 0.00,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -45,8 +112,8 @@ CREATE TABLE IF NOT EXISTS cart_items (
     product_name VARCHAR(255) NOT NULL,
     price DECIMAL(10, 2) NOT NULL,
     quantity INTEGER NOT NULL DEFAULT 1,
-    selected_size VARCHAR(20),
-    selected_color VARCHAR(50),
+    selected_size VARCHAR(20) NOT NULL DEFAULT '',
+    selected_color VARCHAR(50) NOT NULL DEFAULT '',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE CASCADE,
     FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
@@ -57,12 +124,29 @@ CREATE TABLE IF NOT EXISTS orders (
     id VARCHAR(50) PRIMARY KEY,
     user_id VARCHAR(50) NOT NULL,
     total DECIMAL(10, 2) NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+    -- Rates the catalog prices were converted with, for audit
+    exchange_rates JSONB NOT NULL DEFAULT '[]',
     status VARCHAR(50) DEFAULT 'pending',
+    reservation_id VARCHAR(50),
+    refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0.00,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- Order Status History table: every status change of an order
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id VARCHAR(50) NOT NULL,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    changed_by VARCHAR(100) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+);
+
 -- Order Items table
 CREATE TABLE IF NOT EXISTS order_items (
     id SERIAL PRIMARY KEY,
@@ -78,27 +162,162 @@ CREATE TABLE IF NOT EXISTS order_items (
     FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
 );
 
+-- Checkout Sagas table: persisted progress of server-side checkouts
+CREATE TABLE IF NOT EXISTS checkout_sagas (
+    id VARCHAR(50) PRIMARY KEY,
+    cart_id VARCHAR(50) NOT NULL,
+    order_id VARCHAR(50),
+    reservation_id VARCHAR(50),
+    payment_id VARCHAR(50),
+    step VARCHAR(50) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'running',
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Payments table
 CREATE TABLE IF NOT EXISTS payments (
     id VARCHAR(50) PRIMARY KEY,
     order_id VARCHAR(50) NOT NULL,
+    user_id VARCHAR(50),
     amount DECIMAL(10, 2) NOT NULL,
     currency VARCHAR(3) DEFAULT 'USD',
     status VARCHAR(50) DEFAULT 'pending',
     card_last_four VARCHAR(4),
     transaction_id VARCHAR(100),
+    capture_method VARCHAR(20) NOT NULL DEFAULT 'automatic',
+    intent_status VARCHAR(50),
+    captured_at TIMESTAMP,
+    -- Fraud assessment: payments scored review are held until an admin
+    -- approves or declines them
+    fraud_score INTEGER NOT NULL DEFAULT 0,
+    fraud_decision VARCHAR(10) NOT NULL DEFAULT 'allow',
+    fraud_reasons JSONB NOT NULL DEFAULT '[]',
+    card_fingerprint VARCHAR(64),
+    client_ip VARCHAR(45),
+    review_status VARCHAR(20),
+    reviewed_by VARCHAR(50),
+    reviewed_at TIMESTAMP,
+    review_note TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
 );
 
+-- Refunds: every refund issued against a payment. Pending and succeeded
+-- refunds count against the refundable balance of the payment.
+CREATE TABLE IF NOT EXISTS refunds (
+    id VARCHAR(50) PRIMARY KEY,
+    payment_id VARCHAR(50) NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL CHECK (amount > 0),
+    currency VARCHAR(3) NOT NULL,
+    reason TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    stripe_refund_id VARCHAR(100),
+    created_by VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (payment_id) REFERENCES payments(id) ON DELETE CASCADE
+);
+
+-- Stripe events received on the webhook, kept to skip redeliveries and to
+-- replay them
+CREATE TABLE IF NOT EXISTS stripe_events (
+    id VARCHAR(100) PRIMARY KEY,
+    type VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'received',
+    detail TEXT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP
+);
+
+-- Idempotency keys: the first response to a request sent with an
+-- Idempotency-Key header, replayed when the request is retried
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(50) NOT NULL,
+    owner VARCHAR(100) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'processing',
+    response_status INTEGER,
+    response_body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, owner, idempotency_key)
+);
+
+-- Columns added to existing tables after the initial release
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reservation_id VARCHAR(50);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'customer';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS user_id VARCHAR(50);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0.00;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS capture_method VARCHAR(20) NOT NULL DEFAULT 'automatic';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS intent_status VARCHAR(50);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS captured_at TIMESTAMP;
+ALTER TABLE carts ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange_rates JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS fraud_score INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS fraud_decision VARCHAR(10) NOT NULL DEFAULT 'allow';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS fraud_reasons JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS card_fingerprint VARCHAR(64);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS client_ip VARCHAR(45);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS review_status VARCHAR(20);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS reviewed_by VARCHAR(50);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS reviewed_at TIMESTAMP;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS review_note TEXT;
+
+-- Cart lines are unique per product variant. Merge the duplicate lines created
+-- before that was enforced.
+UPDATE cart_items SET selected_size = '' WHERE selected_size IS NULL;
+UPDATE cart_items SET selected_color = '' WHERE selected_color IS NULL;
+UPDATE cart_items c
+SET quantity = d.quantity
+FROM (
+    SELECT MIN(id) AS id, SUM(quantity) AS quantity
+    FROM cart_items
+    GROUP BY cart_id, product_id, selected_size, selected_color
+    HAVING COUNT(*) > 1
+) d
+WHERE c.id = d.id;
+DELETE FROM cart_items c
+USING cart_items k
+WHERE c.cart_id = k.cart_id AND c.product_id = k.product_id
+  AND c.selected_size = k.selected_size AND c.selected_color = k.selected_color
+  AND c.id > k.id;
+
 -- Indexes for better performance
 CREATE INDEX IF NOT EXISTS idx_products_category ON products(category);
 CREATE INDEX IF NOT EXISTS idx_products_name ON products(name);
+CREATE INDEX IF NOT EXISTS idx_product_audit_log_product_id ON product_audit_log(product_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
 CREATE INDEX IF NOT EXISTS idx_carts_user_id ON carts(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_variant ON cart_items(cart_id, product_id, selected_size, selected_color);
 CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id);
 CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
 CREATE INDEX IF NOT EXISTS idx_payments_order_id ON payments(order_id);
+CREATE INDEX IF NOT EXISTS idx_payments_user_id ON payments(user_id);
+CREATE INDEX IF NOT EXISTS idx_payments_transaction_id ON payments(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_payments_card_fingerprint ON payments(card_fingerprint, created_at);
+CREATE INDEX IF NOT EXISTS idx_payments_client_ip ON payments(client_ip, created_at);
+CREATE INDEX IF NOT EXISTS idx_payments_review_status ON payments(review_status);
+-- An order has at most one payment that did not fail, so that concurrent
+-- requests cannot charge it twice
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_order_id_active ON payments(order_id) WHERE status NOT IN ('failed', 'voided');
+CREATE INDEX IF NOT EXISTS idx_refunds_payment_id ON refunds(payment_id);
+CREATE INDEX IF NOT EXISTS idx_stripe_events_status ON stripe_events(status, received_at);
+CREATE INDEX IF NOT EXISTS idx_orders_reservation_id ON orders(reservation_id);
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id);
+CREATE INDEX IF NOT EXISTS idx_checkout_sagas_status ON checkout_sagas(status);
+CREATE INDEX IF NOT EXISTS idx_inventory_product_id ON inventory(product_id);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_status_expires ON stock_reservations(status, expires_at);
+CREATE INDEX IF NOT EXISTS idx_stock_reservation_items_reservation_id ON stock_reservation_items(reservation_id);
 
 -- Function to update the updated_at timestamp
 CREATE OR REPLACE FUNCTION update_updated_at_column()
@@ -110,14 +329,34 @@ END;
 $$ language 'plpgsql';
 
 -- Triggers to automatically update the updated_at column
+DROP TRIGGER IF EXISTS update_products_updated_at ON products;
 CREATE TRIGGER update_products_updated_at BEFORE UPDATE ON products
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
 
+DROP TRIGGER IF EXISTS update_inventory_updated_at ON inventory;
+CREATE TRIGGER update_inventory_updated_at BEFORE UPDATE ON inventory
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+DROP TRIGGER IF EXISTS update_stock_reservations_updated_at ON stock_reservations;
+CREATE TRIGGER update_stock_reservations_updated_at BEFORE UPDATE ON stock_reservations
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+DROP TRIGGER IF EXISTS update_carts_updated_at ON carts;
 CREATE TRIGGER update_carts_updated_at BEFORE UPDATE ON carts
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
 
+DROP TRIGGER IF EXISTS update_orders_updated_at ON orders;
 CREATE TRIGGER update_orders_updated_at BEFORE UPDATE ON orders
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
 
+DROP TRIGGER IF EXISTS update_checkout_sagas_updated_at ON checkout_sagas;
+CREATE TRIGGER update_checkout_sagas_updated_at BEFORE UPDATE ON checkout_sagas
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+DROP TRIGGER IF EXISTS update_payments_updated_at ON payments;
 CREATE TRIGGER update_payments_updated_at BEFORE UPDATE ON payments
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+DROP TRIGGER IF EXISTS update_refunds_updated_at ON refunds;
+CREATE TRIGGER update_refunds_updated_at BEFORE UPDATE ON refunds
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
\ No newline at end of file
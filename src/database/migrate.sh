@@ -53,4 +53,16 @@ else
     echo "Products table already has data, skipping initial data insertion."
 fi
 
+# Seed stock for every product variant that has no inventory row yet, so
+# databases created before the inventory table get stock as well
+echo "Seeding inventory for every product variant..."
+PGPASSWORD=$DB_PASSWORD psql -h $DB_HOST -p $DB_PORT -U $DB_USER -d $DB_NAME -c "
+INSERT INTO inventory (product_id, size, color, on_hand)
+SELECT p.id, s.size, c.color, 10
+FROM products p
+CROSS JOIN LATERAL unnest(COALESCE(NULLIF(p.sizes, '{}'), ARRAY[''])) AS s(size)
+CROSS JOIN LATERAL unnest(COALESCE(NULLIF(p.colors, '{}'), ARRAY[''])) AS c(color)
+ON CONFLICT (product_id, size, color) DO NOTHING;
+"
+
 echo "Migration script completed!"
\ No newline at end of file
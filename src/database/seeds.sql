@@ -8,3 +8,12 @@ INSERT INTO products (id, name, category, price, image, description, rating, rev
 ('7', 'Premium Denim Jeans', 'Bottoms', 950, '/assets/premium_denim_jeans.png', 'High-quality denim with Versace branding. Modern and versatile.', 4.7, 203, ARRAY['24', '25', '26', '27', '28', '29', '30', '31', '32'], ARRAY['Dark Blue', 'Light Blue', 'Black'], true),
 ('8', 'Silk Evening Gown', 'Dresses', 4500, '/assets/silk_evening_gown.png', 'Breathtaking silk gown for special occasions. Haute couture elegance.', 5.0, 87, ARRAY['XS', 'S', 'M', 'L'], ARRAY['Black', 'Red', 'White'], true)
 ON CONFLICT (id) DO NOTHING;
+
+-- Seed 10 units of every size/color combination of every product. A product
+-- without sizes or colors has a single variant with an empty size or color.
+INSERT INTO inventory (product_id, size, color, on_hand)
+SELECT p.id, s.size, c.color, 10
+FROM products p
+CROSS JOIN LATERAL unnest(COALESCE(NULLIF(p.sizes, '{}'), ARRAY[''])) AS s(size)
+CROSS JOIN LATERAL unnest(COALESCE(NULLIF(p.colors, '{}'), ARRAY[''])) AS c(color)
+ON CONFLICT (product_id, size, color) DO NOTHING;
@@ -6,29 +6,104 @@ export interface PaymentResponse {
     success: boolean;
     message: string;
     payment?: any;
+    // Set when the card needs 3-D Secure; complete it with Stripe.js
+    clientSecret?: string;
+    nextAction?: any;
 }
 
 
+export interface Session {
+    user: any;
+    accessToken: string;
+    refreshToken: string;
+    tokenType: string;
+    expiresIn: number;
+}
+
+const SESSION_KEY = 'session';
+
+const getSession = (): Session | null => {
+    const stored = localStorage.getItem(SESSION_KEY);
+    if (!stored) return null;
+    try {
+        return JSON.parse(stored);
+    } catch {
+        return null;
+    }
+};
+
+const storeSession = (session: Session) => {
+    localStorage.setItem(SESSION_KEY, JSON.stringify(session));
+};
+
+export const clearSession = () => {
+    localStorage.removeItem(SESSION_KEY);
+};
+
+// refreshSession rotates the refresh token; the old one is revoked server-side.
+const refreshSession = async (): Promise<Session | null> => {
+    const session = getSession();
+    if (!session) return null;
+
+    const response = await fetch(`${API_CONFIG.AUTH_SERVICE}/api/token/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refreshToken: session.refreshToken }),
+    });
+    if (!response.ok) {
+        clearSession();
+        return null;
+    }
+
+    const refreshed: Session = await response.json();
+    storeSession(refreshed);
+    return refreshed;
+};
+
+// authFetch sends the access token and retries once with a refreshed token
+// when it has expired.
+const authFetch = async (url: string, init: RequestInit = {}): Promise<Response> => {
+    const withToken = (session: Session | null): RequestInit => ({
+        ...init,
+        headers: {
+            ...(init.headers || {}),
+            ...(session ? { Authorization: `Bearer ${session.accessToken}` } : {}),
+        },
+    });
+
+    const response = await fetch(url, withToken(getSession()));
+    if (response.status !== 401) return response;
+
+    const refreshed = await refreshSession();
+    return refreshed ? fetch(url, withToken(refreshed)) : response;
+};
+
+// Money is an exact amount: a decimal string with as many decimals as the
+// currency has, e.g. { amount: '19.99', currency: 'USD' }.
+export interface Money {
+    amount: string;
+    currency: string;
+}
+
 export interface CartResponse {
     id: string;
     userId: string;
     items: any[];
-    total: number;
+    total: Money;
 }
 
 export interface OrderResponse {
     id: string;
     userId: string;
     items: any[];
-    total: number;
+    total: Money;
     status: string;
 }
 
-export const createCart = async (userId: string = 'user123'): Promise<CartResponse> => {
-    const response = await fetch(`${API_CONFIG.CART_SERVICE}/api/carts`, {
+export const createCart = async (): Promise<CartResponse> => {
+    const response = await authFetch(`${API_CONFIG.CART_SERVICE}/api/carts`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ userId }),
     });
     if (!response.ok) throw new Error('Failed to create cart');
     return response.json();
@@ -39,13 +114,11 @@ export const addItemToCart = async (cartId: string, item: any): Promise<any> =>
     console.log(`Adding item to cart: ${url}`, item);
 
     try {
-        const response = await fetch(url, {
+        const response = await authFetch(url, {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({
                 productId: item.product.id,
-                productName: item.product.name,
-                price: item.product.price,
                 quantity: item.quantity,
                 selectedSize: item.selectedSize,
                 selectedColor: item.selectedColor,
@@ -64,29 +137,80 @@ export const addItemToCart = async (cartId: string, item: any): Promise<any> =>
     }
 };
 
+// Requests that create orders or charge cards carry an idempotency key so that
+// a retried request is answered with the original response instead of being
+// processed twice. The key is created once per attempt and sent again with
+// every retry of it; network errors and server errors are retried, since the
+// server does not store those responses.
+const IDEMPOTENT_ATTEMPTS = 3;
+
+const idempotentFetch = async (url: string, init: RequestInit = {}): Promise<Response> => {
+    const idempotencyKey = crypto.randomUUID();
+    const request: RequestInit = {
+        ...init,
+        headers: {
+            ...(init.headers || {}),
+            'Content-Type': 'application/json',
+            'Idempotency-Key': idempotencyKey,
+        },
+    };
+
+    for (let attempt = 1; ; attempt++) {
+        try {
+            const response = await authFetch(url, request);
+            if (response.status < 500 || attempt >= IDEMPOTENT_ATTEMPTS) return response;
+        } catch (error) {
+            if (attempt >= IDEMPOTENT_ATTEMPTS) throw error;
+        }
+        await new Promise((resolve) => setTimeout(resolve, 500 * 2 ** (attempt - 1)));
+    }
+};
+
 export const createOrder = async (cartId: string): Promise<OrderResponse> => {
-    const response = await fetch(`${API_CONFIG.CART_SERVICE}/api/carts/${cartId}/orders`, {
+    const response = await idempotentFetch(`${API_CONFIG.CART_SERVICE}/api/carts/${cartId}/orders`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
     });
     if (!response.ok) throw new Error('Failed to create order');
     return response.json();
 };
 
+export interface CheckoutResponse {
+    checkout: {
+        id: string;
+        status: string;
+        step: string;
+        error?: string;
+    };
+    order?: OrderResponse;
+    payment?: any;
+    error?: string;
+}
+
+// checkout runs order creation, stock reservation and payment as one
+// server-side saga; on failure the cart-order-service rolls all steps back.
+export const checkout = async (cartId: string, details: PaymentDetails): Promise<CheckoutResponse> => {
+    const response = await idempotentFetch(`${API_CONFIG.CART_SERVICE}/api/carts/${cartId}/checkout`, {
+        method: 'POST',
+        body: JSON.stringify({
+            currency: 'USD',
+            paymentMethodId: details.paymentMethodId,
+        }),
+    });
+
+    const data: CheckoutResponse = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || 'Checkout failed');
+    }
+    return data;
+};
+
 export const processPayment = async (details: PaymentDetails, amount: number, orderId: string): Promise<PaymentResponse> => {
-    const response = await fetch(`${API_CONFIG.PAYMENT_SERVICE}/api/payments`, {
+    const response = await idempotentFetch(`${API_CONFIG.PAYMENT_SERVICE}/api/payments`, {
         method: 'POST',
-        headers: {
-            'Content-Type': 'application/json',
-        },
         body: JSON.stringify({
             orderId,
-            amount,
-            currency: 'USD',
-            cardNumber: details.cardNumber,
-            cardHolder: details.cardHolder,
-            expiryDate: details.expiryDate,
-            cvv: details.cvv,
+            amount: { amount: amount.toFixed(2), currency: 'USD' },
+            paymentMethodId: details.paymentMethodId,
         }),
     });
 
@@ -115,7 +239,9 @@ export const signup = async (name: string, email: string, password: string): Pro
         }
         throw new Error(errorMessage);
     }
-    return response.json();
+    const session: Session = await response.json();
+    storeSession(session);
+    return session.user;
 };
 
 export const login = async (email: string, password: string): Promise<any> => {
@@ -135,6 +261,19 @@ export const login = async (email: string, password: string): Promise<any> => {
         }
         throw new Error(errorMessage);
     }
-    return response.json();
+    const session: Session = await response.json();
+    storeSession(session);
+    return session.user;
 };
 
+export const logout = async (): Promise<void> => {
+    const session = getSession();
+    clearSession();
+    if (!session) return;
+
+    await fetch(`${API_CONFIG.AUTH_SERVICE}/api/logout`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refreshToken: session.refreshToken }),
+    });
+};
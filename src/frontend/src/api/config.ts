@@ -5,4 +5,10 @@ export const API_CONFIG = {
     CART_SERVICE: import.meta.env.VITE_CART_SERVICE_URL || 'http://localhost:8002',
     // Auth endpoints use cart-order-service but at the API root, not under /api/carts
     AUTH_SERVICE: import.meta.env.VITE_AUTH_SERVICE_URL || 'http://localhost:8002',
+    // Publishable key used by Stripe.js to tokenize cards in the browser
+    STRIPE_PUBLISHABLE_KEY: import.meta.env.VITE_STRIPE_PUBLISHABLE_KEY || '',
+    // In test mode shoppers pick one of Stripe's test PaymentMethods instead
+    // of entering a card, for payment-service's fake provider or stripe-mock,
+    // which Stripe.js cannot tokenize cards for
+    PAYMENT_TEST_MODE: import.meta.env.VITE_PAYMENT_TEST_MODE === 'true',
 };
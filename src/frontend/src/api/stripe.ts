@@ -0,0 +1,67 @@
+import { API_CONFIG } from './config';
+
+// Stripe.js is loaded from js.stripe.com by index.html, as Stripe requires.
+// Card details are entered in Stripe's own iframe and exchanged for a
+// PaymentMethod ID, so they never reach our services.
+
+export interface StripeCardElement {
+    mount: (element: HTMLElement) => void;
+    destroy: () => void;
+    clear: () => void;
+}
+
+interface StripeElements {
+    create: (type: 'card', options?: { hidePostalCode?: boolean }) => StripeCardElement;
+}
+
+interface PaymentMethodResult {
+    paymentMethod?: { id: string };
+    error?: { message?: string };
+}
+
+export interface StripeClient {
+    elements: () => StripeElements;
+    createPaymentMethod: (params: {
+        type: 'card';
+        card: StripeCardElement;
+        billing_details?: { name?: string; email?: string };
+    }) => Promise<PaymentMethodResult>;
+}
+
+declare global {
+    interface Window {
+        Stripe?: (publishableKey: string) => StripeClient;
+    }
+}
+
+let stripe: StripeClient | null = null;
+
+export const getStripe = (): StripeClient => {
+    if (stripe) return stripe;
+    if (!window.Stripe) throw new Error('Stripe.js failed to load');
+    if (!API_CONFIG.STRIPE_PUBLISHABLE_KEY) throw new Error('VITE_STRIPE_PUBLISHABLE_KEY is not set');
+    stripe = window.Stripe(API_CONFIG.STRIPE_PUBLISHABLE_KEY);
+    return stripe;
+};
+
+// Stripe's test PaymentMethods offered in test mode. payment-service's fake
+// provider and stripe-mock accept them without a card being tokenized.
+export const TEST_PAYMENT_METHODS = [
+    { id: 'pm_card_visa', label: 'Visa •••• 4242 (approved)' },
+    { id: 'pm_card_mastercard', label: 'Mastercard •••• 4444 (approved)' },
+    { id: 'pm_card_amex', label: 'American Express •••• 0005 (approved)' },
+    { id: 'pm_card_chargeDeclined', label: 'Visa •••• 0002 (declined)' },
+    { id: 'pm_card_chargeDeclinedInsufficientFunds', label: 'Visa •••• 9995 (insufficient funds)' },
+];
+
+// createPaymentMethod tokenizes the card entered in a card element.
+export const createPaymentMethod = async (
+    card: StripeCardElement,
+    billingDetails: { name?: string; email?: string },
+): Promise<string> => {
+    const result = await getStripe().createPaymentMethod({ type: 'card', card, billing_details: billingDetails });
+    if (result.error || !result.paymentMethod) {
+        throw new Error(result.error?.message || 'Card could not be verified');
+    }
+    return result.paymentMethod.id;
+};
@@ -1,6 +1,8 @@
 import { X } from 'lucide-react';
-import { useState } from 'react';
+import { useEffect, useRef, useState } from 'react';
 import { CartItem, PaymentDetails } from '../types';
+import { API_CONFIG } from '../api/config';
+import { createPaymentMethod, getStripe, StripeCardElement, TEST_PAYMENT_METHODS } from '../api/stripe';
 
 interface CheckoutModalProps {
   isOpen: boolean;
@@ -17,31 +19,59 @@ export const CheckoutModal = ({
   onClose,
   onSubmit,
 }: CheckoutModalProps) => {
-  const [formData, setFormData] = useState<PaymentDetails>({
-    cardNumber: '',
-    cardHolder: '',
-    expiryDate: '',
-    cvv: '',
-  });
-
+  const [cardHolder, setCardHolder] = useState('');
   const [email, setEmail] = useState('');
   const [address, setAddress] = useState('');
   const [processing, setProcessing] = useState(false);
+  const [cardError, setCardError] = useState('');
+  const [testPaymentMethod, setTestPaymentMethod] = useState(TEST_PAYMENT_METHODS[0].id);
 
-  const handleChange = (e: React.ChangeEvent<HTMLInputElement>) => {
-    const { name, value } = e.target;
-    setFormData((prev) => ({ ...prev, [name]: value }));
-  };
+  // The card number, expiry and CVC are entered in Stripe's card element,
+  // which is mounted here while the modal is open. Test mode needs no card.
+  const cardContainer = useRef<HTMLDivElement>(null);
+  const cardElement = useRef<StripeCardElement | null>(null);
+
+  useEffect(() => {
+    if (!isOpen || API_CONFIG.PAYMENT_TEST_MODE || !cardContainer.current) return;
+    try {
+      const card = getStripe().elements().create('card', { hidePostalCode: true });
+      card.mount(cardContainer.current);
+      cardElement.current = card;
+      setCardError('');
+    } catch (error: any) {
+      setCardError(error.message);
+    }
+    return () => {
+      cardElement.current?.destroy();
+      cardElement.current = null;
+    };
+  }, [isOpen]);
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
+    if (!API_CONFIG.PAYMENT_TEST_MODE && !cardElement.current) {
+      setCardError('Card entry is unavailable, please reload the page');
+      return;
+    }
     setProcessing(true);
+    setCardError('');
+
+    let paymentMethodId = testPaymentMethod;
+    try {
+      if (!API_CONFIG.PAYMENT_TEST_MODE) {
+        paymentMethodId = await createPaymentMethod(cardElement.current!, { name: cardHolder, email });
+      }
+    } catch (error: any) {
+      setCardError(error.message);
+      setProcessing(false);
+      return;
+    }
 
     try {
-      // onSubmit now returns a Promise
-      await onSubmit(formData);
+      await onSubmit({ paymentMethodId });
 
-      setFormData({ cardNumber: '', cardHolder: '', expiryDate: '', cvv: '' });
+      cardElement.current?.clear();
+      setCardHolder('');
       setEmail('');
       setAddress('');
     } catch (error) {
@@ -117,53 +147,46 @@ export const CheckoutModal = ({
 
             <div>
               <h3 className="text-lg font-bold mb-4">Payment Information</h3>
-              <p className="text-sm text-gray-600 mb-3">
-                💳 Test Mode: Use card number <code className="bg-gray-100 px-2 py-1 rounded">4242424242424242</code> with any future expiry and CVV
-              </p>
+              {API_CONFIG.PAYMENT_TEST_MODE ? (
+                <p className="text-sm text-gray-600 mb-3">
+                  💳 Test Mode: Choose one of Stripe's test cards, no card details needed
+                </p>
+              ) : (
+                <p className="text-sm text-gray-600 mb-3">
+                  💳 Test Mode: Use card number <code className="bg-gray-100 px-2 py-1 rounded">4242424242424242</code> with any future expiry and CVC
+                </p>
+              )}
               <div className="space-y-3">
-                <input
-                  type="text"
-                  name="cardNumber"
-                  placeholder="4242424242424242 (Test Card)"
-                  value={formData.cardNumber}
-                  onChange={handleChange}
-                  required
-                  maxLength={19}
-                  className="w-full px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-black"
-                />
-
                 <input
                   type="text"
                   name="cardHolder"
                   placeholder="Cardholder Name"
-                  value={formData.cardHolder}
-                  onChange={handleChange}
+                  value={cardHolder}
+                  onChange={(e) => setCardHolder(e.target.value)}
                   required
                   className="w-full px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-black"
                 />
 
-                <div className="grid grid-cols-2 gap-3">
-                  <input
-                    type="text"
-                    name="expiryDate"
-                    placeholder="MM/YY"
-                    value={formData.expiryDate}
-                    onChange={handleChange}
-                    required
-                    maxLength={5}
-                    className="px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-black"
+                {API_CONFIG.PAYMENT_TEST_MODE ? (
+                  <select
+                    name="testPaymentMethod"
+                    value={testPaymentMethod}
+                    onChange={(e) => setTestPaymentMethod(e.target.value)}
+                    className="w-full px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-black"
+                  >
+                    {TEST_PAYMENT_METHODS.map((method) => (
+                      <option key={method.id} value={method.id}>
+                        {method.label}
+                      </option>
+                    ))}
+                  </select>
+                ) : (
+                  <div
+                    ref={cardContainer}
+                    className="w-full px-4 py-3 border border-gray-300 rounded-lg"
                   />
-                  <input
-                    type="text"
-                    name="cvv"
-                    placeholder="CVV"
-                    value={formData.cvv}
-                    onChange={handleChange}
-                    required
-                    maxLength={4}
-                    className="px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-black"
-                  />
-                </div>
+                )}
+                {cardError && <p className="text-sm text-red-600">{cardError}</p>}
               </div>
             </div>
 
@@ -1,6 +1,7 @@
 import { ShoppingBag, Menu, X, Search, User } from 'lucide-react';
 import { useState, useEffect } from 'react';
 import { Link } from 'react-router-dom';
+import { logout } from '../api/client';
 
 interface HeaderProps {
   cartItemsCount: number;
@@ -22,8 +23,13 @@ export const Header = ({ cartItemsCount, onCartClick }: HeaderProps) => {
     }
   }, []);
 
-  const handleLogout = () => {
+  const handleLogout = async () => {
     localStorage.removeItem('user');
+    try {
+      await logout();
+    } catch (e) {
+      console.error("Failed to revoke session", e);
+    }
     window.location.href = '/';
   };
 
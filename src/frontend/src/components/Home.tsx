@@ -10,7 +10,7 @@ import { SuccessOverlay } from './SuccessOverlay';
 import { useCart } from '../hooks/useCart';
 import { products } from '../data/products';
 import { Product, PaymentDetails } from '../types';
-import { processPayment, createCart, addItemToCart, createOrder } from '../api/client';
+import { createCart, addItemToCart, checkout } from '../api/client';
 
 export function Home() {
     const [selectedProduct, setSelectedProduct] = useState<Product | null>(null);
@@ -45,12 +45,8 @@ export function Home() {
 
     const handleCheckout = async (paymentDetails: PaymentDetails) => {
         try {
-            // 1. Create a cart in the backend
-            const storedUser = localStorage.getItem('user');
-            const user = storedUser ? JSON.parse(storedUser) : null;
-            const userId = user ? user.id : 'guest';
-
-            const cart = await createCart(userId);
+            // 1. Create a cart in the backend for the signed-in user
+            const cart = await createCart();
             const cartId = cart.id;
 
             // 2. Add each item to the backend cart
@@ -58,12 +54,8 @@ export function Home() {
                 await addItemToCart(cartId, item);
             }
 
-            // 3. Create an order from the cart
-            const order = await createOrder(cartId);
-            const orderId = order.id;
-
-            // 4. Process payment for the newly created order
-            await processPayment(paymentDetails, order.total, orderId);
+            // 3. Create the order, reserve stock and pay in one server-side checkout
+            await checkout(cartId, paymentDetails);
 
             console.log('Payment successful');
             setCheckoutOpen(false);
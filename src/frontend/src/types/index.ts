@@ -27,9 +27,8 @@ export interface Order {
   createdAt: string;
 }
 
+// PaymentDetails holds the Stripe PaymentMethod ID the card was tokenized
+// into; card numbers never leave the browser.
 export interface PaymentDetails {
-  cardNumber: string;
-  cardHolder: string;
-  expiryDate: string;
-  cvv: string;
+  paymentMethodId: string;
 }
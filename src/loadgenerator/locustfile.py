@@ -1,15 +1,35 @@
 import os
+import random
+import time
 from locust import HttpUser, task, between
 
 PRODUCT_SERVICE_HOST = os.getenv("PRODUCT_SERVICE_URL", "http://product-service.apps.svc.cluster.local:8001")
 CART_SERVICE_HOST = os.getenv("CART_SERVICE_URL", "http://cart-order-service.apps.svc.cluster.local:8002")
 PAYMENT_SERVICE_HOST = os.getenv("PAYMENT_SERVICE_URL", "http://payment-service.apps.svc.cluster.local:8003")
 
+# Stripe test PaymentMethods that are approved. Shoppers pay with different
+# cards so that payment-service's fraud rules do not see one card paying for
+# every order.
+PAYMENT_METHODS = ["pm_card_visa", "pm_card_mastercard", "pm_card_amex", "pm_card_discover", "pm_card_visa_debit", "pm_card_mastercard_debit"]
+
+# A shopper checks out at most every CHECKOUT_INTERVAL seconds, which stays
+# below the fraud rules' limit of 5 payments per user in 10 minutes
+CHECKOUT_INTERVAL = 150
+
 class WebsiteUser(HttpUser):
     wait_time = between(1, 5)
 
     def on_start(self):
         self.cart_id = None
+        self.last_checkout = 0
+        # Each shopper has an address of its own. payment-service takes the
+        # last hop of X-Forwarded-For, as the ingress appends it.
+        self.ip = f"10.{random.randint(0, 255)}.{random.randint(0, 255)}.{random.randint(1, 254)}"
+        self.payment_method = random.choice(PAYMENT_METHODS)
+        self.user_id = None
+        self.headers = {}
+        self.refresh_token = None
+        self.refresh_at = 0
         # Generate random user credentials
         random_hex = os.urandom(4).hex()
         self.user_email = f"user_{random_hex}@example.com"
@@ -26,8 +46,7 @@ class WebsiteUser(HttpUser):
         # Using CART_SERVICE_HOST as it maps to the same service
         with self.client.post(f"{CART_SERVICE_HOST}/api/signup", json=signup_payload, name="/api/signup", catch_response=True) as response:
             if response.status_code == 200:
-                self.user = response.json()
-                self.user_id = self.user.get("id")
+                self.start_session(response.json())
             elif response.status_code == 409:
                 # User exists (unlikely with random hex but handled)
                 pass 
@@ -35,6 +54,26 @@ class WebsiteUser(HttpUser):
                 print(f"Failed to signup user: {response.text}")
                 self.user_id = "guest" # Fallback, might fail if guest not supported
 
+    def start_session(self, session):
+        """Keep the tokens of a session returned by signup or token refresh."""
+        self.user = session["user"]
+        self.user_id = self.user["id"]
+        self.refresh_token = session["refreshToken"]
+        # Refresh a minute before the access token expires
+        self.refresh_at = time.time() + session["expiresIn"] - 60
+        self.headers = {"Authorization": f"Bearer {session['accessToken']}"}
+
+    def refresh_session(self):
+        """Swap the refresh token for a new access token when it is about to expire."""
+        if time.time() < self.refresh_at:
+            return True
+        with self.client.post(f"{CART_SERVICE_HOST}/api/token/refresh", json={"refreshToken": self.refresh_token}, name="/api/token/refresh", catch_response=True) as response:
+            if response.status_code == 200:
+                self.start_session(response.json())
+                return True
+            response.failure(f"Failed to refresh token: {response.text}")
+            return False
+
     @task(3)
     def browse_products(self):
         # Visit product listing
@@ -45,42 +84,56 @@ class WebsiteUser(HttpUser):
         if not self.user_id or self.user_id == "guest":
              # Try to register again if failed previously or skip
              return
+        if time.time() - self.last_checkout < CHECKOUT_INTERVAL:
+            return
+        self.last_checkout = time.time()
+        if not self.refresh_session():
+            return
+
+        # Pick a product to buy, so that orders have different amounts
+        product = None
+        with self.client.get(f"{PRODUCT_SERVICE_HOST}/api/products", name="/api/products", catch_response=True) as response:
+            if response.status_code == 200 and response.json():
+                product = random.choice(response.json())
+            else:
+                response.failure(f"Failed to list products: {response.text}")
+                return
 
         # 1. Create Cart
-        with self.client.post(f"{CART_SERVICE_HOST}/api/carts", json={"userId": self.user_id}, name="/api/carts [Create]", catch_response=True) as response:
+        with self.client.post(f"{CART_SERVICE_HOST}/api/carts", headers=self.headers, name="/api/carts [Create]", catch_response=True) as response:
             if response.status_code == 200:
                 self.cart_id = response.json().get("id")
             else:
                 response.failure(f"Failed to create cart: {response.text}")
                 return
 
-        # 2. Add Item to Cart (Using valid product ID '1')
+        # 2. Add Item to Cart. Name and price come from the catalog.
         item = {
-            "productId": "1",
-            "productName": "Silk Baroque Shirt",
-            "price": 1200.0,
+            "productId": product["id"],
             "quantity": 1,
-            "selectedSize": "M",
-            "selectedColor": "Black"
+            "selectedSize": random.choice(product.get("sizes") or [""]),
+            "selectedColor": random.choice(product.get("colors") or [""])
         }
-        self.client.post(f"{CART_SERVICE_HOST}/api/carts/{self.cart_id}/items", json=item, name="/api/carts/{id}/items [Add]")
+        self.client.post(f"{CART_SERVICE_HOST}/api/carts/{self.cart_id}/items", json=item, headers=self.headers, name="/api/carts/{id}/items [Add]")
 
-        # 3. Create Order
+        # 3. Create Order. Order creation and payment carry idempotency keys so
+        # that retries never create duplicate orders or charges
         order_id = None
-        with self.client.post(f"{CART_SERVICE_HOST}/api/carts/{self.cart_id}/orders", name="/api/carts/{id}/orders [Create]", catch_response=True) as response:
+        order_total = None
+        order_headers = {**self.headers, "Idempotency-Key": os.urandom(16).hex()}
+        with self.client.post(f"{CART_SERVICE_HOST}/api/carts/{self.cart_id}/orders", headers=order_headers, name="/api/carts/{id}/orders [Create]", catch_response=True) as response:
             if response.status_code == 200:
                 order_id = response.json().get("id")
+                order_total = response.json().get("total")
             else:
                 response.failure(f"Failed to create order: {response.text}")
                 return
 
-        # 4. Process Payment
+        # 4. Process Payment. The amount must be the order total.
         payment_payload = {
             "orderId": order_id,
-            "amount": 1200.0,
-            "currency": "USD",
-            "cardNumber": "4242424242424242",
-            "cvv": "123",
-            "expiryDate": "12/25"
+            "amount": order_total,
+            "paymentMethodId": self.payment_method
         }
-        self.client.post(f"{PAYMENT_SERVICE_HOST}/api/payments", json=payment_payload, name="/api/payments [Pay]")
+        payment_headers = {**self.headers, "Idempotency-Key": os.urandom(16).hex(), "X-Forwarded-For": self.ip}
+        self.client.post(f"{PAYMENT_SERVICE_HOST}/api/payments", json=payment_payload, headers=payment_headers, name="/api/payments [Pay]")
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"payment-service/db"
+	"payment-service/provider"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Card numbers are tokenized in the browser with Stripe.js, so payments
+// arrive with a PaymentMethod ID or a card token and the service never
+// handles a card number. Raw card details are only accepted when
+// PAYMENT_RAW_CARDS_TEST_MODE is set, for local testing against
+// stripe-mock.
+
+// rawCardsTestMode allows raw card details in payment requests. It is never
+// enabled with a live Stripe key.
+var rawCardsTestMode bool
+
+// cardFor checks the card of a payment request, writing the error response
+// if it is not acceptable
+func cardFor(w http.ResponseWriter, r *http.Request, req *db.PaymentRequest) (provider.Card, bool) {
+	span := trace.SpanFromContext(r.Context())
+	hasRawCard := req.CardNumber != "" || req.ExpiryDate != "" || req.CVV != ""
+
+	switch {
+	case hasRawCard && (req.PaymentMethodID != "" || req.Token != ""),
+		req.PaymentMethodID != "" && req.Token != "":
+		writeCardError(w, "Send only one of paymentMethodId, token or card details")
+		return provider.Card{}, false
+
+	case hasRawCard:
+		if !rawCardsTestMode {
+			writeCardError(w, "Card details are not accepted, send a paymentMethodId or token created with Stripe.js")
+			return provider.Card{}, false
+		}
+		span.SetAttributes(attribute.String("payment.method.source", "raw_card"))
+		card, ok := rawCard(w, req)
+		// Drop the card details as soon as they are checked
+		req.CardNumber, req.ExpiryDate, req.CVV = "", "", ""
+		return card, ok
+
+	case req.PaymentMethodID != "":
+		if !strings.HasPrefix(req.PaymentMethodID, "pm_") {
+			writeCardError(w, "Invalid paymentMethodId")
+			return provider.Card{}, false
+		}
+		span.SetAttributes(attribute.String("payment.method.source", "payment_method"))
+		return provider.Card{PaymentMethodID: req.PaymentMethodID}, true
+
+	case req.Token != "":
+		if !strings.HasPrefix(req.Token, "tok_") {
+			writeCardError(w, "Invalid token")
+			return provider.Card{}, false
+		}
+		span.SetAttributes(attribute.String("payment.method.source", "token"))
+		return provider.Card{Token: req.Token}, true
+
+	default:
+		writeCardError(w, "paymentMethodId or token is required")
+		return provider.Card{}, false
+	}
+}
+
+// rawCard validates raw card details. Test mode only.
+func rawCard(w http.ResponseWriter, req *db.PaymentRequest) (provider.Card, bool) {
+	if !db.ValidateCardNumber(req.CardNumber) {
+		writeCardError(w, "Invalid card number")
+		return provider.Card{}, false
+	}
+
+	if !db.ValidateExpiryDate(req.ExpiryDate) {
+		writeCardError(w, "Invalid or expired card")
+		return provider.Card{}, false
+	}
+
+	if !db.ValidateCVV(req.CVV) {
+		writeCardError(w, "Invalid CVV")
+		return provider.Card{}, false
+	}
+
+	// Parse expiry date, MM/YY or MM/YYYY
+	parts := strings.Split(req.ExpiryDate, "/")
+	expMonth := strings.TrimSpace(parts[0])
+	expYear := strings.TrimSpace(parts[1])
+	if len(expYear) == 2 {
+		expYear = "20" + expYear
+	}
+
+	return provider.Card{
+		Number:   req.CardNumber,
+		ExpMonth: expMonth,
+		ExpYear:  expYear,
+		CVC:      req.CVV,
+	}, true
+}
+
+func writeCardError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(db.PaymentResponse{
+		Success: false,
+		Message: message,
+	})
+}
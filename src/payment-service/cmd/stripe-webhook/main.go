@@ -0,0 +1,72 @@
+// Command stripe-webhook sends a fixture event from testdata/stripe to the
+// payment-service webhook, signed with the webhook secret the way Stripe
+// signs it, so the webhook can be exercised without a Stripe account:
+//
+//	go run ./cmd/stripe-webhook -payment-intent pi_123 testdata/stripe/payment_intent.succeeded.json
+//
+// {{EVENT_ID}}, {{PAYMENT_INTENT_ID}} and {{CHARGE_ID}} in the fixture are
+// replaced by the flag values. Sending the same -event-id twice shows the
+// redelivery being skipped.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+func main() {
+	url := flag.String("url", "http://localhost:8003/api/payments/webhooks/stripe", "webhook endpoint")
+	secret := flag.String("secret", os.Getenv("STRIPE_WEBHOOK_SECRET"), "webhook signing secret")
+	eventID := flag.String("event-id", fmt.Sprintf("evt_test_%d", time.Now().UnixNano()), "event ID")
+	intentID := flag.String("payment-intent", "pi_test", "PaymentIntent ID of the payment")
+	chargeID := flag.String("charge", "ch_test", "charge ID of the payment")
+	tamper := flag.Bool("tamper", false, "change the payload after signing it, to see it rejected")
+	flag.Parse()
+
+	if flag.NArg() != 1 || *secret == "" {
+		fmt.Fprintln(os.Stderr, "usage: stripe-webhook [flags] fixture.json (the secret comes from -secret or STRIPE_WEBHOOK_SECRET)")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	fixture, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	payload := []byte(strings.NewReplacer(
+		"{{EVENT_ID}}", *eventID,
+		"{{PAYMENT_INTENT_ID}}", *intentID,
+		"{{CHARGE_ID}}", *chargeID,
+	).Replace(string(fixture)))
+
+	now := time.Now()
+	signature := fmt.Sprintf("t=%d,v1=%x", now.Unix(), webhook.ComputeSignature(now, payload, *secret))
+	if *tamper {
+		payload = append(payload, ' ')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, *url, bytes.NewReader(payload))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s %s\n%s", *eventID, resp.Status, body)
+}
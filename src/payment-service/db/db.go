@@ -1,18 +1,23 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"payment-service/money"
+	"payment-service/telemetry"
+
+	"github.com/lib/pq"
 )
 
 // DB is the global database connection
-var DB *sql.DB
+var DB *telemetry.DB
 
 // InitDB initializes the database connection
 func InitDB() {
@@ -29,17 +34,19 @@ func InitDB() {
 
 	// Open database connection
 	var err error
-	DB, err = sql.Open("postgres", psqlInfo)
+	DB, err = telemetry.OpenDB("postgres", psqlInfo, dbname)
 	if err != nil {
-		log.Fatal("Failed to open database:", err)
+		slog.Error("Failed to open database", "error", err)
+		os.Exit(1)
 	}
 
 	// Test the connection
-	if err = DB.Ping(); err != nil {
-		log.Fatal("Failed to ping database:", err)
+	if err = DB.PingContext(context.Background()); err != nil {
+		slog.Error("Failed to ping database", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Successfully connected to database!")
+	slog.Info("Successfully connected to database!")
 }
 
 // GetEnvOrDefault returns the environment variable value or a default value
@@ -58,66 +65,187 @@ func CloseDB() {
 }
 
 type PaymentRequest struct {
-	OrderID    string  `json:"orderId"`
-	Amount     float64 `json:"amount"`
-	Currency   string  `json:"currency"`
-	CardNumber string  `json:"cardNumber"`
-	CardHolder string  `json:"cardHolder"`
-	ExpiryDate string  `json:"expiryDate"`
-	CVV        string  `json:"cvv"`
+	OrderID string      `json:"orderId"`
+	Amount  money.Money `json:"amount"`
+	// The card is a PaymentMethod ID (pm_...) or a card token (tok_...)
+	// created in the browser with Stripe.js, so the card number never
+	// reaches our services
+	PaymentMethodID string `json:"paymentMethodId,omitempty"`
+	Token           string `json:"token,omitempty"`
+	// Raw card details are only accepted in test mode, see
+	// PAYMENT_RAW_CARDS_TEST_MODE
+	CardNumber string `json:"cardNumber,omitempty"`
+	CardHolder string `json:"cardHolder,omitempty"`
+	ExpiryDate string `json:"expiryDate,omitempty"`
+	CVV        string `json:"cvv,omitempty"`
+	// CaptureMethod is "automatic" (the default) to capture the payment
+	// right away or "manual" to only authorize it until it is captured
+	CaptureMethod string `json:"captureMethod,omitempty"`
+	// ReturnURL is where a card issuer sends the customer back to after a
+	// redirect-based authentication
+	ReturnURL string `json:"returnUrl,omitempty"`
+	// BillingCountry is the customer's country as an ISO 3166 code, which
+	// the fraud rules compare with the country the card was issued in
+	BillingCountry string `json:"billingCountry,omitempty"`
 }
 
+// Payment statuses. A payment is pending while it is being authorized, then
+// moves to requires_action, processing, authorized, completed or failed
+// depending on the status of its PaymentIntent.
+const (
+	PaymentPending           = "pending"
+	PaymentRequiresAction    = "requires_action"
+	PaymentProcessing        = "processing"
+	PaymentAuthorized        = "authorized"
+	PaymentCompleted         = "completed"
+	PaymentPartiallyRefunded = "partially_refunded"
+	PaymentRefunded          = "refunded"
+	PaymentVoided            = "voided"
+	PaymentFailed            = "failed"
+	PaymentDisputed          = "disputed"
+	PaymentChargedBack       = "charged_back"
+)
+
+// Capture methods
+const (
+	CaptureAutomatic = "automatic"
+	CaptureManual    = "manual"
+)
+
 type Payment struct {
-	ID            string  `json:"id"`
-	OrderID       string  `json:"orderId"`
-	Amount        float64 `json:"amount"`
-	Currency      string  `json:"currency"`
-	Status        string  `json:"status"`
-	CardLastFour  string  `json:"cardLastFour"`
-	TransactionID string  `json:"transactionId"`
-	CreatedAt     string  `json:"createdAt"`
-	UpdatedAt     string  `json:"updatedAt"`
+	ID            string      `json:"id"`
+	OrderID       string      `json:"orderId"`
+	UserID        string      `json:"userId,omitempty"`
+	Amount        money.Money `json:"amount"`
+	Status        string      `json:"status"`
+	CardLastFour  string      `json:"cardLastFour"`
+	TransactionID string      `json:"transactionId"`
+	CaptureMethod string      `json:"captureMethod"`
+	// IntentStatus is the last known status of the Stripe PaymentIntent
+	IntentStatus string `json:"intentStatus,omitempty"`
+	CapturedAt   string `json:"capturedAt,omitempty"`
+	// RefundedAmount counts pending and succeeded refunds, RefundableAmount
+	// is what is left to refund
+	RefundedAmount   money.Money `json:"refundedAmount"`
+	RefundableAmount money.Money `json:"refundableAmount"`
+	// ReviewStatus is set on payments the fraud rules held for review
+	ReviewStatus string          `json:"reviewStatus,omitempty"`
+	Fraud        FraudAssessment `json:"-"`
+	CreatedAt    string          `json:"createdAt"`
+	UpdatedAt    string          `json:"updatedAt"`
 }
 
 type PaymentResponse struct {
 	Success bool    `json:"success"`
 	Message string  `json:"message"`
 	Payment Payment `json:"payment,omitempty"`
+	// ClientSecret and NextAction are set when the customer has to complete
+	// an action such as 3-D Secure with Stripe.js before the payment goes on
+	ClientSecret string      `json:"clientSecret,omitempty"`
+	NextAction   interface{} `json:"nextAction,omitempty"`
 }
 
-// CreatePayment creates a new payment record
-func CreatePayment(req PaymentRequest, transactionID string) (*Payment, error) {
-	paymentID := generateID()
-	cardLastFour := req.CardNumber[len(req.CardNumber)-4:]
+const paymentColumns = `id, order_id, COALESCE(user_id, ''), amount, currency, status, card_last_four, transaction_id, capture_method, COALESCE(intent_status, ''), COALESCE(captured_at::text, ''), ` + fraudColumns + `, ` + refundedAmountColumn + `, created_at, updated_at`
 
-	query := `
-		INSERT INTO payments (id, order_id, amount, currency, status, card_last_four, transaction_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, order_id, amount, currency, status, card_last_four, transaction_id, created_at, updated_at`
+// fraudColumns are the fraud assessment and review of a payment
+const fraudColumns = `COALESCE(review_status, ''), fraud_score, fraud_decision, fraud_reasons, COALESCE(card_fingerprint, ''), COALESCE(client_ip, ''), COALESCE(reviewed_by, ''), COALESCE(reviewed_at::text, ''), COALESCE(review_note, '')`
 
-	var payment Payment
-	err := DB.QueryRow(query, paymentID, req.OrderID, req.Amount, req.Currency, "completed", cardLastFour, transactionID).Scan(
-		&payment.ID, &payment.OrderID, &payment.Amount, &payment.Currency,
-		&payment.Status, &payment.CardLastFour, &payment.TransactionID,
-		&payment.CreatedAt, &payment.UpdatedAt,
-	)
+// refundedAmountColumn adds up the refunds of a payment that have not failed
+const refundedAmountColumn = `COALESCE((SELECT SUM(r.amount) FROM refunds r WHERE r.payment_id = payments.id AND r.status <> 'failed'), 0)`
+
+// CreatePayment creates a new payment record owned by userID for the Stripe
+// PaymentIntent intentID, which is empty for a payment that was blocked
+// before reaching Stripe. Only the last four digits of the card are stored.
+// A payment the fraud rules scored review is held for review unless it
+// failed.
+func CreatePayment(ctx context.Context, req PaymentRequest, cardLastFour, intentID, intentStatus, status, userID string, fraud FraudAssessment) (*Payment, error) {
+	paymentID := generateID()
+
+	reasons, err := json.Marshal(fraud.Reasons)
 	if err != nil {
 		return nil, err
 	}
 
-	return &payment, nil
+	query := `
+		INSERT INTO payments (id, order_id, user_id, amount, currency, status, card_last_four, transaction_id,
+		                      capture_method, intent_status, captured_at, review_status, fraud_score,
+		                      fraud_decision, fraud_reasons, card_fingerprint, client_ip)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10,
+		        CASE WHEN $6 = '` + PaymentCompleted + `' THEN CURRENT_TIMESTAMP END,
+		        NULLIF($11, ''), $12, $13, $14::jsonb, NULLIF($15, ''), NULLIF($16, ''))
+		RETURNING ` + paymentColumns
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, paymentID, req.OrderID, userID, req.Amount, req.Amount.Currency, status,
+		cardLastFour, intentID, req.CaptureMethod, intentStatus, reviewStatus(fraud, status), fraud.Score, fraud.Decision,
+		string(reasons), fraud.CardFingerprint, fraud.ClientIP))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return nil, fmt.Errorf("order already has a payment")
+	}
+	return payment, err
+}
+
+// StartPayment records a pending payment before its card is authorized. An
+// order can only have one payment that did not fail, so of two concurrent
+// attempts to pay an order one returns "order already has a payment"
+// before its card is charged. Finish the payment with FinishPayment.
+func StartPayment(ctx context.Context, req PaymentRequest, userID string, fraud FraudAssessment) (*Payment, error) {
+	return CreatePayment(ctx, req, "", "", "", PaymentPending, userID, fraud)
+}
+
+// FinishPayment stores the outcome of authorizing a pending payment at the
+// provider
+func FinishPayment(ctx context.Context, paymentID, cardLastFour, intentID, intentStatus, status string, fraud FraudAssessment) (*Payment, error) {
+	query := `
+		UPDATE payments
+		SET status = $2, card_last_four = $3, transaction_id = $4, intent_status = $5,
+		    captured_at = CASE WHEN $2 = '` + PaymentCompleted + `' THEN CURRENT_TIMESTAMP END,
+		    review_status = NULLIF($6, ''), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = '` + PaymentPending + `'
+		RETURNING ` + paymentColumns
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, paymentID, status, cardLastFour, intentID, intentStatus, reviewStatus(fraud, status)))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("payment is not pending")
+	}
+	return payment, err
+}
+
+// reviewStatus is the review status of a payment the fraud rules scored:
+// pending for one held for review, unless it failed anyway
+func reviewStatus(fraud FraudAssessment, status string) string {
+	if fraud.Decision == FraudReview && status != PaymentFailed && status != PaymentVoided && status != PaymentPending {
+		return ReviewPending
+	}
+	return ""
+}
+
+// UpdatePaymentIntent stores a new status of a payment's PaymentIntent,
+// provided the payment is still in one of the from statuses. Otherwise it
+// returns "payment status changed" and nothing is updated.
+func UpdatePaymentIntent(ctx context.Context, paymentID string, from []string, status, intentStatus string) (*Payment, error) {
+	query := `
+		UPDATE payments
+		SET status = $2, intent_status = $3,
+		    captured_at = CASE WHEN $2 = '` + PaymentCompleted + `' THEN COALESCE(captured_at, CURRENT_TIMESTAMP) ELSE captured_at END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = ANY($4)
+		RETURNING ` + paymentColumns
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, paymentID, status, intentStatus, pq.Array(from)))
+	if err == sql.ErrNoRows {
+		if _, err = GetPayment(ctx, paymentID); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("payment status changed")
+	}
+	return payment, err
 }
 
 // GetPayment retrieves a payment by its ID
-func GetPayment(paymentID string) (*Payment, error) {
-	query := `SELECT id, order_id, amount, currency, status, card_last_four, transaction_id, created_at, updated_at FROM payments WHERE id = $1`
+func GetPayment(ctx context.Context, paymentID string) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE id = $1`
 
-	var payment Payment
-	err := DB.QueryRow(query, paymentID).Scan(
-		&payment.ID, &payment.OrderID, &payment.Amount, &payment.Currency,
-		&payment.Status, &payment.CardLastFour, &payment.TransactionID,
-		&payment.CreatedAt, &payment.UpdatedAt,
-	)
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, paymentID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("payment not found")
@@ -125,19 +253,15 @@ func GetPayment(paymentID string) (*Payment, error) {
 		return nil, err
 	}
 
-	return &payment, nil
+	return payment, nil
 }
 
-// GetPaymentByOrderID retrieves a payment by its order ID
-func GetPaymentByOrderID(orderID string) (*Payment, error) {
-	query := `SELECT id, order_id, amount, currency, status, card_last_four, transaction_id, created_at, updated_at FROM payments WHERE order_id = $1`
+// GetPaymentByOrderID retrieves the latest payment for an order
+func GetPaymentByOrderID(ctx context.Context, orderID string) (*Payment, error) {
+	// Only the latest attempt counts if an order was paid for more than once
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE order_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1`
 
-	var payment Payment
-	err := DB.QueryRow(query, orderID).Scan(
-		&payment.ID, &payment.OrderID, &payment.Amount, &payment.Currency,
-		&payment.Status, &payment.CardLastFour, &payment.TransactionID,
-		&payment.CreatedAt, &payment.UpdatedAt,
-	)
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, orderID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("payment not found for this order")
@@ -145,13 +269,61 @@ func GetPaymentByOrderID(orderID string) (*Payment, error) {
 		return nil, err
 	}
 
+	return payment, nil
+}
+
+// GetPaymentByTransactionID retrieves the payment made through any of the
+// given Stripe PaymentIntent or charge IDs
+func GetPaymentByTransactionID(ctx context.Context, transactionIDs ...string) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE transaction_id = ANY($1) ORDER BY created_at DESC LIMIT 1`
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, pq.Array(transactionIDs)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("payment not found")
+		}
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+func scanPayment(row rowScanner) (*Payment, error) {
+	var payment Payment
+	var amount, currency, refunded string
+	var reasons []byte
+	fraud := &payment.Fraud
+	err := row.Scan(
+		&payment.ID, &payment.OrderID, &payment.UserID, &amount, &currency,
+		&payment.Status, &payment.CardLastFour, &payment.TransactionID, &payment.CaptureMethod,
+		&payment.IntentStatus, &payment.CapturedAt,
+		&payment.ReviewStatus, &fraud.Score, &fraud.Decision, &reasons, &fraud.CardFingerprint,
+		&fraud.ClientIP, &fraud.ReviewedBy, &fraud.ReviewedAt, &fraud.ReviewNote,
+		&refunded, &payment.CreatedAt, &payment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(reasons, &fraud.Reasons); err != nil {
+		return nil, err
+	}
+	if payment.Amount, err = money.Parse(amount, currency); err != nil {
+		return nil, err
+	}
+	if payment.RefundedAmount, err = money.Parse(refunded, currency); err != nil {
+		return nil, err
+	}
+	payment.RefundableAmount = money.Zero(currency)
+	if payment.Status == PaymentCompleted || payment.Status == PaymentPartiallyRefunded {
+		payment.RefundableAmount = payment.Amount.Sub(payment.RefundedAmount)
+	}
 	return &payment, nil
 }
 
 // UpdatePaymentStatus updates the status of a payment
-func UpdatePaymentStatus(paymentID, status string) error {
+func UpdatePaymentStatus(ctx context.Context, paymentID, status string) error {
 	query := `UPDATE payments SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`
-	_, err := DB.Exec(query, status, paymentID)
+	_, err := DB.ExecContext(ctx, query, status, paymentID)
 	return err
 }
 
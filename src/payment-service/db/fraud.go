@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Fraud decisions. Payments scored review are authorized without capture and
+// held until an admin approves or declines them; blocked payments never
+// reach the payment provider.
+const (
+	FraudAllow  = "allow"
+	FraudReview = "review"
+	FraudBlock  = "block"
+)
+
+// Review statuses of payments held for review
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewDeclined = "declined"
+)
+
+// FraudAssessment is the fraud score of a payment, the decision taken on it
+// and the signals it was scored on. It is only shown to admins.
+type FraudAssessment struct {
+	Score           int      `json:"score"`
+	Decision        string   `json:"decision"`
+	Reasons         []string `json:"reasons"`
+	CardFingerprint string   `json:"cardFingerprint,omitempty"`
+	ClientIP        string   `json:"clientIp,omitempty"`
+	ReviewedBy      string   `json:"reviewedBy,omitempty"`
+	ReviewedAt      string   `json:"reviewedAt,omitempty"`
+	ReviewNote      string   `json:"reviewNote,omitempty"`
+}
+
+// HeldPayment is a payment together with its fraud assessment, as admins
+// see it in the review queue
+type HeldPayment struct {
+	*Payment
+	Fraud FraudAssessment `json:"fraud"`
+}
+
+// fraudKeyColumns are the columns payments are counted by for each fraud.Key
+var fraudKeyColumns = map[string]string{
+	"card": "card_fingerprint",
+	"user": "user_id",
+	"ip":   "client_ip",
+}
+
+// CountPayments counts the payments created since the given time whose card
+// fingerprint, user or client IP address, as named by key, is value. Only
+// payments in one of statuses are counted, unless none are given.
+func CountPayments(ctx context.Context, key, value string, since time.Time, statuses ...string) (int, error) {
+	column, ok := fraudKeyColumns[key]
+	if !ok {
+		return 0, fmt.Errorf("unknown key %q", key)
+	}
+
+	var count int
+	err := DB.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM payments
+		WHERE `+column+` = $1 AND created_at >= $2 AND (cardinality($3::text[]) = 0 OR status = ANY($3))`,
+		value, since, pq.Array(statuses)).Scan(&count)
+	return count, err
+}
+
+// GetHeldPayments lists the authorized payments waiting for review, oldest
+// first
+func GetHeldPayments(ctx context.Context, limit int) ([]Payment, error) {
+	rows, err := DB.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE review_status = $1 AND status = $2
+		ORDER BY created_at, id
+		LIMIT $3`, ReviewPending, PaymentAuthorized, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *payment)
+	}
+
+	return payments, rows.Err()
+}
+
+// ReviewPayment records an admin's decision on a held payment. It returns
+// "payment not held for review" if the payment is not waiting for review, so
+// that two reviews cannot both be applied.
+func ReviewPayment(ctx context.Context, paymentID, reviewStatus, reviewer, note string) (*Payment, error) {
+	query := `
+		UPDATE payments
+		SET review_status = $2, reviewed_by = NULLIF($3, ''), review_note = NULLIF($4, ''),
+		    reviewed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND review_status = $5
+		RETURNING ` + paymentColumns
+
+	payment, err := scanPayment(DB.QueryRowContext(ctx, query, paymentID, reviewStatus, reviewer, note, ReviewPending))
+	if err == sql.ErrNoRows {
+		if _, err = GetPayment(ctx, paymentID); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("payment not held for review")
+	}
+	return payment, err
+}
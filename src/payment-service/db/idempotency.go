@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Idempotency key statuses
+const (
+	IdempotencyProcessing = "processing"
+	IdempotencyCompleted  = "completed"
+)
+
+// IdempotencyRecord is the stored outcome of the first request made with an
+// idempotency key
+type IdempotencyRecord struct {
+	Fingerprint    string
+	Status         string
+	ResponseStatus int
+	ResponseBody   []byte
+}
+
+// ClaimIdempotencyKey reserves a key for a request about to be processed. It
+// returns nil if the caller now holds the key, or the record of the earlier
+// request that holds it. Keys whose TTL has elapsed are reclaimed.
+func ClaimIdempotencyKey(ctx context.Context, scope, owner, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	var claimed bool
+	err := DB.QueryRowContext(ctx, `
+		INSERT INTO idempotency_keys (scope, owner, idempotency_key, fingerprint, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + $6 * INTERVAL '1 second')
+		ON CONFLICT (scope, owner, idempotency_key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = EXCLUDED.status,
+		    response_status = NULL, response_body = NULL,
+		    created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < CURRENT_TIMESTAMP
+		RETURNING true`,
+		scope, owner, key, fingerprint, IdempotencyProcessing, int64(ttl.Seconds()),
+	).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var record IdempotencyRecord
+	err = DB.QueryRowContext(ctx, `
+		SELECT fingerprint, status, COALESCE(response_status, 0), response_body
+		FROM idempotency_keys
+		WHERE scope = $1 AND owner = $2 AND idempotency_key = $3`,
+		scope, owner, key,
+	).Scan(&record.Fingerprint, &record.Status, &record.ResponseStatus, &record.ResponseBody)
+	if err == sql.ErrNoRows {
+		// Released by its holder in the meantime; report it as in flight so
+		// the client retries
+		return &IdempotencyRecord{Fingerprint: fingerprint, Status: IdempotencyProcessing}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// CompleteIdempotencyKey stores the response to the request holding a key
+func CompleteIdempotencyKey(ctx context.Context, scope, owner, key string, status int, body []byte) error {
+	_, err := DB.ExecContext(ctx, `
+		UPDATE idempotency_keys
+		SET status = $4, response_status = $5, response_body = $6
+		WHERE scope = $1 AND owner = $2 AND idempotency_key = $3`,
+		scope, owner, key, IdempotencyCompleted, status, body)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a key so that the request can be retried,
+// e.g. after it failed with a server error
+func ReleaseIdempotencyKey(ctx context.Context, scope, owner, key string) error {
+	_, err := DB.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND owner = $2 AND idempotency_key = $3`,
+		scope, owner, key)
+	return err
+}
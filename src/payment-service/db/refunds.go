@@ -0,0 +1,276 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"payment-service/money"
+	"payment-service/telemetry"
+)
+
+// Refund statuses
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+type Refund struct {
+	ID             string      `json:"id"`
+	PaymentID      string      `json:"paymentId"`
+	Amount         money.Money `json:"amount"`
+	Reason         string      `json:"reason,omitempty"`
+	Status         string      `json:"status"`
+	StripeRefundID string      `json:"stripeRefundId,omitempty"`
+	CreatedBy      string      `json:"createdBy,omitempty"`
+	CreatedAt      string      `json:"createdAt"`
+	UpdatedAt      string      `json:"updatedAt"`
+}
+
+const refundColumns = `id, payment_id, amount, currency, COALESCE(reason, ''), status, COALESCE(stripe_refund_id, ''), COALESCE(created_by, ''), created_at, updated_at`
+
+// CreateRefund records a pending refund of amount against a payment. An
+// amount of 0 refunds whatever is left. The payment is locked while the
+// refundable balance is checked, so concurrent refunds can never add up to
+// more than was charged. It fails with "currency mismatch" if amount is not
+// in the payment's currency.
+func CreateRefund(ctx context.Context, paymentID string, amount money.Money, reason, createdBy string) (*Refund, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var chargedAmount, refundedAmount, currency, status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT amount, currency, status, `+refundedAmountColumn+`
+		FROM payments
+		WHERE id = $1
+		FOR UPDATE`, paymentID,
+	).Scan(&chargedAmount, &currency, &status, &refundedAmount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("payment not found")
+		}
+		return nil, err
+	}
+
+	if status != PaymentCompleted && status != PaymentPartiallyRefunded {
+		return nil, fmt.Errorf("payment not refundable")
+	}
+
+	charged, err := money.Parse(chargedAmount, currency)
+	if err != nil {
+		return nil, err
+	}
+	refunded, err := money.Parse(refundedAmount, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := charged.Sub(refunded)
+	if !remaining.IsPositive() {
+		return nil, fmt.Errorf("nothing to refund")
+	}
+	if amount.IsZero() {
+		amount = remaining
+	}
+	if amount.Currency != charged.Currency {
+		return nil, fmt.Errorf("currency mismatch")
+	}
+	if amount.Cmp(remaining) > 0 {
+		return nil, fmt.Errorf("refund exceeds refundable amount")
+	}
+
+	refund, err := scanRefund(tx.QueryRowContext(ctx, `
+		INSERT INTO refunds (id, payment_id, amount, currency, reason, status, created_by)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''))
+		RETURNING `+refundColumns,
+		fmt.Sprintf("ref_%d", time.Now().UnixNano()), paymentID, amount, amount.Currency, reason, RefundPending, createdBy))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return refund, nil
+}
+
+// CompleteRefund records the outcome of a refund at Stripe and moves the
+// payment to refunded once its succeeded refunds cover the whole amount, or
+// to partially_refunded before that. A failed refund frees its amount again.
+func CompleteRefund(ctx context.Context, refundID, stripeRefundID, status string) (*Refund, *Payment, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	refund, err := scanRefund(tx.QueryRowContext(ctx, `
+		UPDATE refunds SET status = $2, stripe_refund_id = NULLIF($3, '')
+		WHERE id = $1
+		RETURNING `+refundColumns,
+		refundID, status, stripeRefundID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("refund not found")
+		}
+		return nil, nil, err
+	}
+
+	payment, err := updateRefundedStatus(ctx, tx, refund.PaymentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return refund, payment, nil
+}
+
+// RecordExternalRefund reconciles a payment with the total Stripe reports as
+// refunded, e.g. after a refund was made in the Stripe dashboard. Whatever
+// exceeds the refunds already recorded is stored as one succeeded refund.
+// Calling it again with the same total changes nothing, and the returned
+// refund is nil then.
+func RecordExternalRefund(ctx context.Context, paymentID string, amountRefunded money.Money) (*Refund, *Payment, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var currency, recordedAmount string
+	err = tx.QueryRowContext(ctx, `
+		SELECT currency, `+refundedAmountColumn+`
+		FROM payments
+		WHERE id = $1
+		FOR UPDATE`, paymentID,
+	).Scan(&currency, &recordedAmount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("payment not found")
+		}
+		return nil, nil, err
+	}
+
+	recorded, err := money.Parse(recordedAmount, currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amountRefunded.Currency != recorded.Currency {
+		return nil, nil, fmt.Errorf("currency mismatch")
+	}
+
+	missing := amountRefunded.Sub(recorded)
+	if !missing.IsPositive() {
+		return nil, nil, nil
+	}
+
+	refund, err := scanRefund(tx.QueryRowContext(ctx, `
+		INSERT INTO refunds (id, payment_id, amount, currency, reason, status, created_by)
+		VALUES ($1, $2, $3, $4, 'Refunded in Stripe', $5, 'stripe')
+		RETURNING `+refundColumns,
+		fmt.Sprintf("ref_%d", time.Now().UnixNano()), paymentID, missing, missing.Currency, RefundSucceeded))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payment, err := updateRefundedStatus(ctx, tx, paymentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return refund, payment, nil
+}
+
+// RefreshRefundedStatus moves a completed payment to partially_refunded or
+// refunded if its succeeded refunds call for it
+func RefreshRefundedStatus(ctx context.Context, paymentID string) (*Payment, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	payment, err := updateRefundedStatus(ctx, tx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// GetRefunds retrieves the refunds of a payment, oldest first
+func GetRefunds(ctx context.Context, paymentID string) ([]Refund, error) {
+	rows, err := DB.QueryContext(ctx, `SELECT `+refundColumns+` FROM refunds WHERE payment_id = $1 ORDER BY created_at, id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, *refund)
+	}
+
+	return refunds, rows.Err()
+}
+
+// updateRefundedStatus sets the status of a payment from the sum of its
+// succeeded refunds and returns the payment. Payments without succeeded
+// refunds keep their status.
+func updateRefundedStatus(ctx context.Context, tx *telemetry.Tx, paymentID string) (*Payment, error) {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE payments p
+		SET status = CASE WHEN s.refunded >= p.amount THEN $2
+		                  WHEN s.refunded > 0 THEN $3
+		                  ELSE p.status END,
+		    updated_at = CURRENT_TIMESTAMP
+		FROM (SELECT COALESCE(SUM(amount), 0) AS refunded FROM refunds WHERE payment_id = $1 AND status = $4) s
+		WHERE p.id = $1`,
+		paymentID, PaymentRefunded, PaymentPartiallyRefunded, RefundSucceeded)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPayment(tx.QueryRowContext(ctx, `SELECT `+paymentColumns+` FROM payments WHERE id = $1`, paymentID))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRefund(row rowScanner) (*Refund, error) {
+	var r Refund
+	var amount, currency string
+	err := row.Scan(
+		&r.ID, &r.PaymentID, &amount, &currency, &r.Reason, &r.Status,
+		&r.StripeRefundID, &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if r.Amount, err = money.Parse(amount, currency); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
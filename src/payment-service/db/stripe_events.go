@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// Stripe event statuses. Events that failed, or were received but never
+// finished, are processed again when Stripe redelivers them.
+const (
+	EventReceived  = "received"
+	EventProcessed = "processed"
+	EventIgnored   = "ignored"
+	EventFailed    = "failed"
+)
+
+type StripeEvent struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	Detail      string          `json:"detail,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  string          `json:"receivedAt"`
+	ProcessedAt string          `json:"processedAt,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+const stripeEventColumns = `id, type, status, COALESCE(detail, ''), attempts, received_at, COALESCE(processed_at::text, '')`
+
+// RecordStripeEvent stores a verified event. If an event with the same ID
+// was received before, the stored one is returned with duplicate set.
+func RecordStripeEvent(ctx context.Context, id, eventType string, payload []byte) (event *StripeEvent, duplicate bool, err error) {
+	event, err = scanStripeEvent(DB.QueryRowContext(ctx, `
+		INSERT INTO stripe_events (id, type, payload)
+		VALUES ($1, $2, $3::jsonb)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING `+stripeEventColumns,
+		id, eventType, string(payload)))
+	if err == sql.ErrNoRows {
+		event, err = GetStripeEvent(ctx, id)
+		return event, true, err
+	}
+	return event, false, err
+}
+
+// FinishStripeEvent records the outcome of processing an event
+func FinishStripeEvent(ctx context.Context, id, status, detail string) (*StripeEvent, error) {
+	return scanStripeEvent(DB.QueryRowContext(ctx, `
+		UPDATE stripe_events
+		SET status = $2, detail = NULLIF($3, ''), attempts = attempts + 1, processed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+stripeEventColumns,
+		id, status, detail))
+}
+
+// GetStripeEvent retrieves an event including its payload
+func GetStripeEvent(ctx context.Context, id string) (*StripeEvent, error) {
+	var event StripeEvent
+	var payload []byte
+	err := DB.QueryRowContext(ctx, `SELECT `+stripeEventColumns+`, payload FROM stripe_events WHERE id = $1`, id).Scan(
+		&event.ID, &event.Type, &event.Status, &event.Detail, &event.Attempts,
+		&event.ReceivedAt, &event.ProcessedAt, &payload,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("event not found")
+		}
+		return nil, err
+	}
+	event.Payload = payload
+	return &event, nil
+}
+
+// GetStripeEvents retrieves the latest events without their payload, only
+// those with the given status unless it is empty
+func GetStripeEvents(ctx context.Context, status string, limit int) ([]StripeEvent, error) {
+	rows, err := DB.QueryContext(ctx, `
+		SELECT `+stripeEventColumns+`
+		FROM stripe_events
+		WHERE $1 = '' OR status = $1
+		ORDER BY received_at DESC
+		LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []StripeEvent{}
+	for rows.Next() {
+		event, err := scanStripeEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+
+	return events, rows.Err()
+}
+
+func scanStripeEvent(row rowScanner) (*StripeEvent, error) {
+	var e StripeEvent
+	err := row.Scan(&e.ID, &e.Type, &e.Status, &e.Detail, &e.Attempts, &e.ReceivedAt, &e.ProcessedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"payment-service/auth"
+	"payment-service/db"
+	"payment-service/fraud"
+	"payment-service/provider"
+
+	"github.com/open-feature/go-sdk/openfeature"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Payments are scored by the fraud rules before they reach the provider.
+// Blocked payments are recorded as failed without charging the card, and
+// payments held for review are only authorized until an admin approves or
+// declines them in the review queue.
+
+// fraudEngine scores payments with the rules of FRAUD_RULES_FILE, or the
+// built-in rules, unless the fraudRules flag is set
+var fraudEngine *fraud.Engine
+
+func initFraud() {
+	config, err := fraud.LoadConfig(db.GetEnvOrDefault("FRAUD_RULES_FILE", ""))
+	if err != nil {
+		slog.Error("Failed to load fraud rules", "error", err)
+		os.Exit(1)
+	}
+	fraudEngine = fraud.New(config)
+}
+
+// fraudRules returns the engine to score a payment with: that of the
+// fraudRules flag when it is set, so that the rules can be changed without a
+// restart, otherwise fraudEngine
+func fraudRules(ctx context.Context) *fraud.Engine {
+	client := openfeature.NewClient("payment-service")
+	value, err := client.ObjectValue(ctx, "fraudRules", nil, openfeature.EvaluationContext{})
+	if rules, ok := value.(map[string]interface{}); err != nil || !ok || len(rules) == 0 {
+		return fraudEngine
+	}
+
+	data, err := json.Marshal(value)
+	if err == nil {
+		var config fraud.Config
+		if config, err = fraud.ParseConfig(data); err == nil {
+			return fraud.New(config)
+		}
+	}
+	slog.WarnContext(ctx, "Ignoring invalid fraudRules flag", "error", err)
+	return fraudEngine
+}
+
+// assessFraud scores a payment request. A rule that cannot be checked, e.g.
+// because the database is down, is left out rather than turning the payment
+// away.
+func assessFraud(r *http.Request, req *db.PaymentRequest, card provider.Card) db.FraudAssessment {
+	ctx := r.Context()
+	payment := fraud.Payment{
+		UserID:          auth.UserID(ctx),
+		Amount:          req.Amount,
+		CardFingerprint: fraud.Fingerprint(card),
+		BIN:             fraud.BIN(card),
+		Country:         strings.ToUpper(req.BillingCountry),
+		IP:              clientIP(r),
+	}
+
+	span := trace.SpanFromContext(ctx)
+	assessment, err := fraudRules(ctx).Assess(ctx, payment)
+	if err != nil {
+		slog.WarnContext(ctx, "ProcessPayment: Fraud rule not checked", "error", err)
+		span.RecordError(err)
+	}
+	assessment.CardFingerprint = payment.CardFingerprint
+	assessment.ClientIP = payment.IP
+
+	span.SetAttributes(
+		attribute.Int("payment.fraud.score", assessment.Score),
+		attribute.String("payment.fraud.decision", assessment.Decision),
+		attribute.StringSlice("payment.fraud.reasons", assessment.Reasons),
+	)
+	decision := metric.WithAttributes(attribute.String("decision", assessment.Decision))
+	fraudDecisions.Add(ctx, 1, decision)
+	fraudScores.Record(ctx, int64(assessment.Score), decision)
+	return assessment
+}
+
+// blockPayment records a payment the fraud rules blocked as failed, without
+// charging the card. The customer is not told why it was declined.
+func blockPayment(w http.ResponseWriter, r *http.Request, req db.PaymentRequest, card provider.Card, assessment db.FraudAssessment) {
+	lastFour := ""
+	if len(card.Number) >= 4 {
+		lastFour = card.Number[len(card.Number)-4:]
+	}
+
+	payment, err := db.CreatePayment(r.Context(), req, lastFour, "", "", db.PaymentFailed, auth.UserID(r.Context()), assessment)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(db.PaymentResponse{
+			Success: false,
+			Message: "Database Error: " + err.Error(),
+		})
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).AddEvent("payment.fraud_blocked", trace.WithAttributes(
+		attribute.String("payment.id", payment.ID),
+	))
+	recordPayment(r.Context(), outcomeBlocked, "fraud", req.Amount)
+	w.WriteHeader(http.StatusPaymentRequired)
+	json.NewEncoder(w).Encode(db.PaymentResponse{
+		Success: false,
+		Message: "Payment was declined",
+		Payment: *payment,
+	})
+}
+
+// clientIP is the address the request came from. Behind the ingress that is
+// the last hop of X-Forwarded-For, which the load balancer appends; the hops
+// before it are whatever the client sent and cannot be trusted.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func getHeldPayments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+
+	payments, err := db.GetHeldPayments(r.Context(), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	held := make([]db.HeldPayment, len(payments))
+	for i := range payments {
+		held[i] = db.HeldPayment{Payment: &payments[i], Fraud: payments[i].Fraud}
+	}
+	json.NewEncoder(w).Encode(held)
+}
+
+// reviewPayment approves or declines a held payment. An approved payment is
+// captured and its order marked paid, which completes a checkout waiting for
+// the review; a declined one is voided and its order cancelled. The order's
+// stock is confirmed before an approved payment is captured, as a checkout
+// does, and an approval whose stock is no longer reserved declines the
+// payment instead of charging for stock that may have been sold again.
+func reviewPayment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		Decision string `json:"decision"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	var reviewStatus string
+	switch req.Decision {
+	case "approve":
+		reviewStatus = db.ReviewApproved
+	case "decline":
+		reviewStatus = db.ReviewDeclined
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "decision must be approve or decline"})
+		return
+	}
+
+	payment, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	payment = refreshIntent(r.Context(), payment)
+	if payment.ReviewStatus != db.ReviewPending || payment.Status != db.PaymentAuthorized {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payment is not held for review"})
+		return
+	}
+
+	// Confirming is idempotent, so a concurrent approval confirming the
+	// stock as well does no harm
+	if reviewStatus == db.ReviewApproved {
+		if err := orderClient.ConfirmStock(r.Context(), payment.OrderID); err != nil {
+			if err.Error() != "stock no longer reserved" {
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Stock Error: " + err.Error()})
+				return
+			}
+			trace.SpanFromContext(r.Context()).AddEvent("payment.review_stock_lapsed", trace.WithAttributes(
+				attribute.String("payment.id", payment.ID),
+				attribute.String("order.id", payment.OrderID),
+			))
+			reviewStatus = db.ReviewDeclined
+			req.Note = strings.TrimSpace("Declined as the stock is no longer reserved. " + req.Note)
+		}
+	}
+
+	// The review is recorded first, so that a concurrent review of the same
+	// payment is refused
+	reviewed, err := db.ReviewPayment(r.Context(), payment.ID, reviewStatus, auth.UserID(r.Context()), req.Note)
+	if err != nil {
+		if err.Error() == "payment not held for review" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Payment is not held for review"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).AddEvent("payment.reviewed", trace.WithAttributes(
+		attribute.String("payment.id", reviewed.ID),
+		attribute.String("payment.review_status", reviewStatus),
+		attribute.Int("payment.fraud.score", reviewed.Fraud.Score),
+	))
+	fraudReviews.Add(r.Context(), 1, metric.WithAttributes(attribute.String("review_status", reviewStatus)))
+
+	if reviewStatus == db.ReviewDeclined {
+		intent, err := paymentProvider.Void(r.Context(), reviewed.TransactionID, "fraudulent", "void-"+reviewed.ID)
+		if err != nil {
+			w.WriteHeader(providerErrorStatus(err))
+			json.NewEncoder(w).Encode(map[string]string{"error": "Void Error: " + err.Error()})
+			return
+		}
+		updateIntent(w, r, reviewed, intent, "payment.voided")
+		// The order is cancelled once the payment is voided, so that the
+		// checkout waiting for it finds nothing left to void
+		if err := orderClient.MarkCancelled(r.Context(), reviewed.OrderID, reviewed.ID); err != nil {
+			slog.ErrorContext(r.Context(), "ReviewPayment: Failed to cancel order", "order_id", reviewed.OrderID, "error", err)
+			trace.SpanFromContext(r.Context()).AddEvent("order.cancel_notification_failed", trace.WithAttributes(
+				attribute.String("order.id", reviewed.OrderID),
+				attribute.String("error", err.Error()),
+			))
+		}
+		return
+	}
+
+	intent, err := paymentProvider.Capture(r.Context(), reviewed.TransactionID, "capture-"+reviewed.ID)
+	if err != nil {
+		w.WriteHeader(providerErrorStatus(err))
+		json.NewEncoder(w).Encode(map[string]string{"error": "Capture Error: " + err.Error()})
+		return
+	}
+	updateIntent(w, r, reviewed, intent, "payment.captured")
+}
@@ -0,0 +1,117 @@
+package fraud
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"payment-service/money"
+)
+
+// defaultRules are the rules used when no rules file is configured
+//
+//go:embed default_rules.json
+var defaultRules []byte
+
+// Config sets up the rules of an Engine and the scores at which payments are
+// held for review or blocked. It is read from FRAUD_RULES_FILE or the
+// fraudRules flag, e.g.:
+//
+//	{
+//	  "reviewScore": 50,
+//	  "blockScore": 80,
+//	  "velocity": [{"key": "card", "window": "10m", "max": 3, "score": 40}],
+//	  "amounts": [{"above": {"amount": "1000.00", "currency": "USD"}, "score": 30}],
+//	  "binCountry": {"countries": {"424242": "US"}, "score": 35},
+//	  "declines": [{"key": "user", "window": "1h", "max": 3, "score": 50}]
+//	}
+type Config struct {
+	ReviewScore int            `json:"reviewScore"`
+	BlockScore  int            `json:"blockScore"`
+	Velocity    []VelocityRule `json:"velocity"`
+	Amounts     []AmountRule   `json:"amounts"`
+	BINCountry  *BINCountry    `json:"binCountry"`
+	Declines    []DeclineRule  `json:"declines"`
+}
+
+// Duration is a time.Duration written as a string such as "10m" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads a rules file, or the built-in rules if path is empty
+func LoadConfig(path string) (Config, error) {
+	data, name := defaultRules, "default"
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return Config{}, err
+		}
+		name = path
+	}
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("fraud rules %s: %w", name, err)
+	}
+	return config, nil
+}
+
+// ParseConfig reads and checks rules in JSON
+func ParseConfig(data []byte) (Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, err
+	}
+	if err := config.validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if c.ReviewScore <= 0 || c.BlockScore <= 0 {
+		return fmt.Errorf("reviewScore and blockScore must be positive")
+	}
+	if c.ReviewScore > c.BlockScore {
+		return fmt.Errorf("reviewScore must not be above blockScore")
+	}
+
+	for _, rule := range c.Velocity {
+		if !validKey(rule.Key) || rule.Window <= 0 || rule.Max <= 0 {
+			return fmt.Errorf("velocity rules need a key of card, user or ip, a window and a max")
+		}
+	}
+	for _, rule := range c.Declines {
+		if !validKey(rule.Key) || rule.Window <= 0 || rule.Max <= 0 {
+			return fmt.Errorf("declines rules need a key of card, user or ip, a window and a max")
+		}
+	}
+	for _, rule := range c.Amounts {
+		if !money.Supported(rule.Above.Currency) || rule.Above.IsNegative() {
+			return fmt.Errorf("amounts rules need an amount above which they apply")
+		}
+	}
+	return nil
+}
+
+func validKey(key string) bool {
+	return key == KeyCard || key == KeyUser || key == KeyIP
+}
@@ -0,0 +1,141 @@
+// Package fraud scores payments before they are authorized. Each Rule adds to
+// the score of a payment when it sees a risk signal: many payments by the same
+// card, user or IP address, a large amount, a card issued in another country
+// than the customer's, or repeated declines. The total decides whether the
+// payment goes ahead, is held for manual review or is blocked.
+package fraud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"payment-service/db"
+	"payment-service/money"
+	"payment-service/provider"
+)
+
+// Keys that velocity and decline rules count payments by
+const (
+	KeyCard = "card"
+	KeyUser = "user"
+	KeyIP   = "ip"
+)
+
+// Payment holds what the rules know about a payment to score
+type Payment struct {
+	UserID string
+	Amount money.Money
+	// CardFingerprint identifies the card without revealing it, see
+	// Fingerprint
+	CardFingerprint string
+	// BIN is the first digits of the card number, only known for raw card
+	// details
+	BIN string
+	// Country is the customer's country as an ISO 3166 code, if known
+	Country string
+	IP      string
+}
+
+func (p Payment) key(key string) string {
+	switch key {
+	case KeyCard:
+		return p.CardFingerprint
+	case KeyUser:
+		return p.UserID
+	case KeyIP:
+		return p.IP
+	}
+	return ""
+}
+
+// Engine scores payments with a set of rules
+type Engine struct {
+	Rules       []Rule
+	ReviewScore int
+	BlockScore  int
+}
+
+// New creates an engine with the rules of config
+func New(config Config) *Engine {
+	e := &Engine{ReviewScore: config.ReviewScore, BlockScore: config.BlockScore}
+	for _, rule := range config.Velocity {
+		e.Rules = append(e.Rules, rule)
+	}
+	for _, rule := range config.Amounts {
+		e.Rules = append(e.Rules, rule)
+	}
+	if config.BINCountry != nil {
+		e.Rules = append(e.Rules, config.BINCountry)
+	}
+	for _, rule := range config.Declines {
+		e.Rules = append(e.Rules, rule)
+	}
+	return e
+}
+
+// Assess scores a payment with every rule. The score is capped at 100. A
+// rule that fails is left out of the score and its error returned alongside
+// the assessment of the other rules.
+func (e *Engine) Assess(ctx context.Context, p Payment) (db.FraudAssessment, error) {
+	assessment := db.FraudAssessment{Reasons: []string{}}
+	var errs []string
+	for _, rule := range e.Rules {
+		score, reason, err := rule.Check(ctx, p)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", rule.Name(), err))
+			continue
+		}
+		if score > 0 {
+			assessment.Score += score
+			assessment.Reasons = append(assessment.Reasons, rule.Name()+": "+reason)
+		}
+	}
+	if assessment.Score > 100 {
+		assessment.Score = 100
+	}
+
+	switch {
+	case assessment.Score >= e.BlockScore:
+		assessment.Decision = db.FraudBlock
+	case assessment.Score >= e.ReviewScore:
+		assessment.Decision = db.FraudReview
+	default:
+		assessment.Decision = db.FraudAllow
+	}
+
+	if len(errs) > 0 {
+		return assessment, fmt.Errorf("fraud rules failed: %s", strings.Join(errs, "; "))
+	}
+	return assessment, nil
+}
+
+// Fingerprint identifies a card by a hash of its number, PaymentMethod ID or
+// token, so that payments with the same card can be counted without storing
+// it. Tokens are single-use, so payments with a new token each time only
+// share the fingerprint of the tokens.
+func Fingerprint(card provider.Card) string {
+	key := card.Number
+	switch {
+	case card.PaymentMethodID != "":
+		key = card.PaymentMethodID
+	case card.Token != "":
+		key = card.Token
+	}
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// BIN returns the first eight digits of a raw card number, or "" for a
+// PaymentMethod or token
+func BIN(card provider.Card) string {
+	if len(card.Number) < 8 {
+		return ""
+	}
+	return card.Number[:8]
+}
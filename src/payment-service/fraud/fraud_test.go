@@ -0,0 +1,272 @@
+package fraud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"payment-service/db"
+	"payment-service/money"
+	"payment-service/provider"
+	"payment-service/telemetry"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fixedRule adds a fixed score, or fails
+type fixedRule struct {
+	name  string
+	score int
+	err   error
+}
+
+func (r fixedRule) Name() string { return r.name }
+
+func (r fixedRule) Check(ctx context.Context, p Payment) (int, string, error) {
+	return r.score, "fixed", r.err
+}
+
+// mockDBs numbers the mock databases, which need distinct names
+var mockDBs int
+
+// mockDB points db.DB at a sqlmock database for the test
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	mockDBs++
+	dsn := fmt.Sprintf("fraud_%d", mockDBs)
+	conn, mock, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db.DB
+	db.DB, err = telemetry.OpenDB("sqlmock", dsn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.DB = previous
+		conn.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+func TestAssessDecision(t *testing.T) {
+	tests := []struct {
+		scores []int
+		score  int
+		want   string
+	}{
+		{nil, 0, db.FraudAllow},
+		{[]int{0, 0}, 0, db.FraudAllow},
+		{[]int{30, 19}, 49, db.FraudAllow},
+		{[]int{30, 20}, 50, db.FraudReview},
+		{[]int{40, 39}, 79, db.FraudReview},
+		{[]int{40, 40}, 80, db.FraudBlock},
+		{[]int{60, 60}, 100, db.FraudBlock},
+	}
+	for _, tt := range tests {
+		engine := &Engine{ReviewScore: 50, BlockScore: 80}
+		for i, score := range tt.scores {
+			engine.Rules = append(engine.Rules, fixedRule{name: string(rune('a' + i)), score: score})
+		}
+
+		assessment, err := engine.Assess(context.Background(), Payment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assessment.Score != tt.score || assessment.Decision != tt.want {
+			t.Errorf("scores %v: got %d %s, want %d %s", tt.scores, assessment.Score, assessment.Decision, tt.score, tt.want)
+		}
+		if nonZero := countNonZero(tt.scores); len(assessment.Reasons) != nonZero {
+			t.Errorf("scores %v: reasons %v, want %d", tt.scores, assessment.Reasons, nonZero)
+		}
+	}
+}
+
+func countNonZero(scores []int) int {
+	n := 0
+	for _, score := range scores {
+		if score > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAssessSkipsFailingRules(t *testing.T) {
+	engine := &Engine{ReviewScore: 50, BlockScore: 80, Rules: []Rule{
+		fixedRule{name: "broken", score: 90, err: errors.New("database down")},
+		fixedRule{name: "amount", score: 30},
+	}}
+
+	assessment, err := engine.Assess(context.Background(), Payment{})
+	if err == nil || !strings.Contains(err.Error(), "broken: database down") {
+		t.Errorf("error = %v, want the failing rule", err)
+	}
+	if assessment.Score != 30 || assessment.Decision != db.FraudAllow {
+		t.Errorf("got %d %s, want the score of the other rules", assessment.Score, assessment.Decision)
+	}
+	if len(assessment.Reasons) != 1 || assessment.Reasons[0] != "amount: fixed" {
+		t.Errorf("reasons = %v", assessment.Reasons)
+	}
+}
+
+func TestAmountRule(t *testing.T) {
+	rule := AmountRule{Above: money.New(100000, "USD"), Score: 30}
+	tests := []struct {
+		amount money.Money
+		want   int
+	}{
+		{money.New(99999, "USD"), 0},
+		{money.New(100000, "USD"), 0},
+		{money.New(100001, "USD"), 30},
+		// Rules only apply to their own currency
+		{money.New(500000, "EUR"), 0},
+	}
+	for _, tt := range tests {
+		score, _, err := rule.Check(context.Background(), Payment{Amount: tt.amount})
+		if err != nil || score != tt.want {
+			t.Errorf("Check(%v) = %d, %v, want %d", tt.amount, score, err, tt.want)
+		}
+	}
+}
+
+func TestBINCountry(t *testing.T) {
+	rule := &BINCountry{Countries: map[string]string{"424242": "US", "40000076": "BR"}, Score: 35}
+	tests := []struct {
+		bin, country string
+		want         int
+	}{
+		{"42424242", "US", 0},
+		{"42424242", "GB", 35},
+		// The longest prefix wins
+		{"40000076", "BR", 0},
+		{"40000076", "US", 35},
+		{"55555555", "GB", 0},
+		{"42424242", "", 0},
+		{"", "GB", 0},
+	}
+	for _, tt := range tests {
+		score, _, err := rule.Check(context.Background(), Payment{BIN: tt.bin, Country: tt.country})
+		if err != nil || score != tt.want {
+			t.Errorf("Check(%q, %q) = %d, %v, want %d", tt.bin, tt.country, score, err, tt.want)
+		}
+	}
+}
+
+func TestVelocityRule(t *testing.T) {
+	rule := VelocityRule{Key: KeyCard, Window: Duration(10 * time.Minute), Max: 3, Score: 40}
+	payment := Payment{CardFingerprint: "fp_1"}
+
+	tests := []struct {
+		count int
+		want  int
+	}{
+		{0, 0},
+		{2, 0},
+		// The payment being checked is the fourth
+		{3, 40},
+	}
+	for _, tt := range tests {
+		mock := mockDB(t)
+		mock.ExpectQuery(`SELECT COUNT\(\*\) FROM payments\s+WHERE card_fingerprint = \$1`).
+			WithArgs("fp_1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+
+		score, _, err := rule.Check(context.Background(), payment)
+		if err != nil || score != tt.want {
+			t.Errorf("%d earlier payments: Check = %d, %v, want %d", tt.count, score, err, tt.want)
+		}
+	}
+
+	// A payment without the key is not counted
+	if score, _, err := rule.Check(context.Background(), Payment{}); score != 0 || err != nil {
+		t.Errorf("Check without a card = %d, %v", score, err)
+	}
+}
+
+func TestDeclineRule(t *testing.T) {
+	rule := DeclineRule{Key: KeyUser, Window: Duration(time.Hour), Max: 3, Score: 40}
+	payment := Payment{UserID: "user_1"}
+
+	for count, want := range map[int]int{3: 0, 4: 40} {
+		mock := mockDB(t)
+		mock.ExpectQuery(`SELECT COUNT\(\*\) FROM payments\s+WHERE user_id = \$1`).
+			WithArgs("user_1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+
+		score, _, err := rule.Check(context.Background(), payment)
+		if err != nil || score != want {
+			t.Errorf("%d declines: Check = %d, %v, want %d", count, score, err, want)
+		}
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := New(config)
+	if engine.ReviewScore != 50 || engine.BlockScore != 80 {
+		t.Errorf("thresholds = %d/%d", engine.ReviewScore, engine.BlockScore)
+	}
+
+	// A large payment by a new customer goes ahead on its own...
+	amounts := &Engine{ReviewScore: config.ReviewScore, BlockScore: config.BlockScore}
+	for _, rule := range config.Amounts {
+		amounts.Rules = append(amounts.Rules, rule)
+	}
+	assessment, err := amounts.Assess(context.Background(), Payment{Amount: money.New(120000, "USD")})
+	if err != nil || assessment.Decision != db.FraudAllow {
+		t.Errorf("1200.00 USD: %+v, %v", assessment, err)
+	}
+	// ...but a very large one is held
+	assessment, err = amounts.Assess(context.Background(), Payment{Amount: money.New(600000, "USD")})
+	if err != nil || assessment.Decision != db.FraudReview {
+		t.Errorf("6000.00 USD: %+v, %v", assessment, err)
+	}
+}
+
+func TestParseConfigRejects(t *testing.T) {
+	for _, data := range []string{
+		`{"reviewScore": 0, "blockScore": 80}`,
+		`{"reviewScore": 90, "blockScore": 80}`,
+		`{"reviewScore": 50, "blockScore": 80, "velocity": [{"key": "email", "window": "10m", "max": 3, "score": 40}]}`,
+		`{"reviewScore": 50, "blockScore": 80, "velocity": [{"key": "card", "window": "10m", "score": 40}]}`,
+		`{"reviewScore": 50, "blockScore": 80, "declines": [{"key": "card", "window": "soon", "max": 1, "score": 40}]}`,
+		`{"reviewScore": 50, "blockScore": 80, "amounts": [{"above": {"amount": "10.00", "currency": "XXX"}, "score": 30}]}`,
+	} {
+		if _, err := ParseConfig([]byte(data)); err == nil {
+			t.Errorf("ParseConfig(%s) succeeded", data)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	visa := Fingerprint(provider.Card{PaymentMethodID: "pm_card_visa"})
+	if visa == "" || strings.Contains(visa, "visa") {
+		t.Errorf("Fingerprint = %q", visa)
+	}
+	if visa != Fingerprint(provider.Card{PaymentMethodID: "pm_card_visa"}) {
+		t.Error("the same card has different fingerprints")
+	}
+	if visa == Fingerprint(provider.Card{PaymentMethodID: "pm_card_mastercard"}) {
+		t.Error("different cards share a fingerprint")
+	}
+	if got := Fingerprint(provider.Card{}); got != "" {
+		t.Errorf("Fingerprint of no card = %q", got)
+	}
+
+	if got := BIN(provider.Card{Number: "4242424242424242"}); got != "42424242" {
+		t.Errorf("BIN = %q", got)
+	}
+	if got := BIN(provider.Card{PaymentMethodID: "pm_card_visa"}); got != "" {
+		t.Errorf("BIN of a PaymentMethod = %q", got)
+	}
+}
@@ -0,0 +1,116 @@
+package fraud
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"payment-service/db"
+	"payment-service/money"
+)
+
+// Rule scores one risk signal of a payment
+type Rule interface {
+	// Name identifies the rule in reasons, spans and metrics
+	Name() string
+	// Check returns the score the payment adds and why, or 0 if the rule
+	// does not apply to it
+	Check(ctx context.Context, p Payment) (score int, reason string, err error)
+}
+
+// VelocityRule scores a card, user or IP address that made more than Max
+// payments within Window
+type VelocityRule struct {
+	Key    string   `json:"key"`
+	Window Duration `json:"window"`
+	Max    int      `json:"max"`
+	Score  int      `json:"score"`
+}
+
+func (r VelocityRule) Name() string { return "velocity_" + r.Key }
+
+func (r VelocityRule) Check(ctx context.Context, p Payment) (int, string, error) {
+	value := p.key(r.Key)
+	if value == "" {
+		return 0, "", nil
+	}
+	window := time.Duration(r.Window)
+	count, err := db.CountPayments(ctx, r.Key, value, time.Now().Add(-window))
+	if err != nil {
+		return 0, "", err
+	}
+	// The payment being checked is not stored yet
+	if count+1 <= r.Max {
+		return 0, "", nil
+	}
+	return r.Score, fmt.Sprintf("%d payments by %s within %s", count+1, r.Key, window), nil
+}
+
+// AmountRule scores payments above an amount. Only the rules in the currency
+// of a payment apply to it; several rules add up, e.g. one above 1000.00 and
+// one above 5000.00.
+type AmountRule struct {
+	Above money.Money `json:"above"`
+	Score int         `json:"score"`
+}
+
+func (r AmountRule) Name() string { return "amount" }
+
+func (r AmountRule) Check(ctx context.Context, p Payment) (int, string, error) {
+	if p.Amount.Currency != r.Above.Currency || p.Amount.Cmp(r.Above) <= 0 {
+		return 0, "", nil
+	}
+	return r.Score, "amount above " + r.Above.String(), nil
+}
+
+// BINCountry scores cards issued in another country than the customer's.
+// The issuing country is looked up by the longest prefix of the card's BIN
+// in Countries; payments whose card or customer country is unknown are not
+// scored.
+type BINCountry struct {
+	Countries map[string]string `json:"countries"`
+	Score     int               `json:"score"`
+}
+
+func (r *BINCountry) Name() string { return "bin_country" }
+
+func (r *BINCountry) Check(ctx context.Context, p Payment) (int, string, error) {
+	if p.BIN == "" || p.Country == "" {
+		return 0, "", nil
+	}
+	cardCountry := ""
+	for prefix := len(p.BIN); prefix > 0 && cardCountry == ""; prefix-- {
+		cardCountry = r.Countries[p.BIN[:prefix]]
+	}
+	if cardCountry == "" || cardCountry == p.Country {
+		return 0, "", nil
+	}
+	return r.Score, fmt.Sprintf("card issued in %s, customer in %s", cardCountry, p.Country), nil
+}
+
+// DeclineRule scores a card, user or IP address that had more than Max
+// payments declined within Window
+type DeclineRule struct {
+	Key    string   `json:"key"`
+	Window Duration `json:"window"`
+	Max    int      `json:"max"`
+	Score  int      `json:"score"`
+}
+
+func (r DeclineRule) Name() string { return "declines_" + r.Key }
+
+func (r DeclineRule) Check(ctx context.Context, p Payment) (int, string, error) {
+	value := p.key(r.Key)
+	if value == "" {
+		return 0, "", nil
+	}
+	window := time.Duration(r.Window)
+	count, err := db.CountPayments(ctx, r.Key, value, time.Now().Add(-window), db.PaymentFailed)
+	if err != nil {
+		return 0, "", err
+	}
+	if count <= r.Max {
+		return 0, "", nil
+	}
+	return r.Score, fmt.Sprintf("%d declined payments by %s within %s", count, r.Key, window), nil
+}
@@ -0,0 +1,116 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"payment-service/auth"
+	"payment-service/db"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carries the client-chosen key that identifies retries of a request
+const Header = "Idempotency-Key"
+
+// TTL is how long a key and its response are kept
+var TTL = 24 * time.Hour
+
+// Middleware makes next safe to retry for requests sent with an
+// Idempotency-Key header. The first response for a key is stored and
+// replayed for every retry with the same body; reusing the key for a
+// different request returns 422, and a retry that arrives while the first
+// request is still running returns 409. Server errors are not stored so the
+// request can be retried. Keys are scoped to the caller and to scope.
+func Middleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+		owner := auth.UserID(r.Context())
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("idempotency.key", key))
+
+		existing, err := db.ClaimIdempotencyKey(r.Context(), scope, owner, key, fingerprint, TTL)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				span.AddEvent("idempotency.mismatch")
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			case existing.Status != db.IdempotencyCompleted:
+				writeError(w, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+			default:
+				span.AddEvent("idempotency.replayed")
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.ResponseStatus)
+				w.Write(existing.ResponseBody)
+			}
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status >= 500 {
+			err = db.ReleaseIdempotencyKey(r.Context(), scope, owner, key)
+		} else {
+			err = db.CompleteIdempotencyKey(r.Context(), scope, owner, key, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Idempotency: Failed to store response", "key", key, "error", err)
+		}
+	}
+}
+
+// recorder passes the response through while keeping a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
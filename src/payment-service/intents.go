@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"payment-service/auth"
+	"payment-service/db"
+	"payment-service/provider"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Payments are made through the provider's intents. A payment created with
+// captureMethod "manual" is only authorized: it is captured once the order
+// can be fulfilled, or voided to release the hold on the card.
+
+func capturePayment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	payment, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	payment = refreshIntent(r.Context(), payment)
+
+	switch payment.Status {
+	case db.PaymentCompleted, db.PaymentPartiallyRefunded, db.PaymentRefunded:
+		// Already captured, so a retried capture succeeds
+		json.NewEncoder(w).Encode(payment)
+		return
+	case db.PaymentAuthorized:
+	default:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payment cannot be captured in status " + payment.Status})
+		return
+	}
+	if payment.ReviewStatus == db.ReviewPending {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payment is held for review"})
+		return
+	}
+
+	intent, err := paymentProvider.Capture(r.Context(), payment.TransactionID, "capture-"+payment.ID)
+	if err != nil {
+		w.WriteHeader(providerErrorStatus(err))
+		json.NewEncoder(w).Encode(map[string]string{"error": "Capture Error: " + err.Error()})
+		return
+	}
+
+	updateIntent(w, r, payment, intent, "payment.captured")
+}
+
+func voidPayment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// The body is optional and may carry a cancellation reason, e.g. Stripe's
+	// "abandoned" or "requested_by_customer"
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	payment, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	payment = refreshIntent(r.Context(), payment)
+
+	switch payment.Status {
+	case db.PaymentVoided:
+		json.NewEncoder(w).Encode(payment)
+		return
+	case db.PaymentAuthorized, db.PaymentRequiresAction, db.PaymentProcessing:
+	default:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payment cannot be voided in status " + payment.Status + ", refund it instead"})
+		return
+	}
+
+	intent, err := paymentProvider.Void(r.Context(), payment.TransactionID, req.Reason, "void-"+payment.ID)
+	if err != nil {
+		w.WriteHeader(providerErrorStatus(err))
+		json.NewEncoder(w).Encode(map[string]string{"error": "Void Error: " + err.Error()})
+		return
+	}
+
+	updateIntent(w, r, payment, intent, "payment.voided")
+}
+
+// updateIntent stores the status the provider returned for a capture or void
+// and writes the updated payment
+func updateIntent(w http.ResponseWriter, r *http.Request, payment *db.Payment, intent *provider.Intent, event string) {
+	updated, err := db.UpdatePaymentIntent(r.Context(), payment.ID, []string{payment.Status}, intent.Status, intent.ProviderStatus)
+	if err != nil {
+		if err.Error() == "payment status changed" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Payment was changed concurrently, reload it and try again"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).AddEvent(event, trace.WithAttributes(
+		attribute.String("payment.id", updated.ID),
+		attribute.String("payment.intent.id", intent.ID),
+		attribute.String("payment.intent.status", intent.ProviderStatus),
+		attribute.String("payment.status", updated.Status),
+	))
+	markOrderPaid(r.Context(), updated)
+
+	json.NewEncoder(w).Encode(updated)
+}
+
+// loadPayment reads the payment named in the URL, writing 404 or 403 if it
+// does not exist or belongs to someone else
+func loadPayment(w http.ResponseWriter, r *http.Request) (*db.Payment, bool) {
+	paymentID := mux.Vars(r)["paymentId"]
+
+	payment, err := db.GetPayment(r.Context(), paymentID)
+	if err != nil {
+		if err.Error() == "payment not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Payment not found"})
+			return nil, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return nil, false
+	}
+
+	if !auth.CanAccess(r.Context(), payment.UserID) {
+		auth.Forbid(w, r, "payment", paymentID)
+		return nil, false
+	}
+
+	return payment, true
+}
+
+// refreshIntent asks the provider for the current status of a payment that
+// is waiting on the customer or the card network, e.g. after 3-D Secure was
+// completed in the browser. Other payments, and payments the provider cannot
+// be reached for, are returned unchanged.
+func refreshIntent(ctx context.Context, payment *db.Payment) *db.Payment {
+	if payment.Status != db.PaymentRequiresAction && payment.Status != db.PaymentProcessing {
+		return payment
+	}
+	intent, err := paymentProvider.Lookup(ctx, payment.TransactionID)
+	if err != nil {
+		slog.WarnContext(ctx, "Payment: Failed to refresh intent", "transaction_id", payment.TransactionID, "error", err)
+		return payment
+	}
+
+	if intent.Status == payment.Status {
+		return payment
+	}
+
+	updated, err := db.UpdatePaymentIntent(ctx, payment.ID, []string{payment.Status}, intent.Status, intent.ProviderStatus)
+	if err != nil {
+		slog.ErrorContext(ctx, "Payment: Failed to store intent status", "payment_id", payment.ID, "error", err)
+		return payment
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("payment.intent_updated", trace.WithAttributes(
+		attribute.String("payment.id", payment.ID),
+		attribute.String("payment.intent.status", intent.ProviderStatus),
+	))
+	markOrderPaid(ctx, updated)
+	return updated
+}
+
+// writeProviderError reports a failed provider call while creating a payment
+func writeProviderError(w http.ResponseWriter, prefix string, err error) {
+	w.WriteHeader(providerErrorStatus(err))
+	json.NewEncoder(w).Encode(db.PaymentResponse{
+		Success: false,
+		Message: prefix + ": " + err.Error(),
+	})
+}
+
+// providerErrorStatus is 402 for card errors, which are the customer's to
+// fix, 504 when the provider timed out and 502 for anything else it fails
+// with
+func providerErrorStatus(err error) int {
+	var cardErr *provider.CardError
+	switch {
+	case errors.As(err, &cardErr):
+		return http.StatusPaymentRequired
+	case errors.Is(err, provider.ErrTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -4,29 +4,41 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"payment-service/auth"
 	"payment-service/db"
+	"payment-service/idempotency"
+	"payment-service/money"
+	"payment-service/orders"
+	"payment-service/provider"
 	"payment-service/telemetry" // Added telemetry import
 
 	"github.com/gorilla/mux"
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
 
 	flagd "github.com/open-feature/go-sdk-contrib/providers/flagd/pkg"
 	"github.com/open-feature/go-sdk/openfeature"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var sc *client.API
+var paymentProvider provider.PaymentProvider
+
+var orderClient *orders.Client
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -62,110 +74,274 @@ func processPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !db.ValidateCardNumber(req.CardNumber) {
+	if !req.Amount.IsPositive() {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(db.PaymentResponse{
 			Success: false,
-			Message: "Invalid card number",
+			Message: "amount must be positive",
 		})
 		return
 	}
-
-	if !db.ValidateExpiryDate(req.ExpiryDate) {
+	// Amounts are stored with two decimals, so KWD and the like would be
+	// rounded
+	if !money.Storable(req.Amount.Currency) {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(db.PaymentResponse{
 			Success: false,
-			Message: "Invalid or expired card",
+			Message: "unsupported currency " + req.Amount.Currency,
 		})
 		return
 	}
 
-	if !db.ValidateCVV(req.CVV) {
+	switch req.CaptureMethod {
+	case "":
+		req.CaptureMethod = db.CaptureAutomatic
+	case db.CaptureAutomatic, db.CaptureManual:
+	default:
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(db.PaymentResponse{
 			Success: false,
-			Message: "Invalid CVV",
+			Message: "captureMethod must be automatic or manual",
 		})
 		return
 	}
 
-	// Parse expiry date
-	var expMonth, expYear string
-	if len(req.ExpiryDate) == 5 { // MM/YY
-		expMonth = req.ExpiryDate[:2]
-		expYear = "20" + req.ExpiryDate[3:]
-	} else if len(req.ExpiryDate) == 7 { // MM/YYYY
-		expMonth = req.ExpiryDate[:2]
-		expYear = req.ExpiryDate[3:]
-	} else {
-		// Should be caught by validation, but just in case
-		expMonth = "12"
-		expYear = "2025"
+	// 1. Check the order and the card
+	if !checkOrder(w, r, &req) {
+		return
+	}
+	card, ok := cardFor(w, r, &req)
+	if !ok {
+		return
 	}
 
-	// 1. Create a Token
-	tokenParams := &stripe.TokenParams{
-		Card: &stripe.CardParams{
-			Number:   stripe.String(req.CardNumber),
-			ExpMonth: stripe.String(expMonth),
-			ExpYear:  stripe.String(expYear),
-			CVC:      stripe.String(req.CVV),
-		},
+	// 2. Score the payment. Blocked payments never reach the provider, and
+	// payments held for review are only authorized until they are approved.
+	assessment := assessFraud(r, &req, card)
+	if assessment.Decision == db.FraudBlock {
+		blockPayment(w, r, req, card, assessment)
+		return
+	}
+	captureMethod := req.CaptureMethod
+	if assessment.Decision == db.FraudReview {
+		captureMethod = db.CaptureManual
 	}
 
-	token, err := sc.Tokens.New(tokenParams)
+	// 3. Record the payment as pending before the card is charged. An order
+	// has at most one payment that did not fail, so of two concurrent
+	// requests to pay it only one gets past this point.
+	pending, err := db.StartPayment(r.Context(), req, auth.UserID(r.Context()), assessment)
 	if err != nil {
+		if err.Error() == "order already has a payment" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(db.PaymentResponse{
+				Success: false,
+				Message: "Order already has a payment",
+			})
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(db.PaymentResponse{
 			Success: false,
-			Message: "Stripe Token Error: " + err.Error(),
+			Message: "Database Error: " + err.Error(),
 		})
 		return
 	}
 
-	// 2. Create a Charge
-	chargeParams := &stripe.ChargeParams{
-		Amount:   stripe.Int64(int64(req.Amount * 100)), // Amount in cents
-		Currency: stripe.String(req.Currency),
-		Source:   &stripe.SourceParams{Token: stripe.String(token.ID)},
+	// 4. Authorize the payment at the provider. With manual capture the card
+	// is only authorized until the payment is captured or voided.
+	intent, err := paymentProvider.Authorize(r.Context(), provider.AuthorizeRequest{
+		OrderID:        req.OrderID,
+		Amount:         req.Amount,
+		Card:           card,
+		CaptureMethod:  captureMethod,
+		ReturnURL:      req.ReturnURL,
+		IdempotencyKey: r.Header.Get(idempotency.Header),
+	})
+	if err != nil {
+		// The order can be paid again
+		if err := db.UpdatePaymentStatus(r.Context(), pending.ID, db.PaymentFailed); err != nil {
+			slog.ErrorContext(r.Context(), "ProcessPayment: Failed to fail pending payment", "payment_id", pending.ID, "error", err)
+		}
+		recordProviderError(r.Context(), err, req.Amount)
+		writeProviderError(w, "Payment Provider Error", err)
+		return
 	}
 
-	charge, err := sc.Charges.New(chargeParams)
+	status := intent.Status
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("payment.provider", paymentProvider.Name()),
+		attribute.String("payment.intent.id", intent.ID),
+		attribute.String("payment.intent.status", intent.ProviderStatus),
+		attribute.String("payment.capture_method", req.CaptureMethod),
+	)
+
+	// 5. Save the outcome using the provider's intent ID
+	payment, err := db.FinishPayment(r.Context(), pending.ID, intent.CardLastFour, intent.ID, intent.ProviderStatus, status, assessment)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(db.PaymentResponse{
 			Success: false,
-			Message: "Stripe Charge Error: " + err.Error(),
+			Message: "Database Error: " + err.Error(),
 		})
 		return
 	}
 
-	// 3. Save to DB using Stripe Charge ID
-	payment, err := db.CreatePayment(req, charge.ID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	switch status {
+	case db.PaymentRequiresAction:
+		recordPayment(r.Context(), outcomeRequiresAction, "", req.Amount)
+		// The client completes the action with Stripe.js using the client
+		// secret; the payment is updated the next time it is read
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(db.PaymentResponse{
+			Success:      false,
+			Message:      "Payment requires additional authentication",
+			Payment:      *payment,
+			ClientSecret: intent.ClientSecret,
+			NextAction:   intent.NextAction,
+		})
+	case db.PaymentProcessing:
+		recordPayment(r.Context(), outcomeProcessing, "", req.Amount)
+		w.WriteHeader(http.StatusAccepted)
 		json.NewEncoder(w).Encode(db.PaymentResponse{
 			Success: false,
-			Message: "Database Error: " + err.Error(),
+			Message: "Payment is processing",
+			Payment: *payment,
+		})
+	case db.PaymentFailed, db.PaymentVoided:
+		recordPayment(r.Context(), outcomeDeclined, intent.ProviderStatus, req.Amount)
+		message := "Payment was declined"
+		if intent.DeclineMessage != "" {
+			message += ": " + intent.DeclineMessage
+		}
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(db.PaymentResponse{
+			Success: false,
+			Message: message,
+			Payment: *payment,
+		})
+	case db.PaymentAuthorized:
+		if payment.ReviewStatus == db.ReviewPending {
+			recordPayment(r.Context(), outcomeHeld, "", req.Amount)
+			writeHeldPayment(w, payment)
+			return
+		}
+		recordPayment(r.Context(), outcomeAuthorized, "", req.Amount)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(db.PaymentResponse{
+			Success: true,
+			Message: "Payment authorized, capture it to complete it",
+			Payment: *payment,
+		})
+	default:
+		recordPayment(r.Context(), outcomeSucceeded, "", req.Amount)
+		markOrderPaid(r.Context(), payment)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(db.PaymentResponse{
+			Success: true,
+			Message: "Payment processed successfully",
+			Payment: *payment,
 		})
-		return
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
+// writeHeldPayment answers a payment that was authorized and held for review.
+// It is not done yet, whether it was to be captured right away or later:
+// approving it captures it and marks the order paid, declining it voids it
+// and cancels the order.
+func writeHeldPayment(w http.ResponseWriter, payment *db.Payment) {
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(db.PaymentResponse{
-		Success: true,
-		Message: "Payment processed successfully via Stripe",
+		Success: false,
+		Message: "Payment is held for review",
 		Payment: *payment,
 	})
 }
 
+// checkOrder looks up the order of a payment request in cart-order-service
+// and checks that the caller may pay for it, that it is still waiting for a
+// payment and that the amount is its total. Otherwise it writes the error
+// response.
+func checkOrder(w http.ResponseWriter, r *http.Request, req *db.PaymentRequest) bool {
+	writeError := func(status int, message string) bool {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(db.PaymentResponse{
+			Success: false,
+			Message: message,
+		})
+		return false
+	}
+
+	order, err := orderClient.GetOrder(r.Context(), req.OrderID)
+	if err != nil {
+		if err.Error() == "order not found" {
+			return writeError(http.StatusNotFound, "Order not found")
+		}
+		slog.ErrorContext(r.Context(), "ProcessPayment: Failed to look up order", "order_id", req.OrderID, "error", err)
+		return writeError(http.StatusBadGateway, "Order service unavailable")
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("order.id", order.ID),
+		attribute.String("order.status", order.Status),
+		attribute.Float64("order.total", order.Total.Float64()),
+		attribute.String("order.currency", order.Total.Currency),
+	)
+
+	if !auth.CanAccess(r.Context(), order.UserID) {
+		auth.Forbid(w, r, "order", order.ID)
+		return false
+	}
+
+	if order.Status != orders.OrderPending {
+		span.AddEvent("payment.order_not_payable")
+		if order.Status == orders.OrderPaid {
+			return writeError(http.StatusConflict, "Order is already paid")
+		}
+		return writeError(http.StatusConflict, "Order cannot be paid in status "+order.Status)
+	}
+
+	// Only a failed or voided attempt may be followed by another one, so that
+	// an order is never charged twice
+	previous, err := db.GetPaymentByOrderID(r.Context(), order.ID)
+	if err != nil && err.Error() != "payment not found for this order" {
+		return writeError(http.StatusInternalServerError, "Database Error: "+err.Error())
+	}
+	if previous != nil && previous.Status != db.PaymentFailed && previous.Status != db.PaymentVoided {
+		span.AddEvent("payment.order_not_payable", trace.WithAttributes(attribute.String("payment.id", previous.ID)))
+		return writeError(http.StatusConflict, fmt.Sprintf("Order already has payment %s in status %s", previous.ID, previous.Status))
+	}
+
+	if req.Amount != order.Total {
+		span.AddEvent("payment.amount_mismatch")
+		return writeError(http.StatusBadRequest, fmt.Sprintf("Amount %s does not match the order total %s", req.Amount, order.Total))
+	}
+	return true
+}
+
+// markOrderPaid moves the order of a completed payment to paid. The payment
+// has succeeded either way, so a failed update is only logged.
+func markOrderPaid(ctx context.Context, payment *db.Payment) {
+	if payment.Status != db.PaymentCompleted {
+		return
+	}
+	if err := orderClient.MarkPaid(ctx, payment.OrderID, payment.ID); err != nil {
+		slog.ErrorContext(ctx, "Payment: Failed to mark order paid", "order_id", payment.OrderID, "error", err)
+		trace.SpanFromContext(ctx).AddEvent("order.paid_notification_failed", trace.WithAttributes(
+			attribute.String("order.id", payment.OrderID),
+			attribute.String("error", err.Error()),
+		))
+	}
+}
+
 func getPayment(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	vars := mux.Vars(r)
 	paymentID := vars["paymentId"]
 
-	payment, err := db.GetPayment(paymentID)
+	payment, err := db.GetPayment(r.Context(), paymentID)
 	if err != nil {
 		if err.Error() == "payment not found" {
 			w.WriteHeader(http.StatusNotFound)
@@ -177,7 +353,12 @@ func getPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(payment)
+	if !auth.CanAccess(r.Context(), payment.UserID) {
+		auth.Forbid(w, r, "payment", paymentID)
+		return
+	}
+
+	json.NewEncoder(w).Encode(refreshIntent(r.Context(), payment))
 }
 
 func getPaymentByOrderID(w http.ResponseWriter, r *http.Request) {
@@ -186,7 +367,7 @@ func getPaymentByOrderID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["orderId"]
 
-	payment, err := db.GetPaymentByOrderID(orderID)
+	payment, err := db.GetPaymentByOrderID(r.Context(), orderID)
 	if err != nil {
 		if err.Error() == "payment not found for this order" {
 			w.WriteHeader(http.StatusNotFound)
@@ -198,7 +379,12 @@ func getPaymentByOrderID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(payment)
+	if !auth.CanAccess(r.Context(), payment.UserID) {
+		auth.Forbid(w, r, "payment", payment.ID)
+		return
+	}
+
+	json.NewEncoder(w).Encode(refreshIntent(r.Context(), payment))
 }
 
 func refundPayment(w http.ResponseWriter, r *http.Request) {
@@ -207,44 +393,197 @@ func refundPayment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	paymentID := vars["paymentId"]
 
-	err := db.UpdatePaymentStatus(paymentID, "refunded")
+	// The body is optional, without an amount the rest of the payment is
+	// refunded
+	var req struct {
+		Amount money.Money `json:"amount"`
+		Reason string      `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+	if req.Amount.IsNegative() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Refund amount must be positive"})
+		return
+	}
+
+	payment, err := db.GetPayment(r.Context(), paymentID)
+	if err != nil {
+		if err.Error() == "payment not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Payment not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if !auth.CanAccess(r.Context(), payment.UserID) {
+		auth.Forbid(w, r, "payment", paymentID)
+		return
+	}
+
+	// Asking again for a full refund of a refunded payment is not an error,
+	// so that callers such as the checkout saga can retry it safely
+	if req.Amount.IsZero() && payment.Status == db.PaymentRefunded {
+		json.NewEncoder(w).Encode(payment)
+		return
+	}
+
+	refund, err := db.CreateRefund(r.Context(), paymentID, req.Amount, req.Reason, auth.UserID(r.Context()))
+	if err != nil {
+		switch err.Error() {
+		case "currency mismatch":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Refund amount must be in " + payment.Amount.Currency})
+		case "payment not refundable", "nothing to refund", "refund exceeds refundable amount":
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":            "Payment cannot be refunded: " + err.Error(),
+				"refundableAmount": payment.RefundableAmount,
+			})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		}
+		return
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("payment.id", paymentID),
+		attribute.String("refund.id", refund.ID),
+		attribute.Float64("refund.amount", refund.Amount.Float64()),
+		attribute.String("refund.currency", refund.Amount.Currency),
+	)
+
+	// A retried refund must not be issued twice, so the refund ID is the
+	// idempotency key
+	providerRefund, err := paymentProvider.Refund(r.Context(), provider.RefundRequest{
+		TransactionID:  payment.TransactionID,
+		Amount:         refund.Amount,
+		PaymentID:      paymentID,
+		RefundID:       refund.ID,
+		IdempotencyKey: refund.ID,
+	})
+	if err != nil {
+		if _, _, cerr := db.CompleteRefund(r.Context(), refund.ID, "", db.RefundFailed); cerr != nil {
+			slog.ErrorContext(r.Context(), "Refund: Failed to mark refund as failed", "refund_id", refund.ID, "error", cerr)
+		}
+		recordRefund(r.Context(), db.RefundFailed, refund.Amount)
+		span.RecordError(err)
+		w.WriteHeader(providerErrorStatus(err))
+		json.NewEncoder(w).Encode(map[string]string{"error": "Refund Error: " + err.Error()})
+		return
+	}
+
+	refund, payment, err = db.CompleteRefund(r.Context(), refund.ID, providerRefund.ID, db.RefundSucceeded)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	recordRefund(r.Context(), db.RefundSucceeded, refund.Amount)
+	notifyRefund(r.Context(), payment, refund)
+
+	json.NewEncoder(w).Encode(struct {
+		*db.Payment
+		Refund *db.Refund `json:"refund"`
+	}{payment, refund})
+}
+
+// notifyRefund tells cart-order-service how much of the payment's order is
+// refunded now. The refund has happened at the provider either way, so a failed
+// notification is only logged.
+func notifyRefund(ctx context.Context, payment *db.Payment, refund *db.Refund) {
+	err := orderClient.NotifyRefund(ctx, payment.OrderID, orders.RefundNotice{
+		PaymentID:      payment.ID,
+		RefundID:       refund.ID,
+		RefundedAmount: payment.RefundedAmount,
+		FullyRefunded:  payment.Status == db.PaymentRefunded,
+		Reason:         refund.Reason,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Refund: Failed to notify cart-order-service", "refund_id", refund.ID, "error", err)
+		trace.SpanFromContext(ctx).AddEvent("order.refund_notification_failed", trace.WithAttributes(
+			attribute.String("order.id", payment.OrderID),
+			attribute.String("error", err.Error()),
+		))
+	}
+}
+
+func getPaymentRefunds(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	paymentID := vars["paymentId"]
+
+	payment, err := db.GetPayment(r.Context(), paymentID)
 	if err != nil {
+		if err.Error() == "payment not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Payment not found"})
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
-	payment, err := db.GetPayment(paymentID)
+	if !auth.CanAccess(r.Context(), payment.UserID) {
+		auth.Forbid(w, r, "payment", paymentID)
+		return
+	}
+
+	refunds, err := db.GetRefunds(r.Context(), paymentID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
-	json.NewEncoder(w).Encode(payment)
+	json.NewEncoder(w).Encode(refunds)
 }
 
 func main() {
-	// Initialize OpenTelemetry
+	// Initialize OpenTelemetry. Logs are JSON from here on, and scrubbed of
+	// card numbers whatever ends up in a message.
 	ctx := context.Background()
-	shutdownTracer := telemetry.InitTracer(ctx) // Uncommented
-	defer shutdownTracer(ctx)                   // Uncommented
+	shutdownTelemetry := telemetry.Init(ctx)
+	defer shutdownTelemetry(ctx)
 
 	// Initialize OpenFeature provider
-	provider, err := flagd.NewProvider(
+	flagProvider, err := flagd.NewProvider(
 		flagd.WithHost("otel-flagd.apps.svc.cluster.local"),
 		flagd.WithPort(8013),
 	)
 	if err != nil {
-		log.Printf("Warning: Failed to create flagd provider: %v", err)
+		slog.Warn("Failed to create flagd provider", "error", err)
 	} else {
-		openfeature.SetProvider(provider)
+		openfeature.SetProvider(flagProvider)
 	}
 
 	db.InitDB()
 	defer db.CloseDB()
 
-	// Initialize Stripe Client pointing to stripe-mock
+	if err := auth.Init(); err != nil {
+		slog.Error("Failed to initialize auth", "error", err)
+		os.Exit(1)
+	}
+	initFraud()
+
+	if ttl, err := time.ParseDuration(db.GetEnvOrDefault("IDEMPOTENCY_KEY_TTL", "24h")); err == nil && ttl > 0 {
+		idempotency.TTL = ttl
+	} else {
+		slog.Warn("Invalid IDEMPOTENCY_KEY_TTL, using the default", "ttl", idempotency.TTL.String())
+	}
+
+	// Stripe configuration, stripe-mock by default
 	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
 	if stripeKey == "" {
 		stripeKey = "sk_test_default_mock_key"
@@ -255,21 +594,59 @@ func main() {
 		stripeURL = "http://localhost:12111"
 	}
 
-	sc = &client.API{}
-	sc.Init(stripeKey, &stripe.Backends{
-		API: stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
-			URL: stripe.String(stripeURL), // Address of stripe-mock from env
-		}),
-	})
+	webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		slog.Warn("STRIPE_WEBHOOK_SECRET is not set, Stripe webhooks will be rejected")
+	}
+
+	// Raw card fields are for local testing against stripe-mock only
+	if db.GetEnvOrDefault("PAYMENT_RAW_CARDS_TEST_MODE", "false") == "true" {
+		if strings.HasPrefix(stripeKey, "sk_live_") {
+			slog.Warn("PAYMENT_RAW_CARDS_TEST_MODE is ignored with a live Stripe key")
+		} else {
+			rawCardsTestMode = true
+			slog.Warn("Raw card details are accepted (PAYMENT_RAW_CARDS_TEST_MODE), never use this in production")
+		}
+	}
+
+	// Stripe by default. The fake provider needs neither Stripe nor
+	// stripe-mock, and the failing one fails every call.
+	switch name := db.GetEnvOrDefault("PAYMENT_PROVIDER", "stripe"); name {
+	case "stripe":
+		paymentProvider = provider.NewStripe(stripeKey, stripeURL)
+	case "fake":
+		paymentProvider = provider.NewFake()
+	case "failing":
+		paymentProvider = provider.Failing{}
+	default:
+		slog.Error("Unknown PAYMENT_PROVIDER, use stripe, fake or failing", "provider", name)
+		os.Exit(1)
+	}
+	slog.Info("Using payment provider", "provider", paymentProvider.Name())
+
+	orderClient = orders.NewClient()
 
 	r := mux.NewRouter()
 
 	r.Use(enableCORS)
+	r.Use(auth.Middleware)
 
-	r.HandleFunc("/api/payments", processPayment).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/payments/{paymentId}", getPayment).Methods("GET", "OPTIONS")
-	r.HandleFunc("/api/payments/order/{orderId}", getPaymentByOrderID).Methods("GET", "OPTIONS")
-	r.HandleFunc("/api/payments/{paymentId}/refund", refundPayment).Methods("POST", "OPTIONS")
+	// Stripe authenticates webhooks with the Stripe-Signature header
+	r.HandleFunc("/api/payments/webhooks/stripe", handleStripeWebhook).Methods("POST")
+	r.HandleFunc("/api/payments/webhooks/stripe/events", auth.RequireRole(getStripeEvents, auth.RoleAdmin)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/payments/webhooks/stripe/events/{eventId}/replay", auth.RequireRole(replayStripeEvent, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+
+	// The review queue of payments held by the fraud rules
+	r.HandleFunc("/api/payments/reviews", auth.RequireRole(getHeldPayments, auth.RoleAdmin)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/payments/{paymentId}/review", auth.RequireRole(reviewPayment, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/api/payments", auth.Require(idempotency.Middleware("payments", processPayment))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/payments/{paymentId}", auth.Require(getPayment)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/payments/order/{orderId}", auth.Require(getPaymentByOrderID)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/payments/{paymentId}/capture", auth.Require(capturePayment)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/payments/{paymentId}/void", auth.Require(voidPayment)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/payments/{paymentId}/refund", auth.Require(refundPayment)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/payments/{paymentId}/refunds", auth.Require(getPaymentRefunds)).Methods("GET", "OPTIONS")
 
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -277,7 +654,25 @@ func main() {
 	}).Methods("GET", "OPTIONS")
 
 	port := "8003" // Changed to string for fmt.Sprintf
-	fmt.Printf("Payment Service running on http://localhost:%s\n", port)
-	handler := otelhttp.NewHandler(r, "payment-service")              // Added otelhttp middleware
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), handler)) // Modified ListenAndServe
+	slog.Info("Payment Service running", "url", "http://localhost:"+port)
+	handler := otelhttp.NewHandler(r, "payment-service") // Added otelhttp middleware
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGTERM finish the requests in flight, then flush logs, traces and
+	// metrics through the deferred shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down the server", "error", err)
+	}
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"payment-service/auth"
+	"payment-service/db"
+	"payment-service/fraud"
+	"payment-service/idempotency"
+	"payment-service/money"
+	"payment-service/provider"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// withPayments sets up processPayment with the fake provider and no fraud
+// rules, and returns a token for user_1, who owns order ord_1
+func withPayments(t *testing.T) string {
+	t.Setenv("AUTH_JWT_SECRET", "test-secret")
+	if err := auth.Init(); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := auth.IssueAccessToken("user_1", auth.RoleCustomer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousProvider, previousEngine := paymentProvider, fraudEngine
+	paymentProvider = provider.NewFake()
+	fraudEngine = fraud.New(fraud.Config{ReviewScore: 50, BlockScore: 80})
+	t.Cleanup(func() {
+		paymentProvider, fraudEngine = previousProvider, previousEngine
+	})
+	return token
+}
+
+// postPayment pays order ord_1 with a payment method the way the router
+// does, including the idempotency middleware
+func postPayment(token, paymentMethodID, idempotencyKey string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(db.PaymentRequest{
+		OrderID:         "ord_1",
+		Amount:          money.New(120000, "USD"),
+		PaymentMethodID: paymentMethodID,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/payments", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if idempotencyKey != "" {
+		req.Header.Set(idempotency.Header, idempotencyKey)
+	}
+	w := httptest.NewRecorder()
+	auth.Middleware(auth.Require(idempotency.Middleware("payments", processPayment))).ServeHTTP(w, req)
+	return w
+}
+
+// expectNewPayment expects the lookup of an earlier payment of ord_1, which
+// finds none, and the pending payment pay_1
+func expectNewPayment(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT .* FROM payments WHERE order_id = \$1`).
+		WithArgs("ord_1").
+		WillReturnRows(sqlmock.NewRows(paymentRowColumns))
+	mock.ExpectQuery(`INSERT INTO payments`).
+		WillReturnRows(paymentRow("pay_1", "", db.PaymentPending))
+}
+
+// capture matches any string argument and keeps it
+type capture struct{ value *string }
+
+func (c capture) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.value = s
+	return ok
+}
+
+// heldPaymentRow is payment pay_1 of ord_1, authorized and held for review
+// with the given review status
+func heldPaymentRow(intentID, reviewStatus string) *sqlmock.Rows {
+	return sqlmock.NewRows(paymentRowColumns).AddRow(
+		"pay_1", "ord_1", "user_1", "1200.00", "USD", db.PaymentAuthorized, "4242", intentID, db.CaptureAutomatic,
+		"requires_capture", "", reviewStatus, 60, db.FraudReview, []byte(`["amount: over 1000.00 USD"]`), "", "", "", "", "", "0", "2026-01-01 00:00:00", "2026-01-01 00:00:00",
+	)
+}
+
+func decodePayment(t *testing.T, w *httptest.ResponseRecorder) db.PaymentResponse {
+	var resp db.PaymentResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v", w.Body, err)
+	}
+	return resp
+}
+
+func TestProcessPaymentSucceeds(t *testing.T) {
+	token := withPayments(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+
+	expectNewPayment(mock)
+	mock.ExpectQuery(`UPDATE payments`).
+		WithArgs("pay_1", db.PaymentCompleted, "4242", sqlmock.AnyArg(), "succeeded", "").
+		WillReturnRows(paymentRow("pay_1", "pi_fake_1", db.PaymentCompleted))
+
+	w := postPayment(token, "pm_card_visa", "")
+	resp := decodePayment(t, w)
+	if w.Code != http.StatusOK || !resp.Success || resp.Payment.Status != db.PaymentCompleted {
+		t.Fatalf("%d %s, want 200 and a completed payment", w.Code, w.Body)
+	}
+	if got := updates.list(); len(got) != 1 || got[0] != "/api/orders/ord_1/status paid" {
+		t.Errorf("order updates = %v, want ord_1 paid", got)
+	}
+}
+
+func TestProcessPaymentDeclined(t *testing.T) {
+	token := withPayments(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+
+	// The pending payment fails so that the order can be paid again
+	expectNewPayment(mock)
+	mock.ExpectExec(`UPDATE payments SET status = \$1`).
+		WithArgs(db.PaymentFailed, "pay_1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := postPayment(token, "pm_card_chargeDeclined", "")
+	if w.Code != http.StatusPaymentRequired || !strings.Contains(w.Body.String(), "Your card was declined") {
+		t.Fatalf("%d %s, want 402", w.Code, w.Body)
+	}
+	if got := updates.list(); len(got) != 0 {
+		t.Errorf("order updates = %v, want none", got)
+	}
+}
+
+func TestProcessPaymentRequiresAction(t *testing.T) {
+	token := withPayments(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+
+	expectNewPayment(mock)
+	mock.ExpectQuery(`UPDATE payments`).
+		WithArgs("pay_1", db.PaymentRequiresAction, "3184", sqlmock.AnyArg(), "requires_action", "").
+		WillReturnRows(paymentRow("pay_1", "pi_fake_1", db.PaymentRequiresAction))
+
+	w := postPayment(token, "pm_card_threeDSecure2Required", "")
+	resp := decodePayment(t, w)
+	if w.Code != http.StatusAccepted || resp.Success {
+		t.Fatalf("%d %s, want 202", w.Code, w.Body)
+	}
+	if resp.ClientSecret == "" || resp.NextAction == nil {
+		t.Errorf("client secret %q and next action %v, want both", resp.ClientSecret, resp.NextAction)
+	}
+	if got := updates.list(); len(got) != 0 {
+		t.Errorf("order updates = %v, want none", got)
+	}
+}
+
+func TestProcessPaymentHeldForReview(t *testing.T) {
+	token := withPayments(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+	fraudEngine = &fraud.Engine{ReviewScore: 50, BlockScore: 80, Rules: []fraud.Rule{
+		fraud.AmountRule{Above: money.New(100000, "USD"), Score: 60},
+	}}
+
+	// A held payment is only authorized, whatever the capture method
+	expectNewPayment(mock)
+	mock.ExpectQuery(`UPDATE payments`).
+		WithArgs("pay_1", db.PaymentAuthorized, "4242", sqlmock.AnyArg(), "requires_capture", db.ReviewPending).
+		WillReturnRows(heldPaymentRow("pi_fake_1", db.ReviewPending))
+
+	w := postPayment(token, "pm_card_visa", "")
+	resp := decodePayment(t, w)
+	if w.Code != http.StatusAccepted || resp.Success || resp.Payment.ReviewStatus != db.ReviewPending {
+		t.Fatalf("%d %s, want 202 and a payment held for review", w.Code, w.Body)
+	}
+	// The order stays pending until the payment is reviewed
+	if got := updates.list(); len(got) != 0 {
+		t.Errorf("order updates = %v, want none", got)
+	}
+}
+
+func TestProcessPaymentIdempotentRetry(t *testing.T) {
+	token := withPayments(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+
+	var fingerprint string
+	mock.ExpectQuery(`INSERT INTO idempotency_keys`).
+		WithArgs("payments", "user_1", "key_1", capture{&fingerprint}, db.IdempotencyProcessing, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"claimed"}).AddRow(true))
+	expectNewPayment(mock)
+	mock.ExpectQuery(`UPDATE payments`).
+		WillReturnRows(paymentRow("pay_1", "pi_fake_1", db.PaymentCompleted))
+	mock.ExpectExec(`UPDATE idempotency_keys`).
+		WithArgs("payments", "user_1", "key_1", db.IdempotencyCompleted, http.StatusOK, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	first := postPayment(token, "pm_card_visa", "key_1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("%d %s, want 200", first.Code, first.Body)
+	}
+	stored := first.Body.Bytes()
+
+	// The retry finds the key taken and replays the stored response without
+	// looking at the order or charging the card again
+	mock.ExpectQuery(`INSERT INTO idempotency_keys`).
+		WithArgs("payments", "user_1", "key_1", fingerprint, db.IdempotencyProcessing, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"claimed"}))
+	mock.ExpectQuery(`SELECT fingerprint, status`).
+		WithArgs("payments", "user_1", "key_1").
+		WillReturnRows(sqlmock.NewRows([]string{"fingerprint", "status", "response_status", "response_body"}).
+			AddRow(fingerprint, db.IdempotencyCompleted, http.StatusOK, stored))
+
+	retry := postPayment(token, "pm_card_visa", "key_1")
+	if retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("%d %v, want a replayed 200", retry.Code, retry.Header())
+	}
+	if !bytes.Equal(retry.Body.Bytes(), stored) {
+		t.Errorf("replayed %s, want %s", retry.Body, stored)
+	}
+	if got := updates.list(); len(got) != 1 {
+		t.Errorf("order updates = %v, want ord_1 paid once", got)
+	}
+}
+
+func TestReviewApprovalAfterReservationExpired(t *testing.T) {
+	withPayments(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+	updates.stockLapsed = true
+
+	token, _, err := auth.IssueAccessToken("admin_1", auth.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intent, err := paymentProvider.Authorize(context.Background(), provider.AuthorizeRequest{
+		OrderID:       "ord_1",
+		Amount:        money.New(120000, "USD"),
+		Card:          provider.Card{PaymentMethodID: "pm_card_visa"},
+		CaptureMethod: db.CaptureManual,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reservation expired during the review, so the approval declines
+	// the payment and voids it rather than charging the card
+	mock.ExpectQuery(`SELECT .* FROM payments WHERE id = \$1`).
+		WithArgs("pay_1").
+		WillReturnRows(heldPaymentRow(intent.ID, db.ReviewPending))
+	mock.ExpectQuery(`UPDATE payments\s+SET review_status`).
+		WithArgs("pay_1", db.ReviewDeclined, "admin_1", sqlmock.AnyArg(), db.ReviewPending).
+		WillReturnRows(heldPaymentRow(intent.ID, db.ReviewDeclined))
+	mock.ExpectQuery(`UPDATE payments\s+SET status = \$2`).
+		WithArgs("pay_1", db.PaymentVoided, "canceled", sqlmock.AnyArg()).
+		WillReturnRows(paymentRow("pay_1", intent.ID, db.PaymentVoided))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/payments/pay_1/review", strings.NewReader(`{"decision": "approve"}`)),
+		map[string]string{"paymentId": "pay_1"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	auth.Middleware(auth.RequireRole(reviewPayment, auth.RoleAdmin)).ServeHTTP(w, req)
+
+	var payment db.Payment
+	if err := json.Unmarshal(w.Body.Bytes(), &payment); err != nil || w.Code != http.StatusOK || payment.Status != db.PaymentVoided {
+		t.Fatalf("%d %s, want 200 and a voided payment", w.Code, w.Body)
+	}
+	if got, _ := paymentProvider.Lookup(context.Background(), intent.ID); got.Status != db.PaymentVoided {
+		t.Errorf("intent is %s, want voided", got.Status)
+	}
+	if got := updates.list(); len(got) != 1 || got[0] != "/api/orders/ord_1/status cancelled" {
+		t.Errorf("order updates = %v, want ord_1 cancelled", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"payment-service/db"
+	"payment-service/money"
+	"payment-service/provider"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Business metrics of payments. Attributes are limited to outcomes,
+// provider decline codes, fraud decisions and currencies so that the number
+// of series stays small.
+
+var meter = otel.Meter("payment-service")
+
+var (
+	paymentAttempts, _ = meter.Int64Counter("payment.attempts",
+		metric.WithDescription("Payment requests by outcome, and reason for declines and errors"))
+	paymentAmount, _ = meter.Float64Counter("payment.amount",
+		metric.WithDescription("Amounts of payment requests by outcome, in units of the currency"))
+	refundsIssued, _ = meter.Int64Counter("payment.refunds",
+		metric.WithDescription("Refunds by status"))
+	refundedAmount, _ = meter.Float64Counter("payment.refunded_amount",
+		metric.WithDescription("Amounts refunded, in units of the currency"))
+
+	fraudDecisions, _ = meter.Int64Counter("payment.fraud.decisions",
+		metric.WithDescription("Payments scored by the fraud rules, by decision"))
+	fraudScores, _ = meter.Int64Histogram("payment.fraud.score",
+		metric.WithDescription("Fraud scores of payments, from 0 to 100"),
+		metric.WithExplicitBucketBoundaries(0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100))
+	fraudReviews, _ = meter.Int64Counter("payment.fraud.reviews",
+		metric.WithDescription("Held payments approved or declined by an admin"))
+)
+
+// Outcomes of payment requests
+const (
+	outcomeSucceeded      = "succeeded"
+	outcomeAuthorized     = "authorized"
+	outcomeHeld           = "held"
+	outcomeRequiresAction = "requires_action"
+	outcomeProcessing     = "processing"
+	outcomeDeclined       = "declined"
+	outcomeBlocked        = "blocked"
+	outcomeError          = "error"
+)
+
+// recordPayment counts a payment request and its amount
+func recordPayment(ctx context.Context, outcome, reason string, amount money.Money) {
+	paymentAttempts.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("outcome", outcome),
+		attribute.String("reason", reason),
+		attribute.String("currency", amount.Currency),
+	))
+	paymentAmount.Add(ctx, amount.Float64(), metric.WithAttributes(
+		attribute.String("outcome", outcome),
+		attribute.String("currency", amount.Currency),
+	))
+}
+
+// recordProviderError counts a payment the provider refused or failed. Card
+// errors are declines, by Stripe's decline code.
+func recordProviderError(ctx context.Context, err error, amount money.Money) {
+	var cardErr *provider.CardError
+	switch {
+	case errors.As(err, &cardErr):
+		reason := cardErr.DeclineCode
+		if reason == "" {
+			reason = cardErr.Code
+		}
+		recordPayment(ctx, outcomeDeclined, reason, amount)
+	case errors.Is(err, provider.ErrTimeout):
+		recordPayment(ctx, outcomeError, "timeout", amount)
+	default:
+		recordPayment(ctx, outcomeError, "provider_error", amount)
+	}
+}
+
+// recordRefund counts a refund by its status and, if it succeeded, its
+// amount
+func recordRefund(ctx context.Context, status string, amount money.Money) {
+	refundsIssued.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("status", status),
+		attribute.String("currency", amount.Currency),
+	))
+	if status == db.RefundSucceeded {
+		refundedAmount.Add(ctx, amount.Float64(), metric.WithAttributes(attribute.String("currency", amount.Currency)))
+	}
+}
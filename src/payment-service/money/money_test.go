@@ -0,0 +1,212 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             Money
+	}{
+		{"19.99", "USD", New(1999, "USD")},
+		{"19.9", "usd", New(1990, "USD")},
+		{"19", "USD", New(1900, "USD")},
+		{"0.01", "EUR", New(1, "EUR")},
+		{"-5", "USD", New(-500, "USD")},
+		{" 7.50 ", "GBP", New(750, "GBP")},
+		{"19.990", "USD", New(1999, "USD")},
+		{"0", "USD", New(0, "USD")},
+		{"1500", "JPY", New(1500, "JPY")},
+		{"1500.00", "JPY", New(1500, "JPY")},
+		{"1.234", "KWD", New(1234, "KWD")},
+		{"1.2", "KWD", New(1200, "KWD")},
+		{"999999999999.99", "USD", New(99999999999999, "USD")},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.amount, tt.currency)
+		if err != nil {
+			t.Errorf("Parse(%q, %q): %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q, %q) = %#v, want %#v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+	}{
+		{"19.999", "USD"},
+		{"1.5", "JPY"},
+		{"1.2345", "KWD"},
+		{"", "USD"},
+		{".5", "USD"},
+		{"1.2.3", "USD"},
+		{"1e3", "USD"},
+		{"12a", "USD"},
+		{"--1", "USD"},
+		{"10", "XXX"},
+		{"10000000000000000", "USD"},
+	}
+	for _, tt := range tests {
+		if got, err := Parse(tt.amount, tt.currency); err == nil {
+			t.Errorf("Parse(%q, %q) = %v, want an error", tt.amount, tt.currency, got)
+		}
+	}
+}
+
+func TestExponent(t *testing.T) {
+	tests := map[string]int{"USD": 2, "eur": 2, "JPY": 0, "KRW": 0, "KWD": 3, "BHD": 3, "XXX": 2}
+	for currency, want := range tests {
+		if got := Exponent(currency); got != want {
+			t.Errorf("Exponent(%q) = %d, want %d", currency, got, want)
+		}
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := map[string]bool{"USD": true, "JPY": true, "eur": true, "KWD": false, "OMR": false, "XXX": false}
+	for currency, want := range tests {
+		if got := Storable(currency); got != want {
+			t.Errorf("Storable(%q) = %v, want %v", currency, got, want)
+		}
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     Money
+	}{
+		{19.99, "USD", New(1999, "USD")},
+		{0.285, "USD", New(29, "USD")},
+		{0.284, "USD", New(28, "USD")},
+		{1.005, "USD", New(101, "USD")},
+		{-0.285, "USD", New(-29, "USD")},
+		{1234.5, "JPY", New(1235, "JPY")},
+		{1234.4, "JPY", New(1234, "JPY")},
+		{1.2345, "KWD", New(1235, "KWD")},
+		{100, "EUR", New(10000, "EUR")},
+	}
+	for _, tt := range tests {
+		if got := FromFloat(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FromFloat(%v, %q) = %#v, want %#v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(1999, "USD"), "19.99"},
+		{New(5, "USD"), "0.05"},
+		{New(0, "USD"), "0.00"},
+		{New(-1999, "USD"), "-19.99"},
+		{New(-5, "USD"), "-0.05"},
+		{New(1500, "JPY"), "1500"},
+		{New(1234, "KWD"), "1.234"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%#v.Decimal() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a, b := New(1999, "USD"), New(1, "USD")
+	if got := a.Add(b); got != New(2000, "USD") {
+		t.Errorf("Add = %v", got)
+	}
+	if got := a.Sub(b); got != New(1998, "USD") {
+		t.Errorf("Sub = %v", got)
+	}
+	if got := a.Mul(3); got != New(5997, "USD") {
+		t.Errorf("Mul = %v", got)
+	}
+	if a.Cmp(b) != 1 || b.Cmp(a) != -1 || a.Cmp(a) != 0 {
+		t.Error("Cmp orders amounts wrongly")
+	}
+	// The zero Money takes the currency of the other
+	if got := (Money{}).Add(a); got != a {
+		t.Errorf("zero Add = %v", got)
+	}
+
+	// 0.1 + 0.2 is exactly 0.3, unlike with floats
+	sum := New(10, "USD").Add(New(20, "USD"))
+	if want, _ := Parse("0.30", "USD"); sum != want {
+		t.Errorf("0.10 + 0.20 = %v", sum)
+	}
+}
+
+func TestMixingCurrenciesPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding USD and EUR did not panic")
+		}
+	}()
+	New(1, "USD").Add(New(1, "EUR"))
+}
+
+func TestJSON(t *testing.T) {
+	data, err := json.Marshal(New(1999, "USD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":"19.99","currency":"USD"}` {
+		t.Errorf("Marshal = %s", data)
+	}
+
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{`{"amount":"19.99","currency":"USD"}`, New(1999, "USD")},
+		{`{"amount":19.99,"currency":"usd"}`, New(1999, "USD")},
+		{`{"amount":1500,"currency":"JPY"}`, New(1500, "JPY")},
+		{`null`, Money{}},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.in), &m); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.in, m, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		`{"amount":"19.999","currency":"USD"}`,
+		`{"amount":"19.99"}`,
+		`"19.99"`,
+		`{"amount":"abc","currency":"USD"}`,
+	} {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("Unmarshal(%s) = %v, want an error", in, m)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	v, err := New(1999, "USD").Value()
+	if err != nil || v != "19.99" {
+		t.Errorf("Value = %v, %v", v, err)
+	}
+	v, err = New(1500, "JPY").Value()
+	if err != nil || v != "1500" {
+		t.Errorf("Value = %v, %v", v, err)
+	}
+	if _, err := New(1234, "KWD").Value(); err == nil {
+		t.Error("a KWD amount was stored without an error")
+	}
+}
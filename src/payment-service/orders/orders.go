@@ -0,0 +1,177 @@
+package orders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"payment-service/auth"
+	"payment-service/db"
+	"payment-service/money"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Client calls cart-order-service. Requests are traced with otelhttp and are
+// sent with a service token, since they report on payments rather than act
+// for the caller.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient creates a cart-order-service client from CART_ORDER_SERVICE_URL
+func NewClient() *Client {
+	return &Client{
+		BaseURL: db.GetEnvOrDefault("CART_ORDER_SERVICE_URL", "http://localhost:8002"),
+		HTTPClient: &http.Client{
+			Transport: otelhttp.NewTransport(auth.NewServiceTransport("payment-service", http.DefaultTransport)),
+			Timeout:   10 * time.Second,
+		},
+	}
+}
+
+// Order statuses of cart-order-service that payments care about
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderCancelled = "cancelled"
+)
+
+// Order is the part of a cart-order-service order that payments need
+type Order struct {
+	ID     string      `json:"id"`
+	UserID string      `json:"userId"`
+	Total  money.Money `json:"total"`
+	Status string      `json:"status"`
+}
+
+// GetOrder looks up an order. It returns "order not found" for unknown IDs.
+func (c *Client) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/orders/"+url.PathEscape(orderID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("order not found")
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("cart-order-service order lookup returned %d", resp.StatusCode)
+	}
+
+	var order Order
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// MarkPaid moves an order to paid once its payment completed. Marking a paid
+// order paid again is not an error.
+func (c *Client) MarkPaid(ctx context.Context, orderID, paymentID string) error {
+	return c.setStatus(ctx, orderID, OrderPaid, "payment "+paymentID+" completed")
+}
+
+// MarkCancelled cancels a pending order whose payment was declined in fraud
+// review, which releases its stock
+func (c *Client) MarkCancelled(ctx context.Context, orderID, paymentID string) error {
+	return c.setStatus(ctx, orderID, OrderCancelled, "payment "+paymentID+" declined in review")
+}
+
+// ConfirmStock takes the stock reserved for an order for good. It returns
+// "stock no longer reserved" if the reservation lapsed or the order was
+// cancelled, so that its stock may have been sold to someone else.
+func (c *Client) ConfirmStock(ctx context.Context, orderID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/orders/"+url.PathEscape(orderID)+"/reservation/confirm", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("stock no longer reserved")
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("cart-order-service stock confirmation returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) setStatus(ctx context.Context, orderID, status, reason string) error {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(map[string]string{
+		"status": status,
+		"reason": reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.BaseURL+"/api/orders/"+url.PathEscape(orderID)+"/status", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cart-order-service order status update returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// RefundNotice tells cart-order-service how much of an order has been
+// refunded in total
+type RefundNotice struct {
+	PaymentID      string      `json:"paymentId"`
+	RefundID       string      `json:"refundId"`
+	RefundedAmount money.Money `json:"refundedAmount"`
+	FullyRefunded  bool        `json:"fullyRefunded"`
+	Reason         string      `json:"reason,omitempty"`
+}
+
+// NotifyRefund reports a completed refund of an order
+func (c *Client) NotifyRefund(ctx context.Context, orderID string, notice RefundNotice) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(notice); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/orders/"+orderID+"/refunds", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cart-order-service refund notification returned %d", resp.StatusCode)
+	}
+	return nil
+}
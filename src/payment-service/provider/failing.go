@@ -0,0 +1,39 @@
+package provider
+
+import "context"
+
+// Failing is a provider whose every call fails with Err, or ErrUnavailable
+// if Err is nil. It shows how payments and checkouts behave while the
+// payment provider is down.
+type Failing struct {
+	Err error
+}
+
+func (f Failing) Name() string { return "failing" }
+
+func (f Failing) Authorize(ctx context.Context, req AuthorizeRequest) (*Intent, error) {
+	return nil, f.err()
+}
+
+func (f Failing) Capture(ctx context.Context, intentID, idempotencyKey string) (*Intent, error) {
+	return nil, f.err()
+}
+
+func (f Failing) Void(ctx context.Context, intentID, reason, idempotencyKey string) (*Intent, error) {
+	return nil, f.err()
+}
+
+func (f Failing) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	return nil, f.err()
+}
+
+func (f Failing) Lookup(ctx context.Context, intentID string) (*Intent, error) {
+	return nil, f.err()
+}
+
+func (f Failing) err() error {
+	if f.Err == nil {
+		return ErrUnavailable
+	}
+	return f.Err
+}
@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"payment-service/db"
+	"payment-service/money"
+)
+
+// Fake is an in-process payment provider for local runs without Stripe or
+// stripe-mock. The outcome of a payment depends only on the card, using
+// Stripe's test card numbers, PaymentMethod IDs and tokens, so requests
+// written against Stripe test mode behave the same. Any other card number is
+// approved. Intents are kept in memory and are lost on restart.
+type Fake struct {
+	// Timeout is how long the timeout test card waits before failing
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	intents map[string]*fakeIntent
+	// Intents and refunds by the idempotency key that created them
+	intentKeys map[string]string
+	refundKeys map[string]*Refund
+}
+
+type fakeIntent struct {
+	Intent
+	amount   money.Money
+	refunded money.Money
+}
+
+// Outcomes of the fake provider's test cards
+const (
+	fakeApprove           = "approve"
+	fakeDecline           = "decline"
+	fakeInsufficientFunds = "insufficient_funds"
+	fakeFraud             = "fraud"
+	fakeTimeout           = "timeout"
+	fakeRequiresAction    = "requires_action"
+)
+
+type fakeCard struct {
+	lastFour string
+	outcome  string
+}
+
+// fakeCards are the deterministic test cards, by number, PaymentMethod ID
+// and token
+var fakeCards = map[string]fakeCard{}
+
+func init() {
+	for _, c := range []struct {
+		number, paymentMethod, token string
+		outcome                      string
+	}{
+		{"4242424242424242", "pm_card_visa", "tok_visa", fakeApprove},
+		{"5555555555554444", "pm_card_mastercard", "tok_mastercard", fakeApprove},
+		{"378282246310005", "pm_card_amex", "tok_amex", fakeApprove},
+		{"6011111111111117", "pm_card_discover", "tok_discover", fakeApprove},
+		{"4000056655665556", "pm_card_visa_debit", "tok_visa_debit", fakeApprove},
+		{"5200828282828210", "pm_card_mastercard_debit", "tok_mastercard_debit", fakeApprove},
+		{"4000000000000002", "pm_card_chargeDeclined", "tok_chargeDeclined", fakeDecline},
+		{"4000000000009995", "pm_card_chargeDeclinedInsufficientFunds", "tok_chargeDeclinedInsufficientFunds", fakeInsufficientFunds},
+		{"4100000000000019", "pm_card_radarBlock", "tok_radarBlock", fakeFraud},
+		{"4000002760003184", "pm_card_threeDSecure2Required", "tok_threeDSecure2Required", fakeRequiresAction},
+		// Stripe has no test card for a timeout
+		{"4000000000000119", "pm_card_timeout", "tok_timeout", fakeTimeout},
+	} {
+		card := fakeCard{lastFour: c.number[len(c.number)-4:], outcome: c.outcome}
+		fakeCards[c.number] = card
+		fakeCards[c.paymentMethod] = card
+		fakeCards[c.token] = card
+	}
+}
+
+// NewFake creates a fake provider
+func NewFake() *Fake {
+	return &Fake{
+		Timeout:    5 * time.Second,
+		intents:    make(map[string]*fakeIntent),
+		intentKeys: make(map[string]string),
+		refundKeys: make(map[string]*Refund),
+	}
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (*Intent, error) {
+	card, err := fakeCardFor(req.Card)
+	if err != nil {
+		return nil, err
+	}
+
+	switch card.outcome {
+	case fakeDecline:
+		return nil, &CardError{Code: "card_declined", DeclineCode: "generic_decline", Message: "Your card was declined."}
+	case fakeInsufficientFunds:
+		return nil, &CardError{Code: "card_declined", DeclineCode: "insufficient_funds", Message: "Your card has insufficient funds."}
+	case fakeFraud:
+		return nil, &CardError{Code: "card_declined", DeclineCode: "fraudulent", Message: "Your card was declined."}
+	case fakeTimeout:
+		select {
+		case <-time.After(f.Timeout):
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.intentKeys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		intent := f.intents[id].Intent
+		return &intent, nil
+	}
+
+	intent := &fakeIntent{
+		Intent: Intent{
+			ID:           fmt.Sprintf("pi_fake_%d", time.Now().UnixNano()),
+			CardLastFour: card.lastFour,
+		},
+		amount:   req.Amount,
+		refunded: money.Zero(req.Amount.Currency),
+	}
+	intent.ClientSecret = intent.ID + "_secret"
+	switch {
+	case card.outcome == fakeRequiresAction:
+		// The action is never completed, as there is no browser to do it
+		intent.Status, intent.ProviderStatus = db.PaymentRequiresAction, "requires_action"
+		intent.NextAction = map[string]string{"type": "use_stripe_sdk"}
+	case req.CaptureMethod == db.CaptureManual:
+		intent.Status, intent.ProviderStatus = db.PaymentAuthorized, "requires_capture"
+	default:
+		intent.Status, intent.ProviderStatus = db.PaymentCompleted, "succeeded"
+	}
+
+	f.intents[intent.ID] = intent
+	if req.IdempotencyKey != "" {
+		f.intentKeys[req.IdempotencyKey] = intent.ID
+	}
+
+	result := intent.Intent
+	return &result, nil
+}
+
+// fakeCardFor finds the test card of a request. PaymentMethod IDs and tokens
+// must be test cards; other card numbers are approved.
+func fakeCardFor(card Card) (fakeCard, error) {
+	key := card.PaymentMethodID
+	if key == "" {
+		key = card.Token
+	}
+	if key == "" {
+		if c, ok := fakeCards[card.Number]; ok {
+			return c, nil
+		}
+		if len(card.Number) < 4 {
+			return fakeCard{}, &CardError{Code: "incorrect_number", Message: "Your card number is incorrect."}
+		}
+		return fakeCard{lastFour: card.Number[len(card.Number)-4:], outcome: fakeApprove}, nil
+	}
+
+	c, ok := fakeCards[key]
+	if !ok {
+		return fakeCard{}, &CardError{Code: "resource_missing", Message: "No such test card: " + key}
+	}
+	return c, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, intentID, idempotencyKey string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch intent.Status {
+	case db.PaymentCompleted:
+	case db.PaymentAuthorized:
+		intent.Status, intent.ProviderStatus = db.PaymentCompleted, "succeeded"
+	default:
+		return nil, fmt.Errorf("intent %s cannot be captured in status %s", intentID, intent.ProviderStatus)
+	}
+
+	result := intent.Intent
+	return &result, nil
+}
+
+func (f *Fake) Void(ctx context.Context, intentID, reason, idempotencyKey string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch intent.Status {
+	case db.PaymentVoided:
+	case db.PaymentAuthorized:
+		intent.Status, intent.ProviderStatus = db.PaymentVoided, "canceled"
+	default:
+		return nil, fmt.Errorf("intent %s cannot be voided in status %s", intentID, intent.ProviderStatus)
+	}
+
+	result := intent.Intent
+	return &result, nil
+}
+
+func (f *Fake) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if refund, ok := f.refundKeys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		result := *refund
+		return &result, nil
+	}
+
+	intent, err := f.intent(req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != db.PaymentCompleted {
+		return nil, fmt.Errorf("intent %s cannot be refunded in status %s", req.TransactionID, intent.ProviderStatus)
+	}
+	left := intent.amount.Sub(intent.refunded)
+	if req.Amount.Currency != left.Currency || req.Amount.Cmp(left) > 0 {
+		return nil, fmt.Errorf("refund of %s exceeds the %s left on intent %s", req.Amount, left, req.TransactionID)
+	}
+	intent.refunded = intent.refunded.Add(req.Amount)
+
+	refund := &Refund{ID: fmt.Sprintf("re_fake_%d", time.Now().UnixNano()), Status: "succeeded"}
+	if req.IdempotencyKey != "" {
+		f.refundKeys[req.IdempotencyKey] = refund
+	}
+
+	result := *refund
+	return &result, nil
+}
+
+func (f *Fake) Lookup(ctx context.Context, intentID string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, err := f.intent(intentID)
+	if err != nil {
+		return nil, err
+	}
+	result := intent.Intent
+	return &result, nil
+}
+
+// intent finds an intent; f.mu must be held
+func (f *Fake) intent(intentID string) (*fakeIntent, error) {
+	intent, ok := f.intents[intentID]
+	if !ok {
+		return nil, fmt.Errorf("no such intent: %s", intentID)
+	}
+	return intent, nil
+}
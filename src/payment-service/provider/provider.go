@@ -0,0 +1,103 @@
+// Package provider abstracts the payment provider that moves the money.
+// Stripe is the real one; Fake approves or declines deterministic test cards
+// in process, and Failing fails every call, so payment-service can run
+// without Stripe or stripe-mock.
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"payment-service/money"
+)
+
+// PaymentProvider authorizes, captures, voids, refunds and looks up payments
+// at a payment provider. Intents are identified by the provider's ID, which
+// payment-service stores as the payment's transaction ID.
+type PaymentProvider interface {
+	// Name identifies the provider in logs and spans
+	Name() string
+	// Authorize charges a card. With CaptureManual the card is only
+	// authorized until the intent is captured or voided.
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Intent, error)
+	Capture(ctx context.Context, intentID, idempotencyKey string) (*Intent, error)
+	// Void releases an authorization that was not captured
+	Void(ctx context.Context, intentID, reason, idempotencyKey string) (*Intent, error)
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	Lookup(ctx context.Context, intentID string) (*Intent, error)
+}
+
+// Card identifies the card to charge: a PaymentMethod ID or card token
+// created in the browser, or raw card details in test mode
+type Card struct {
+	PaymentMethodID string
+	Token           string
+	Number          string
+	ExpMonth        string
+	ExpYear         string
+	CVC             string
+}
+
+type AuthorizeRequest struct {
+	OrderID       string
+	Amount        money.Money
+	Card          Card
+	CaptureMethod string
+	ReturnURL     string
+	// A retried request with the same key authorizes only once
+	IdempotencyKey string
+}
+
+// Intent is the provider's view of a payment
+type Intent struct {
+	ID string
+	// Status is the payment status the intent amounts to, one of the
+	// db.Payment* statuses
+	Status string
+	// ProviderStatus is the provider's own status of the intent
+	ProviderStatus string
+	CardLastFour   string
+	// ClientSecret and NextAction let the browser complete an intent that
+	// requires action, e.g. 3-D Secure
+	ClientSecret string
+	NextAction   interface{}
+	// DeclineMessage explains why a failed intent was declined
+	DeclineMessage string
+}
+
+type RefundRequest struct {
+	TransactionID  string
+	Amount         money.Money
+	PaymentID      string
+	RefundID       string
+	IdempotencyKey string
+}
+
+type Refund struct {
+	ID     string
+	Status string
+}
+
+// CardError is a card the provider refused, e.g. because it was declined.
+// It is the customer's to fix, unlike any other error of a provider.
+type CardError struct {
+	Code        string
+	DeclineCode string
+	Message     string
+}
+
+func (e *CardError) Error() string {
+	if e.DeclineCode != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.DeclineCode)
+	}
+	return e.Message
+}
+
+var (
+	// ErrTimeout means the provider did not answer in time, so the outcome of
+	// the call is unknown
+	ErrTimeout = errors.New("payment provider timed out")
+	// ErrUnavailable means the provider could not be reached
+	ErrUnavailable = errors.New("payment provider unavailable")
+)
@@ -0,0 +1,221 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"payment-service/db"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Stripe makes payments as Stripe PaymentIntents
+type Stripe struct {
+	api *client.API
+}
+
+// NewStripe creates a Stripe provider for the API at url, which is
+// stripe-mock outside of production. Calls to Stripe are traced.
+func NewStripe(key, url string) *Stripe {
+	api := &client.API{}
+	api.Init(key, &stripe.Backends{
+		API: stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+			URL: stripe.String(url),
+			HTTPClient: &http.Client{
+				Transport: otelhttp.NewTransport(http.DefaultTransport),
+				Timeout:   80 * time.Second,
+			},
+		}),
+	})
+	return &Stripe{api: api}
+}
+
+func (s *Stripe) Name() string { return "stripe" }
+
+func (s *Stripe) Authorize(ctx context.Context, req AuthorizeRequest) (*Intent, error) {
+	paymentMethod, err := s.paymentMethod(ctx, req.Card)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(req.Amount.Amount),
+		Currency:           stripe.String(strings.ToLower(req.Amount.Currency)),
+		PaymentMethod:      stripe.String(paymentMethod.ID),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		CaptureMethod:      stripe.String(req.CaptureMethod),
+		Confirm:            stripe.Bool(true),
+	}
+	if req.ReturnURL != "" {
+		params.ReturnURL = stripe.String(req.ReturnURL)
+	}
+	params.AddMetadata("order_id", req.OrderID)
+	// Stripe deduplicates retried intents with the same key as ours
+	if req.IdempotencyKey != "" {
+		params.SetIdempotencyKey(req.IdempotencyKey)
+	}
+	params.Context = ctx
+
+	intent, err := s.api.PaymentIntents.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+
+	result := intentFrom(intent)
+	if paymentMethod.Card != nil {
+		result.CardLastFour = paymentMethod.Card.Last4
+	}
+	return result, nil
+}
+
+// paymentMethod resolves a card to a Stripe PaymentMethod
+func (s *Stripe) paymentMethod(ctx context.Context, card Card) (*stripe.PaymentMethod, error) {
+	if card.PaymentMethodID != "" {
+		params := &stripe.PaymentMethodParams{}
+		params.Context = ctx
+		paymentMethod, err := s.api.PaymentMethods.Get(card.PaymentMethodID, params)
+		return paymentMethod, stripeError(err)
+	}
+
+	params := &stripe.PaymentMethodParams{
+		Type: stripe.String(string(stripe.PaymentMethodTypeCard)),
+	}
+	if card.Token != "" {
+		params.Card = &stripe.PaymentMethodCardParams{
+			Token: stripe.String(card.Token),
+		}
+	} else {
+		params.Card = &stripe.PaymentMethodCardParams{
+			Number:   stripe.String(card.Number),
+			ExpMonth: stripe.String(card.ExpMonth),
+			ExpYear:  stripe.String(card.ExpYear),
+			CVC:      stripe.String(card.CVC),
+		}
+	}
+	params.Context = ctx
+
+	paymentMethod, err := s.api.PaymentMethods.New(params)
+	return paymentMethod, stripeError(err)
+}
+
+func (s *Stripe) Capture(ctx context.Context, intentID, idempotencyKey string) (*Intent, error) {
+	params := &stripe.PaymentIntentCaptureParams{}
+	params.SetIdempotencyKey(idempotencyKey)
+	params.Context = ctx
+
+	intent, err := s.api.PaymentIntents.Capture(intentID, params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return intentFrom(intent), nil
+}
+
+func (s *Stripe) Void(ctx context.Context, intentID, reason, idempotencyKey string) (*Intent, error) {
+	params := &stripe.PaymentIntentCancelParams{}
+	if reason != "" {
+		params.CancellationReason = stripe.String(reason)
+	}
+	params.SetIdempotencyKey(idempotencyKey)
+	params.Context = ctx
+
+	intent, err := s.api.PaymentIntents.Cancel(intentID, params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return intentFrom(intent), nil
+}
+
+func (s *Stripe) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	params := &stripe.RefundParams{
+		Amount: stripe.Int64(req.Amount.Amount),
+	}
+	// Payments made before PaymentIntents store the charge ID instead
+	if strings.HasPrefix(req.TransactionID, "pi_") {
+		params.PaymentIntent = stripe.String(req.TransactionID)
+	} else {
+		params.Charge = stripe.String(req.TransactionID)
+	}
+	params.AddMetadata("payment_id", req.PaymentID)
+	params.AddMetadata("refund_id", req.RefundID)
+	// A retried refund must not be issued twice at Stripe
+	params.SetIdempotencyKey(req.IdempotencyKey)
+	params.Context = ctx
+
+	refund, err := s.api.Refunds.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return &Refund{ID: refund.ID, Status: string(refund.Status)}, nil
+}
+
+func (s *Stripe) Lookup(ctx context.Context, intentID string) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+
+	intent, err := s.api.PaymentIntents.Get(intentID, params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return intentFrom(intent), nil
+}
+
+func intentFrom(intent *stripe.PaymentIntent) *Intent {
+	result := &Intent{
+		ID:             intent.ID,
+		Status:         StripeStatus(intent),
+		ProviderStatus: string(intent.Status),
+		ClientSecret:   intent.ClientSecret,
+	}
+	if intent.NextAction != nil {
+		result.NextAction = intent.NextAction
+	}
+	if intent.LastPaymentError != nil {
+		result.DeclineMessage = intent.LastPaymentError.Msg
+	}
+	return result
+}
+
+// StripeStatus maps the status of a PaymentIntent to a payment status
+func StripeStatus(intent *stripe.PaymentIntent) string {
+	switch intent.Status {
+	case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresConfirmation:
+		return db.PaymentRequiresAction
+	case stripe.PaymentIntentStatusRequiresCapture:
+		return db.PaymentAuthorized
+	case stripe.PaymentIntentStatusSucceeded:
+		return db.PaymentCompleted
+	case stripe.PaymentIntentStatusCanceled:
+		return db.PaymentVoided
+	case stripe.PaymentIntentStatusRequiresPaymentMethod:
+		// Confirming with the card failed, e.g. because it was declined
+		return db.PaymentFailed
+	default:
+		return db.PaymentProcessing
+	}
+}
+
+// stripeError turns Stripe's card errors into a CardError and timeouts into
+// ErrTimeout
+func stripeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Type == stripe.ErrorTypeCard {
+		return &CardError{
+			Code:        string(stripeErr.Code),
+			DeclineCode: string(stripeErr.DeclineCode),
+			Message:     stripeErr.Msg,
+		}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrTimeout
+	}
+	return err
+}
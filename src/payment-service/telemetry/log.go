@@ -0,0 +1,137 @@
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/log/global"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InitLogger makes slog's default logger write JSON to stderr and export
+// every record over OTLP, configured like traces (see otlp.go). Records at
+// LOG_LEVEL (debug, info, warn or error, info by default) and above are
+// logged; those written with a context of a span carry its trace_id and
+// span_id. The standard logger goes through it as well, at info level.
+// Returns a shutdown function that flushes pending records.
+func InitLogger(ctx context.Context) func(context.Context) error {
+	level, err := logLevel()
+	stderr := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(&logHandler{level: level, stderr: stderr}))
+	if err != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info", "error", err)
+	}
+
+	exporter, err := newLogExporter(ctx)
+	if err != nil {
+		slog.Error("Failed to create OTLP log exporter", "error", err)
+		return func(context.Context) error { return nil }
+	}
+
+	res, err := newResource()
+	if err != nil {
+		slog.Error("Failed to create resource", "error", err)
+		return func(context.Context) error { return nil }
+	}
+
+	lp := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+		sdklog.WithResource(res),
+	)
+	global.SetLoggerProvider(lp)
+
+	slog.SetDefault(slog.New(&logHandler{
+		level:  level,
+		stderr: stderr,
+		otlp:   otelslog.NewHandler(serviceName(), otelslog.WithLoggerProvider(lp)),
+	}))
+
+	return lp.Shutdown
+}
+
+func newLogExporter(ctx context.Context) (sdklog.Exporter, error) {
+	protocol := otlpProtocol("logs")
+	endpoint := defaultEndpoint("logs", protocol)
+	if protocol == protocolGRPC {
+		var opts []otlploggrpc.Option
+		if endpoint != "" {
+			opts = append(opts, otlploggrpc.WithEndpointURL(endpoint))
+		}
+		return otlploggrpc.New(ctx, opts...)
+	}
+	var opts []otlploghttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlploghttp.WithEndpointURL(endpoint))
+	}
+	return otlploghttp.New(ctx, opts...)
+}
+
+// logLevel is the level of LOG_LEVEL, or info if it is unset or invalid
+func logLevel() (slog.Level, error) {
+	value := strings.TrimSpace(os.Getenv("LOG_LEVEL"))
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo, err
+	}
+	return level, nil
+}
+
+// logHandler scrubs card numbers from records and hands them to both the
+// stderr and the OTLP handler. The OTLP handler takes the span from the
+// context itself, so the trace and span IDs are only added for stderr.
+type logHandler struct {
+	level  slog.Leveler
+	stderr slog.Handler
+	otlp   slog.Handler
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	r = redactRecord(r)
+
+	if h.otlp != nil {
+		// Export errors are reported by the SDK, the line is written to
+		// stderr regardless
+		_ = h.otlp.Handle(ctx, r.Clone())
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.stderr.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(redacted) })
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *logHandler) with(f func(slog.Handler) slog.Handler) *logHandler {
+	out := &logHandler{level: h.level, stderr: f(h.stderr)}
+	if h.otlp != nil {
+		out.otlp = f(h.otlp)
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package telemetry
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// The OTLP exporters read the standard environment variables themselves:
+// OTEL_EXPORTER_OTLP_ENDPOINT, with its scheme, and the HEADERS,
+// CERTIFICATE, CLIENT_CERTIFICATE, CLIENT_KEY, COMPRESSION and TIMEOUT
+// variables, each also per signal, e.g. OTEL_EXPORTER_OTLP_TRACES_HEADERS.
+// Only the protocol is chosen here, and the in-cluster collector is used
+// when no endpoint is set.
+
+// OTLP protocols, see OTEL_EXPORTER_OTLP_PROTOCOL
+const (
+	protocolGRPC = "grpc"
+	protocolHTTP = "http/protobuf"
+)
+
+// collectorHost is the collector the services export to without an
+// endpoint in the environment
+const collectorHost = "otel-collector-collector.observability"
+
+// otlpProtocol is the protocol signal ("traces", "metrics" or "logs") is
+// exported with, http/protobuf unless OTEL_EXPORTER_OTLP_<SIGNAL>_PROTOCOL
+// or OTEL_EXPORTER_OTLP_PROTOCOL says grpc
+func otlpProtocol(signal string) string {
+	protocol := signalEnv(signal, "PROTOCOL")
+	switch protocol {
+	case "", protocolHTTP:
+		return protocolHTTP
+	case protocolGRPC:
+		return protocolGRPC
+	}
+	slog.Warn("Unsupported OTLP protocol, using http/protobuf", "signal", signal, "protocol", protocol)
+	return protocolHTTP
+}
+
+// defaultEndpoint is the URL of the in-cluster collector for signal, or ""
+// if an endpoint is set in the environment. The HTTP exporters take the
+// URL as is, so it includes the signal's path.
+func defaultEndpoint(signal, protocol string) string {
+	if signalEnv(signal, "ENDPOINT") != "" {
+		return ""
+	}
+	if protocol == protocolGRPC {
+		return "http://" + collectorHost + ":4317"
+	}
+	return "http://" + collectorHost + ":4318/v1/" + signal
+}
+
+// otlpEndpoint is the endpoint signal is exported to, for the log
+func otlpEndpoint(signal, protocol string) string {
+	if endpoint := defaultEndpoint(signal, protocol); endpoint != "" {
+		return endpoint
+	}
+	return signalEnv(signal, "ENDPOINT")
+}
+
+// signalEnv returns OTEL_EXPORTER_OTLP_<SIGNAL>_<name>, or
+// OTEL_EXPORTER_OTLP_<name> if that is not set
+func signalEnv(signal, name string) string {
+	if value := strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_" + strings.ToUpper(signal) + "_" + name)); value != "" {
+		return value
+	}
+	return strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_" + name))
+}
@@ -0,0 +1,202 @@
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Card numbers must never leave a service, not even by accident through an
+// error message recorded on a span or written to the log. Every exported
+// span and log line is scrubbed of anything that looks like a valid card
+// number.
+
+// Redacted replaces a card number
+const Redacted = "[REDACTED]"
+
+// panCandidate matches 13 to 19 digits, optionally grouped by spaces or
+// dashes the way card numbers are usually written
+var panCandidate = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+// RedactPAN replaces every Luhn-valid card number in s
+func RedactPAN(s string) string {
+	if len(s) < 13 {
+		return s
+	}
+	return panCandidate.ReplaceAllStringFunc(s, func(match string) string {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+		if luhnValid(digits) {
+			return Redacted
+		}
+		return match
+	})
+}
+
+// luhnValid reports whether a string of digits passes the Luhn check
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// redactRecord scrubs the message and attributes of a log record
+func redactRecord(r slog.Record) slog.Record {
+	out := slog.NewRecord(r.Time, r.Level, RedactPAN(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return out
+}
+
+// redactAttr scrubs string values, and replaces numbers, errors and other
+// values whose text is a card number
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(RedactPAN(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case slog.KindInt64, slog.KindUint64, slog.KindAny:
+		text := a.Value.String()
+		if redacted := RedactPAN(text); redacted != text {
+			a.Value = slog.StringValue(redacted)
+		}
+	}
+	return a
+}
+
+// redactingExporter scrubs card numbers from the name, attributes, events
+// and status of spans before handing them to the wrapped exporter
+type redactingExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (e redactingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	redacted := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, span := range spans {
+		redacted[i] = redactSpan(span)
+	}
+	return e.SpanExporter.ExportSpans(ctx, redacted)
+}
+
+// redactedSpan overrides the parts of a span that can carry free text
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	name       string
+	attributes []attribute.KeyValue
+	events     []sdktrace.Event
+	status     sdktrace.Status
+}
+
+func (s redactedSpan) Name() string                     { return s.name }
+func (s redactedSpan) Attributes() []attribute.KeyValue { return s.attributes }
+func (s redactedSpan) Events() []sdktrace.Event         { return s.events }
+func (s redactedSpan) Status() sdktrace.Status          { return s.status }
+
+// redactSpan returns span itself unless it contains a card number
+func redactSpan(span sdktrace.ReadOnlySpan) sdktrace.ReadOnlySpan {
+	changed := false
+
+	name := RedactPAN(span.Name())
+	changed = changed || name != span.Name()
+
+	attributes, c := redactAttributes(span.Attributes())
+	changed = changed || c
+
+	events := span.Events()
+	var redactedEvents []sdktrace.Event
+	for i, event := range events {
+		eventAttributes, c := redactAttributes(event.Attributes)
+		eventName := RedactPAN(event.Name)
+		if !c && eventName == event.Name {
+			continue
+		}
+		if redactedEvents == nil {
+			redactedEvents = append([]sdktrace.Event(nil), events...)
+		}
+		redactedEvents[i].Name = eventName
+		redactedEvents[i].Attributes = eventAttributes
+	}
+	if redactedEvents != nil {
+		events, changed = redactedEvents, true
+	}
+
+	status := span.Status()
+	if description := RedactPAN(status.Description); description != status.Description {
+		status.Description, changed = description, true
+	}
+
+	if !changed {
+		return span
+	}
+	return redactedSpan{
+		ReadOnlySpan: span,
+		name:         name,
+		attributes:   attributes,
+		events:       events,
+		status:       status,
+	}
+}
+
+// redactAttributes scrubs string and string slice values. The input is
+// returned, and false, if there was nothing to scrub.
+func redactAttributes(attributes []attribute.KeyValue) ([]attribute.KeyValue, bool) {
+	var out []attribute.KeyValue
+	for i, kv := range attributes {
+		value, changed := redactValue(kv.Value)
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = append([]attribute.KeyValue(nil), attributes...)
+		}
+		out[i] = attribute.KeyValue{Key: kv.Key, Value: value}
+	}
+	if out == nil {
+		return attributes, false
+	}
+	return out, true
+}
+
+func redactValue(v attribute.Value) (attribute.Value, bool) {
+	switch v.Type() {
+	case attribute.STRING:
+		if s := RedactPAN(v.AsString()); s != v.AsString() {
+			return attribute.StringValue(s), true
+		}
+	case attribute.STRINGSLICE:
+		values := v.AsStringSlice()
+		changed := false
+		for i, s := range values {
+			if r := RedactPAN(s); r != s {
+				values[i], changed = r, true
+			}
+		}
+		if changed {
+			return attribute.StringSliceValue(values), true
+		}
+	}
+	return v, false
+}
@@ -0,0 +1,359 @@
+package telemetry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Every statement run through a DB gets a client span carrying the
+// statement, without its arguments, and the number of rows it returned or
+// affected. Statements of a transaction are children of a span that lasts
+// from BeginTx until Commit or Rollback. The connection pool is reported
+// as metrics following the OpenTelemetry semantic conventions.
+
+var (
+	rowsReturnedKey = attribute.Key("db.rows_returned")
+	rowsAffectedKey = attribute.Key("db.rows_affected")
+	txOutcomeKey    = attribute.Key("db.transaction.outcome")
+)
+
+// DB is a *sql.DB that traces what it runs. Only the context variants of
+// the *sql.DB methods are offered, so that spans have a parent.
+type DB struct {
+	db     *sql.DB
+	tracer trace.Tracer
+	attrs  []attribute.KeyValue
+}
+
+// OpenDB opens a database like sql.Open and registers the metrics of its
+// connection pool. name is the database name reported with spans and
+// metrics.
+func OpenDB(driverName, dataSourceName, name string) (*DB, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerPoolMetrics(db, name); err != nil {
+		slog.Error("Failed to register database pool metrics", "error", err)
+	}
+	return &DB{
+		db:     db,
+		tracer: otel.Tracer("telemetry/sql"),
+		attrs:  []attribute.KeyValue{dbSystem(driverName), semconv.DBName(name)},
+	}, nil
+}
+
+func dbSystem(driverName string) attribute.KeyValue {
+	switch driverName {
+	case "postgres", "pgx":
+		return semconv.DBSystemPostgreSQL
+	}
+	return semconv.DBSystemOtherSQL
+}
+
+// PingContext verifies the connection to the database is alive
+func (db *DB) PingContext(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+// Close closes the database
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// QueryContext runs a query that returns rows. The span ends when the rows
+// are closed or fully read.
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	return db.query(ctx, nil, query, args)
+}
+
+// QueryRowContext runs a query that returns at most one row. The span ends
+// when the row is scanned.
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	return db.queryRow(ctx, nil, query, args)
+}
+
+// ExecContext runs a statement that returns no rows
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.exec(ctx, nil, query, args)
+}
+
+// BeginTx starts a transaction and its span
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	ctx, span := db.tracer.Start(ctx, "transaction",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(db.attrs...),
+	)
+	tx, err := db.db.BeginTx(ctx, opts)
+	if err != nil {
+		fail(span, err)
+		span.End()
+		return nil, err
+	}
+	return &Tx{tx: tx, db: db, span: span}, nil
+}
+
+// Tx is a *sql.Tx whose statements are traced as children of the
+// transaction's span
+type Tx struct {
+	tx   *sql.Tx
+	db   *DB
+	span trace.Span
+	done bool
+}
+
+// QueryContext runs a query that returns rows within the transaction
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	return tx.db.query(trace.ContextWithSpan(ctx, tx.span), tx.tx, query, args)
+}
+
+// QueryRowContext runs a query that returns at most one row within the
+// transaction
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	return tx.db.queryRow(trace.ContextWithSpan(ctx, tx.span), tx.tx, query, args)
+}
+
+// ExecContext runs a statement that returns no rows within the transaction
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.db.exec(trace.ContextWithSpan(ctx, tx.span), tx.tx, query, args)
+}
+
+// Commit commits the transaction and ends its span
+func (tx *Tx) Commit() error {
+	err := tx.tx.Commit()
+	tx.end("commit", err)
+	return err
+}
+
+// Rollback aborts the transaction and ends its span. Rolling back a
+// transaction that is already committed, as a deferred Rollback does, is
+// not recorded.
+func (tx *Tx) Rollback() error {
+	err := tx.tx.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		tx.end("rollback", err)
+	}
+	return err
+}
+
+func (tx *Tx) end(outcome string, err error) {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.span.SetAttributes(txOutcomeKey.String(outcome))
+	if err != nil {
+		fail(tx.span, err)
+	}
+	tx.span.End()
+}
+
+// Rows is a *sql.Rows that counts the rows read and ends the query's span
+// once they are closed or exhausted
+type Rows struct {
+	*sql.Rows
+	span  trace.Span
+	count int
+}
+
+// Next prepares the next row for Scan
+func (r *Rows) Next() bool {
+	if r.Rows.Next() {
+		r.count++
+		return true
+	}
+	r.end()
+	return false
+}
+
+// Close closes the rows
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	r.end()
+	return err
+}
+
+func (r *Rows) end() {
+	if r.span == nil {
+		return
+	}
+	if err := r.Rows.Err(); err != nil {
+		fail(r.span, err)
+	}
+	r.span.SetAttributes(rowsReturnedKey.Int(r.count))
+	r.span.End()
+	r.span = nil
+}
+
+// Row is a *sql.Row whose query's span ends when it is scanned
+type Row struct {
+	row  *sql.Row
+	span trace.Span
+}
+
+// Scan copies the columns of the row into dest. sql.ErrNoRows is counted
+// as no rows rather than recorded as an error.
+func (r *Row) Scan(dest ...any) error {
+	err := r.row.Scan(dest...)
+	if r.span != nil {
+		switch {
+		case err == nil:
+			r.span.SetAttributes(rowsReturnedKey.Int(1))
+		case errors.Is(err, sql.ErrNoRows):
+			r.span.SetAttributes(rowsReturnedKey.Int(0))
+		default:
+			fail(r.span, err)
+		}
+		r.span.End()
+		r.span = nil
+	}
+	return err
+}
+
+// Err returns the error, if any, of running the query
+func (r *Row) Err() error {
+	return r.row.Err()
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// on is the querier of a statement: the transaction if there is one,
+// otherwise the database
+func (db *DB) on(tx *sql.Tx) querier {
+	if tx != nil {
+		return tx
+	}
+	return db.db
+}
+
+func (db *DB) query(ctx context.Context, tx *sql.Tx, query string, args []any) (*Rows, error) {
+	ctx, span := db.start(ctx, query)
+	rows, err := db.on(tx).QueryContext(ctx, query, args...)
+	if err != nil {
+		fail(span, err)
+		span.End()
+		return nil, err
+	}
+	return &Rows{Rows: rows, span: span}, nil
+}
+
+func (db *DB) queryRow(ctx context.Context, tx *sql.Tx, query string, args []any) *Row {
+	ctx, span := db.start(ctx, query)
+	return &Row{row: db.on(tx).QueryRowContext(ctx, query, args...), span: span}
+}
+
+func (db *DB) exec(ctx context.Context, tx *sql.Tx, query string, args []any) (sql.Result, error) {
+	ctx, span := db.start(ctx, query)
+	defer span.End()
+
+	res, err := db.on(tx).ExecContext(ctx, query, args...)
+	if err != nil {
+		fail(span, err)
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		span.SetAttributes(rowsAffectedKey.Int64(n))
+	}
+	return res, nil
+}
+
+// start starts the span of a statement, named after its operation and
+// table, e.g. "SELECT carts"
+func (db *DB) start(ctx context.Context, query string) (context.Context, trace.Span) {
+	statement := strings.Join(strings.Fields(query), " ")
+	operation, table := parseStatement(statement)
+
+	attrs := append(append([]attribute.KeyValue(nil), db.attrs...),
+		semconv.DBStatement(statement),
+		semconv.DBOperation(operation),
+	)
+	name := operation
+	if table != "" {
+		attrs = append(attrs, semconv.DBSQLTable(table))
+		name += " " + table
+	}
+	return db.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// tableRef matches the table a statement reads from or writes to
+var tableRef = regexp.MustCompile(`(?i)\b(?:from|into|update|join)\s+([a-z_][a-z0-9_.]*)(\()?`)
+
+// parseStatement returns the operation of a statement, its first keyword,
+// and the first table it names. Function calls such as FROM now() are not
+// tables.
+func parseStatement(statement string) (operation, table string) {
+	operation, _, _ = strings.Cut(statement, " ")
+	operation = strings.ToUpper(operation)
+	for _, m := range tableRef.FindAllStringSubmatch(statement, -1) {
+		if m[2] == "" {
+			return operation, m[1]
+		}
+	}
+	return operation, ""
+}
+
+func fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// registerPoolMetrics reports the connections of db's pool, and how often
+// and how long callers waited for one
+func registerPoolMetrics(db *sql.DB, name string) error {
+	meter := otel.Meter("telemetry/sql")
+	pool := attribute.String("db.client.connection.pool.name", name)
+	idle := metric.WithAttributes(pool, attribute.String("db.client.connection.state", "idle"))
+	used := metric.WithAttributes(pool, attribute.String("db.client.connection.state", "used"))
+	poolOnly := metric.WithAttributes(pool)
+
+	count, err := meter.Int64ObservableUpDownCounter("db.client.connection.count",
+		metric.WithUnit("{connection}"), metric.WithDescription("Open connections, by whether they are idle or in use"))
+	if err != nil {
+		return err
+	}
+	maxConns, err := meter.Int64ObservableUpDownCounter("db.client.connection.max",
+		metric.WithUnit("{connection}"), metric.WithDescription("Maximum number of open connections allowed, 0 for unlimited"))
+	if err != nil {
+		return err
+	}
+	waits, err := meter.Int64ObservableCounter("db.client.connection.waits",
+		metric.WithUnit("{wait}"), metric.WithDescription("Times a connection was waited for because none was idle"))
+	if err != nil {
+		return err
+	}
+	waitTime, err := meter.Float64ObservableCounter("db.client.connection.wait_time",
+		metric.WithUnit("s"), metric.WithDescription("Total time spent waiting for a connection"))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		stats := db.Stats()
+		o.ObserveInt64(count, int64(stats.Idle), idle)
+		o.ObserveInt64(count, int64(stats.InUse), used)
+		o.ObserveInt64(maxConns, int64(stats.MaxOpenConnections), poolOnly)
+		o.ObserveInt64(waits, stats.WaitCount, poolOnly)
+		o.ObserveFloat64(waitTime, stats.WaitDuration.Seconds(), poolOnly)
+		return nil
+	}, count, maxConns, waits, waitTime)
+	return err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"payment-service/db"
+	"payment-service/money"
+	"payment-service/provider"
+
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Stripe reports asynchronous outcomes (3-D Secure completed in the browser,
+// late failures, refunds made in the dashboard, disputes) as signed events.
+// Every verified event is stored before it is applied, so redeliveries are
+// skipped and an admin can replay an event after fixing whatever made it
+// fail.
+
+// webhookSecret is the signing secret of the webhook endpoint in Stripe,
+// from STRIPE_WEBHOOK_SECRET
+var webhookSecret string
+
+// maxWebhookBody is the largest event payload accepted
+const maxWebhookBody = 65536
+
+// webhookTransitions lists, for each status an event can move a payment to,
+// the statuses it may move from. Events that arrive out of order therefore
+// never undo a later change.
+var webhookTransitions = map[string][]string{
+	db.PaymentRequiresAction: {db.PaymentProcessing},
+	db.PaymentProcessing:     {db.PaymentRequiresAction},
+	db.PaymentAuthorized:     {db.PaymentRequiresAction, db.PaymentProcessing},
+	db.PaymentCompleted:      {db.PaymentRequiresAction, db.PaymentProcessing, db.PaymentAuthorized, db.PaymentDisputed},
+	db.PaymentFailed:         {db.PaymentRequiresAction, db.PaymentProcessing},
+	db.PaymentVoided:         {db.PaymentRequiresAction, db.PaymentProcessing, db.PaymentAuthorized, db.PaymentFailed},
+	db.PaymentDisputed:       {db.PaymentCompleted, db.PaymentPartiallyRefunded, db.PaymentRefunded},
+	db.PaymentChargedBack:    {db.PaymentDisputed},
+}
+
+// intentEvents are the PaymentIntent events that report a new status.
+// payment_intent.created is not among them: it precedes the confirmation
+// whose outcome the payment was created with.
+var intentEvents = map[string]bool{
+	"payment_intent.requires_action":           true,
+	"payment_intent.processing":                true,
+	"payment_intent.amount_capturable_updated": true,
+	"payment_intent.succeeded":                 true,
+	"payment_intent.payment_failed":            true,
+	"payment_intent.canceled":                  true,
+}
+
+func handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	span := trace.SpanFromContext(r.Context())
+
+	if webhookSecret == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Stripe webhooks are not configured"})
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil || len(payload) > maxWebhookBody {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), webhookSecret)
+	if err != nil {
+		span.AddEvent("stripe.webhook.rejected", trace.WithAttributes(attribute.String("error", err.Error())))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid Stripe signature"})
+		return
+	}
+	span.SetAttributes(
+		attribute.String("stripe.event.id", event.ID),
+		attribute.String("stripe.event.type", event.Type),
+	)
+
+	stored, duplicate, err := db.RecordStripeEvent(r.Context(), event.ID, event.Type, payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if duplicate && (stored.Status == db.EventProcessed || stored.Status == db.EventIgnored) {
+		span.AddEvent("stripe.webhook.duplicate")
+		json.NewEncoder(w).Encode(map[string]interface{}{"received": true, "duplicate": true})
+		return
+	}
+
+	stored, err = processStripeEvent(r.Context(), event)
+	if err != nil {
+		// Stripe redelivers events that were not answered with 2xx
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"received": true, "status": stored.Status})
+}
+
+func getStripeEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+
+	events, err := db.GetStripeEvents(r.Context(), r.URL.Query().Get("status"), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(events)
+}
+
+// replayStripeEvent applies a stored event again, whatever its status. The
+// payload was verified when it was received.
+func replayStripeEvent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	eventID := mux.Vars(r)["eventId"]
+
+	stored, err := db.GetStripeEvent(r.Context(), eventID)
+	if err != nil {
+		if err.Error() == "event not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Event not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(stored.Payload, &event); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Stored event cannot be decoded: " + err.Error()})
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).AddEvent("stripe.webhook.replayed", trace.WithAttributes(
+		attribute.String("stripe.event.id", event.ID),
+		attribute.String("stripe.event.type", event.Type),
+	))
+
+	// A failed replay is reported in the returned event
+	replayed, err := processStripeEvent(r.Context(), event)
+	if replayed == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(replayed)
+}
+
+// processStripeEvent applies an event and stores the outcome. The event is
+// returned even if applying it failed, unless the outcome could not be
+// stored.
+func processStripeEvent(ctx context.Context, event stripe.Event) (*db.StripeEvent, error) {
+	status, detail, err := applyStripeEvent(ctx, event)
+	if err != nil {
+		status, detail = db.EventFailed, err.Error()
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("stripe.webhook."+status, trace.WithAttributes(
+		attribute.String("stripe.event.id", event.ID),
+		attribute.String("stripe.event.type", event.Type),
+		attribute.String("stripe.event.detail", detail),
+	))
+
+	stored, ferr := db.FinishStripeEvent(ctx, event.ID, status, detail)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return stored, err
+}
+
+// applyStripeEvent updates the payment an event is about. It returns the
+// event status to store and a detail explaining it.
+func applyStripeEvent(ctx context.Context, event stripe.Event) (string, string, error) {
+	if event.Data == nil {
+		return db.EventIgnored, "event has no data", nil
+	}
+
+	switch {
+	case intentEvents[event.Type]:
+		var intent stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+			return "", "", err
+		}
+		payment, err := db.GetPaymentByTransactionID(ctx, intent.ID)
+		if err != nil {
+			return paymentLookupOutcome(err, intent.ID)
+		}
+		return transitionPayment(ctx, payment, provider.StripeStatus(&intent), string(intent.Status))
+
+	case event.Type == "charge.failed":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return "", "", err
+		}
+		payment, err := db.GetPaymentByTransactionID(ctx, chargeTransactionIDs(&charge)...)
+		if err != nil {
+			return paymentLookupOutcome(err, charge.ID)
+		}
+		return transitionPayment(ctx, payment, db.PaymentFailed, payment.IntentStatus)
+
+	case event.Type == "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return "", "", err
+		}
+		return applyChargeRefunded(ctx, &charge)
+
+	case event.Type == "charge.dispute.created" || event.Type == "charge.dispute.closed":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return "", "", err
+		}
+		var ids []string
+		if dispute.Charge != nil {
+			ids = chargeTransactionIDs(dispute.Charge)
+		}
+		if dispute.PaymentIntent != nil && dispute.PaymentIntent.ID != "" {
+			ids = append(ids, dispute.PaymentIntent.ID)
+		}
+		payment, err := db.GetPaymentByTransactionID(ctx, ids...)
+		if err != nil {
+			return paymentLookupOutcome(err, dispute.ID)
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("stripe.dispute.id", dispute.ID),
+			attribute.String("stripe.dispute.reason", string(dispute.Reason)),
+			attribute.String("stripe.dispute.status", string(dispute.Status)),
+		)
+
+		switch {
+		case event.Type == "charge.dispute.created":
+			return transitionPayment(ctx, payment, db.PaymentDisputed, payment.IntentStatus)
+		case dispute.Status == stripe.DisputeStatusLost:
+			return transitionPayment(ctx, payment, db.PaymentChargedBack, payment.IntentStatus)
+		case dispute.Status == stripe.DisputeStatusWon:
+			status, detail, err := transitionPayment(ctx, payment, db.PaymentCompleted, payment.IntentStatus)
+			if err != nil || status != db.EventProcessed {
+				return status, detail, err
+			}
+			// Refunds made before the dispute still count
+			_, err = db.RefreshRefundedStatus(ctx, payment.ID)
+			return status, detail, err
+		default:
+			return db.EventIgnored, "dispute closed as " + string(dispute.Status), nil
+		}
+
+	default:
+		return db.EventIgnored, "event type not handled", nil
+	}
+}
+
+// applyChargeRefunded records refunds of a charge: pending refunds started by
+// refundPayment are completed, and whatever Stripe refunded beyond the
+// recorded refunds, e.g. in the dashboard, is added as a new refund
+func applyChargeRefunded(ctx context.Context, charge *stripe.Charge) (string, string, error) {
+	payment, err := db.GetPaymentByTransactionID(ctx, chargeTransactionIDs(charge)...)
+	if err != nil {
+		return paymentLookupOutcome(err, charge.ID)
+	}
+
+	if charge.Refunds != nil {
+		recorded, err := db.GetRefunds(ctx, payment.ID)
+		if err != nil {
+			return "", "", err
+		}
+		pending := map[string]bool{}
+		for _, refund := range recorded {
+			if refund.Status == db.RefundPending {
+				pending[refund.ID] = true
+			}
+		}
+
+		for _, stripeRefund := range charge.Refunds.Data {
+			refundID := stripeRefund.Metadata["refund_id"]
+			if !pending[refundID] || stripeRefund.Status != stripe.RefundStatusSucceeded {
+				continue
+			}
+			refund, updated, err := db.CompleteRefund(ctx, refundID, stripeRefund.ID, db.RefundSucceeded)
+			if err != nil {
+				return "", "", err
+			}
+			notifyRefund(ctx, updated, refund)
+		}
+	}
+
+	refund, updated, err := db.RecordExternalRefund(ctx, payment.ID, money.New(charge.AmountRefunded, string(charge.Currency)))
+	if err != nil {
+		return "", "", err
+	}
+	if refund == nil {
+		return db.EventProcessed, "refunds already recorded", nil
+	}
+	notifyRefund(ctx, updated, refund)
+
+	return db.EventProcessed, fmt.Sprintf("recorded refund %s of %s", refund.ID, refund.Amount), nil
+}
+
+// transitionPayment moves a payment to status if webhookTransitions allows it
+func transitionPayment(ctx context.Context, payment *db.Payment, status, intentStatus string) (string, string, error) {
+	if payment.Status == status {
+		return db.EventProcessed, "payment already " + status, nil
+	}
+
+	allowed := false
+	for _, from := range webhookTransitions[status] {
+		if from == payment.Status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return db.EventIgnored, fmt.Sprintf("payment is %s and cannot move to %s", payment.Status, status), nil
+	}
+
+	// A concurrent change fails the event, so that it is retried against
+	// the new status
+	updated, err := db.UpdatePaymentIntent(ctx, payment.ID, []string{payment.Status}, status, intentStatus)
+	if err != nil {
+		return "", "", err
+	}
+	// A won dispute leaves the order where fulfilment took it
+	if payment.Status != db.PaymentDisputed {
+		markOrderPaid(ctx, updated)
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("payment.status_changed", trace.WithAttributes(
+		attribute.String("payment.id", payment.ID),
+		attribute.String("payment.status.from", payment.Status),
+		attribute.String("payment.status.to", status),
+	))
+	return db.EventProcessed, "payment moved to " + status, nil
+}
+
+// paymentLookupOutcome ignores events about payments that are not ours
+func paymentLookupOutcome(err error, objectID string) (string, string, error) {
+	if err.Error() == "payment not found" {
+		return db.EventIgnored, "no payment for " + objectID, nil
+	}
+	return "", "", err
+}
+
+// chargeTransactionIDs returns the IDs a payment for charge may be stored
+// under: its PaymentIntent, or the charge itself for older payments
+func chargeTransactionIDs(charge *stripe.Charge) []string {
+	ids := []string{charge.ID}
+	if charge.PaymentIntent != nil && charge.PaymentIntent.ID != "" {
+		ids = append(ids, charge.PaymentIntent.ID)
+	}
+	return ids
+}
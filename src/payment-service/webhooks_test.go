@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"payment-service/db"
+	"payment-service/money"
+	"payment-service/orders"
+	"payment-service/telemetry"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// mockDBs numbers the mock databases, which need distinct names
+var mockDBs int
+
+// mockDB points db.DB at a sqlmock database for the test. Queries the test
+// did not expect fail, and expected ones that did not run fail the test.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	mockDBs++
+	dsn := fmt.Sprintf("payment_%d", mockDBs)
+	conn, mock, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db.DB
+	db.DB, err = telemetry.OpenDB("sqlmock", dsn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.DB = previous
+		conn.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+// orderUpdates stands in for cart-order-service and records the order status
+// updates payment-service sends it. Order ord_1 of user_1 is a pending order
+// of 1200.00 USD, whose stock is reserved unless stockLapsed is set.
+type orderUpdates struct {
+	mu          sync.Mutex
+	statuses    []string
+	stockLapsed bool
+}
+
+func (o *orderUpdates) list() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.statuses...)
+}
+
+func mockOrders(t *testing.T) *orderUpdates {
+	updates := &orderUpdates{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.URL.Path != "/api/orders/ord_1" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(orders.Order{ID: "ord_1", UserID: "user_1", Total: money.New(120000, "USD"), Status: orders.OrderPending})
+			return
+		}
+		if r.URL.Path == "/api/orders/ord_1/reservation/confirm" {
+			updates.mu.Lock()
+			defer updates.mu.Unlock()
+			if updates.stockLapsed {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]string{"error": "reservation expired"})
+			}
+			return
+		}
+		var req struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		updates.mu.Lock()
+		updates.statuses = append(updates.statuses, r.URL.Path+" "+req.Status)
+		updates.mu.Unlock()
+	}))
+	previous := orderClient
+	orderClient = &orders.Client{BaseURL: server.URL, HTTPClient: server.Client()}
+	t.Cleanup(func() {
+		orderClient = previous
+		server.Close()
+	})
+	return updates
+}
+
+var paymentRowColumns = []string{
+	"id", "order_id", "user_id", "amount", "currency", "status", "card_last_four", "transaction_id", "capture_method",
+	"intent_status", "captured_at", "review_status", "fraud_score", "fraud_decision", "fraud_reasons", "card_fingerprint",
+	"client_ip", "reviewed_by", "reviewed_at", "review_note", "refunded_amount", "created_at", "updated_at",
+}
+
+// paymentRow is a stored payment of 1200.00 USD for order ord_1
+func paymentRow(id, intentID, status string) *sqlmock.Rows {
+	return sqlmock.NewRows(paymentRowColumns).AddRow(
+		id, "ord_1", "user_1", "1200.00", "USD", status, "4242", intentID, db.CaptureAutomatic,
+		"", "", "", 0, db.FraudAllow, []byte("[]"), "", "", "", "", "", "0", "2026-01-01 00:00:00", "2026-01-01 00:00:00",
+	)
+}
+
+var stripeEventColumns = []string{"id", "type", "status", "detail", "attempts", "received_at", "processed_at"}
+
+func stripeEventRow(id, eventType, status string) *sqlmock.Rows {
+	return sqlmock.NewRows(stripeEventColumns).AddRow(id, eventType, status, "", 0, "2026-01-01 00:00:00", "")
+}
+
+// fixture reads an event from testdata/stripe with its IDs filled in
+func fixture(t *testing.T, name, eventID, intentID string) []byte {
+	data, err := os.ReadFile("testdata/stripe/" + name + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(strings.NewReplacer(
+		"{{EVENT_ID}}", eventID,
+		"{{PAYMENT_INTENT_ID}}", intentID,
+		"{{CHARGE_ID}}", "ch_test",
+	).Replace(string(data)))
+}
+
+// signedPayload signs an event the way Stripe does
+func signedPayload(payload []byte, secret string) string {
+	now := time.Now()
+	return fmt.Sprintf("t=%d,v1=%x", now.Unix(), webhook.ComputeSignature(now, payload, secret))
+}
+
+func postWebhook(payload []byte, signature string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/payments/webhooks/stripe", bytes.NewReader(payload))
+	if signature != "" {
+		req.Header.Set("Stripe-Signature", signature)
+	}
+	w := httptest.NewRecorder()
+	handleStripeWebhook(w, req)
+	return w
+}
+
+func withWebhookSecret(t *testing.T) {
+	previous := webhookSecret
+	webhookSecret = testWebhookSecret
+	t.Cleanup(func() { webhookSecret = previous })
+}
+
+func TestWebhookRejectsBadSignatures(t *testing.T) {
+	withWebhookSecret(t)
+	// No query may run for an event that is not verified
+	mockDB(t)
+
+	payload := fixture(t, "payment_intent.succeeded", "evt_1", "pi_1")
+	tampered := append(bytes.Clone(payload), ' ')
+	old := time.Now().Add(-time.Hour)
+
+	tests := map[string]struct {
+		payload   []byte
+		signature string
+	}{
+		"missing":    {payload, ""},
+		"garbage":    {payload, "not a signature"},
+		"wrong key":  {payload, signedPayload(payload, "whsec_other")},
+		"tampered":   {tampered, signedPayload(payload, testWebhookSecret)},
+		"too old":    {payload, fmt.Sprintf("t=%d,v1=%x", old.Unix(), webhook.ComputeSignature(old, payload, testWebhookSecret))},
+		"wrong body": {fixture(t, "payment_intent.succeeded", "evt_2", "pi_1"), signedPayload(payload, testWebhookSecret)},
+	}
+	for name, tt := range tests {
+		w := postWebhook(tt.payload, tt.signature)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid Stripe signature") {
+			t.Errorf("%s: %d %s, want 400", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	previous := webhookSecret
+	webhookSecret = ""
+	t.Cleanup(func() { webhookSecret = previous })
+
+	payload := fixture(t, "payment_intent.succeeded", "evt_1", "pi_1")
+	if w := postWebhook(payload, signedPayload(payload, "")); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", w.Code)
+	}
+}
+
+func TestWebhookAppliesEvent(t *testing.T) {
+	withWebhookSecret(t)
+	mock := mockDB(t)
+	updates := mockOrders(t)
+
+	payload := fixture(t, "payment_intent.succeeded", "evt_1", "pi_1")
+	mock.ExpectQuery(`INSERT INTO stripe_events`).
+		WithArgs("evt_1", "payment_intent.succeeded", sqlmock.AnyArg()).
+		WillReturnRows(stripeEventRow("evt_1", "payment_intent.succeeded", db.EventReceived))
+	mock.ExpectQuery(`FROM payments WHERE transaction_id = ANY`).
+		WillReturnRows(paymentRow("pay_1", "pi_1", db.PaymentRequiresAction))
+	mock.ExpectQuery(`UPDATE payments\s+SET status = \$2`).
+		WithArgs("pay_1", db.PaymentCompleted, "succeeded", sqlmock.AnyArg()).
+		WillReturnRows(paymentRow("pay_1", "pi_1", db.PaymentCompleted))
+	mock.ExpectQuery(`UPDATE stripe_events`).
+		WithArgs("evt_1", db.EventProcessed, "payment moved to completed").
+		WillReturnRows(stripeEventRow("evt_1", "payment_intent.succeeded", db.EventProcessed))
+
+	w := postWebhook(payload, signedPayload(payload, testWebhookSecret))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"processed"`) {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+	if got := updates.list(); len(got) != 1 || got[0] != "/api/orders/ord_1/status paid" {
+		t.Errorf("order updates = %v, want the order marked paid", got)
+	}
+}
+
+func TestWebhookSkipsDuplicates(t *testing.T) {
+	withWebhookSecret(t)
+	payload := fixture(t, "payment_intent.succeeded", "evt_1", "pi_1")
+
+	for _, status := range []string{db.EventProcessed, db.EventIgnored} {
+		mock := mockDB(t)
+		mock.ExpectQuery(`INSERT INTO stripe_events`).
+			WillReturnRows(sqlmock.NewRows(stripeEventColumns))
+		mock.ExpectQuery(`FROM stripe_events WHERE id = \$1`).
+			WithArgs("evt_1").
+			WillReturnRows(sqlmock.NewRows(append(stripeEventColumns, "payload")).
+				AddRow("evt_1", "payment_intent.succeeded", status, "", 1, "2026-01-01 00:00:00", "2026-01-01 00:00:00", payload))
+
+		// Nothing else may run: the payment is neither read nor changed
+		w := postWebhook(payload, signedPayload(payload, testWebhookSecret))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"duplicate":true`) {
+			t.Errorf("%s event: got %d %s, want it skipped", status, w.Code, w.Body)
+		}
+	}
+}
+
+func TestWebhookRetriesFailedEvents(t *testing.T) {
+	withWebhookSecret(t)
+	mock := mockDB(t)
+	mockOrders(t)
+
+	// An event whose processing failed before is applied again
+	payload := fixture(t, "payment_intent.succeeded", "evt_1", "pi_1")
+	mock.ExpectQuery(`INSERT INTO stripe_events`).
+		WillReturnRows(sqlmock.NewRows(stripeEventColumns))
+	mock.ExpectQuery(`FROM stripe_events WHERE id = \$1`).
+		WillReturnRows(sqlmock.NewRows(append(stripeEventColumns, "payload")).
+			AddRow("evt_1", "payment_intent.succeeded", db.EventFailed, "database down", 1, "2026-01-01 00:00:00", "2026-01-01 00:00:00", payload))
+	mock.ExpectQuery(`FROM payments WHERE transaction_id = ANY`).
+		WillReturnRows(paymentRow("pay_1", "pi_1", db.PaymentProcessing))
+	mock.ExpectQuery(`UPDATE payments\s+SET status = \$2`).
+		WillReturnRows(paymentRow("pay_1", "pi_1", db.PaymentCompleted))
+	mock.ExpectQuery(`UPDATE stripe_events`).
+		WillReturnRows(stripeEventRow("evt_1", "payment_intent.succeeded", db.EventProcessed))
+
+	w := postWebhook(payload, signedPayload(payload, testWebhookSecret))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"processed"`) {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+// Events that arrive out of order never undo a later change of the payment
+func TestWebhookOutOfOrderEvents(t *testing.T) {
+	withWebhookSecret(t)
+	updates := mockOrders(t)
+
+	tests := []struct {
+		fixture string
+		status  string
+	}{
+		// Authorized, then captured: the authorization arrives last
+		{"payment_intent.amount_capturable_updated", db.PaymentCompleted},
+		// A failed attempt reported after the payment went through
+		{"payment_intent.payment_failed", db.PaymentCompleted},
+		{"payment_intent.payment_failed", db.PaymentAuthorized},
+		// A cancelation cannot void a captured or refunded payment
+		{"payment_intent.canceled", db.PaymentCompleted},
+		{"payment_intent.canceled", db.PaymentRefunded},
+		// Nor can a late success revive a voided or refunded one
+		{"payment_intent.succeeded", db.PaymentVoided},
+		{"payment_intent.succeeded", db.PaymentRefunded},
+		{"payment_intent.succeeded", db.PaymentChargedBack},
+	}
+	for _, tt := range tests {
+		mock := mockDB(t)
+		payload := fixture(t, tt.fixture, "evt_1", "pi_1")
+		mock.ExpectQuery(`INSERT INTO stripe_events`).
+			WillReturnRows(stripeEventRow("evt_1", tt.fixture, db.EventReceived))
+		mock.ExpectQuery(`FROM payments WHERE transaction_id = ANY`).
+			WillReturnRows(paymentRow("pay_1", "pi_1", tt.status))
+		// No UPDATE payments: the event is only recorded as ignored
+		mock.ExpectQuery(`UPDATE stripe_events`).
+			WithArgs("evt_1", db.EventIgnored, sqlmock.AnyArg()).
+			WillReturnRows(stripeEventRow("evt_1", tt.fixture, db.EventIgnored))
+
+		w := postWebhook(payload, signedPayload(payload, testWebhookSecret))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"ignored"`) {
+			t.Errorf("%s on a %s payment: got %d %s, want it ignored", tt.fixture, tt.status, w.Code, w.Body)
+		}
+	}
+	if got := updates.list(); len(got) != 0 {
+		t.Errorf("order updates = %v, want none", got)
+	}
+}
+
+func TestWebhookTransitions(t *testing.T) {
+	allowed := func(from, to string) bool {
+		for _, status := range webhookTransitions[to] {
+			if status == from {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{db.PaymentRequiresAction, db.PaymentCompleted, true},
+		{db.PaymentProcessing, db.PaymentAuthorized, true},
+		{db.PaymentAuthorized, db.PaymentCompleted, true},
+		{db.PaymentAuthorized, db.PaymentVoided, true},
+		{db.PaymentRequiresAction, db.PaymentFailed, true},
+		{db.PaymentCompleted, db.PaymentDisputed, true},
+		{db.PaymentDisputed, db.PaymentChargedBack, true},
+		{db.PaymentDisputed, db.PaymentCompleted, true},
+		{db.PaymentCompleted, db.PaymentAuthorized, false},
+		{db.PaymentCompleted, db.PaymentFailed, false},
+		{db.PaymentCompleted, db.PaymentRequiresAction, false},
+		{db.PaymentAuthorized, db.PaymentProcessing, false},
+		{db.PaymentFailed, db.PaymentCompleted, false},
+		{db.PaymentVoided, db.PaymentAuthorized, false},
+		{db.PaymentRefunded, db.PaymentCompleted, false},
+		{db.PaymentChargedBack, db.PaymentDisputed, false},
+		// A pending payment is finished by the request that created it
+		{db.PaymentPending, db.PaymentCompleted, false},
+	}
+	for _, tt := range tests {
+		if got := allowed(tt.from, tt.to); got != tt.want {
+			t.Errorf("%s -> %s allowed = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestReplayStripeEvent(t *testing.T) {
+	mock := mockDB(t)
+	updates := mockOrders(t)
+
+	// Replays are not verified again, so they work without the secret
+	payload := fixture(t, "payment_intent.succeeded", "evt_1", "pi_1")
+	mock.ExpectQuery(`FROM stripe_events WHERE id = \$1`).
+		WithArgs("evt_1").
+		WillReturnRows(sqlmock.NewRows(append(stripeEventColumns, "payload")).
+			AddRow("evt_1", "payment_intent.succeeded", db.EventFailed, "payment status changed", 1, "2026-01-01 00:00:00", "2026-01-01 00:00:00", payload))
+	mock.ExpectQuery(`FROM payments WHERE transaction_id = ANY`).
+		WillReturnRows(paymentRow("pay_1", "pi_1", db.PaymentAuthorized))
+	mock.ExpectQuery(`UPDATE payments\s+SET status = \$2`).
+		WithArgs("pay_1", db.PaymentCompleted, "succeeded", sqlmock.AnyArg()).
+		WillReturnRows(paymentRow("pay_1", "pi_1", db.PaymentCompleted))
+	mock.ExpectQuery(`UPDATE stripe_events`).
+		WithArgs("evt_1", db.EventProcessed, sqlmock.AnyArg()).
+		WillReturnRows(stripeEventRow("evt_1", "payment_intent.succeeded", db.EventProcessed))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/payments/webhooks/stripe/events/evt_1/replay", nil),
+		map[string]string{"eventId": "evt_1"})
+	w := httptest.NewRecorder()
+	replayStripeEvent(w, req)
+
+	var replayed db.StripeEvent
+	if err := json.NewDecoder(w.Body).Decode(&replayed); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d, %v", w.Code, err)
+	}
+	if replayed.Status != db.EventProcessed {
+		t.Errorf("replayed event is %s", replayed.Status)
+	}
+	if got := updates.list(); len(got) != 1 || got[0] != "/api/orders/ord_1/status paid" {
+		t.Errorf("order updates = %v, want the order marked paid", got)
+	}
+}
+
+func TestReplayUnknownEvent(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery(`FROM stripe_events WHERE id = \$1`).
+		WillReturnRows(sqlmock.NewRows(append(stripeEventColumns, "payload")))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/", nil), map[string]string{"eventId": "evt_missing"})
+	w := httptest.NewRecorder()
+	replayStripeEvent(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"product-service/auth"
+	"product-service/db"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Admin catalog endpoints. Writes to an existing product must send the
+// version they last read in If-Match (every product response carries it as
+// ETag), so that concurrent edits cannot silently overwrite each other.
+
+func createProduct(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		ID string `json:"id"`
+		db.ProductInput
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !validProduct(w, req.ProductInput) {
+		return
+	}
+
+	product, err := db.CreateProduct(r.Context(), req.ID, req.ProductInput, auth.UserID(r.Context()))
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+
+	traceProductChange(r, db.AuditCreate, product)
+	setETag(w, product)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(product)
+}
+
+func updateProduct(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	var in db.ProductInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !validProduct(w, in) {
+		return
+	}
+
+	product, err := db.UpdateProduct(r.Context(), id, version, in, auth.UserID(r.Context()))
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+
+	traceProductChange(r, db.AuditUpdate, product)
+	setETag(w, product)
+	json.NewEncoder(w).Encode(product)
+}
+
+func archiveProduct(w http.ResponseWriter, r *http.Request) {
+	changeArchived(w, r, true)
+}
+
+func restoreProduct(w http.ResponseWriter, r *http.Request) {
+	changeArchived(w, r, false)
+}
+
+func changeArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	action, change := db.AuditRestore, db.RestoreProduct
+	if archived {
+		action, change = db.AuditArchive, db.ArchiveProduct
+	}
+
+	product, err := change(r.Context(), id, version, auth.UserID(r.Context()))
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+
+	traceProductChange(r, action, product)
+	setETag(w, product)
+	json.NewEncoder(w).Encode(product)
+}
+
+func deleteProduct(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteProduct(r.Context(), id, version, auth.UserID(r.Context())); err != nil {
+		writeProductError(w, err)
+		return
+	}
+
+	traceProductChange(r, db.AuditDelete, &db.Product{ID: id, Version: version})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getProductAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	entries, err := db.GetProductAudit(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+// validProduct writes 400 with every validation problem unless in is valid
+func validProduct(w http.ResponseWriter, in db.ProductInput) bool {
+	problems := db.ValidateProduct(in)
+	if len(problems) == 0 {
+		return true
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "Invalid product",
+		"details": problems,
+	})
+	return false
+}
+
+// ifMatchVersion reads the product version from If-Match. Both "3" and 3 are
+// accepted.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(map[string]string{"error": "If-Match header with the product version is required"})
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid If-Match header"})
+		return 0, false
+	}
+	return version, true
+}
+
+func setETag(w http.ResponseWriter, product *db.Product) {
+	w.Header().Set("ETag", fmt.Sprintf("%q", strconv.Itoa(product.Version)))
+}
+
+func writeProductError(w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case "product not found":
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+	case "version conflict":
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product was changed by someone else, reload it and try again"})
+	case "product already exists":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "A product with this ID already exists"})
+	case "product has orders", "product has reserved stock":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product cannot be deleted because it " + strings.TrimPrefix(err.Error(), "product ") + ", archive it instead"})
+	case "variant has reserved stock":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Cannot remove a size or color that has reserved stock"})
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// traceProductChange records an admin change on the request span
+func traceProductChange(r *http.Request, action string, product *db.Product) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("product.id", product.ID),
+		attribute.Int("product.version", product.Version),
+	)
+	span.AddEvent("product."+action, trace.WithAttributes(
+		attribute.String("enduser.id", auth.UserID(r.Context())),
+	))
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Roles carried in access tokens
+const (
+	RoleCustomer = "customer"
+	RoleAdmin    = "admin"
+	RoleService  = "service"
+)
+
+// Claims are the claims of an access token. The subject is the user ID, or
+// "service:<name>" for tokens minted by a service for its own calls.
+type Claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the subject of the token
+func (c *Claims) UserID() string {
+	return c.Subject
+}
+
+// IsAdmin reports whether the token grants administrative access
+func (c *Claims) IsAdmin() bool {
+	return c.Role == RoleAdmin
+}
+
+var (
+	secret         []byte
+	issuer         string
+	accessTokenTTL time.Duration
+)
+
+// Init reads the signing configuration from the environment. All services
+// must share AUTH_JWT_SECRET so that tokens issued by cart-order-service are
+// accepted everywhere; there is no default, since anyone who knows it can
+// mint tokens.
+func Init() error {
+	secret = []byte(os.Getenv("AUTH_JWT_SECRET"))
+	if len(secret) == 0 {
+		return fmt.Errorf("AUTH_JWT_SECRET is not set")
+	}
+
+	issuer = os.Getenv("AUTH_ISSUER")
+	if issuer == "" {
+		issuer = "ecommerce-opentelemetry-demo"
+	}
+
+	accessTokenTTL = 15 * time.Minute
+	if ttl, err := time.ParseDuration(os.Getenv("AUTH_ACCESS_TOKEN_TTL")); err == nil && ttl > 0 {
+		accessTokenTTL = ttl
+	}
+	return nil
+}
+
+// IssueAccessToken signs a short-lived access token for a user and returns it
+// together with its expiry
+func IssueAccessToken(userID, role string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			Issuer:    issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+
+	signed, err := token.SignedString(secret)
+	return signed, expiresAt, err
+}
+
+// ParseAccessToken verifies the signature, issuer and expiry of a token
+func ParseAccessToken(tokenString string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(*jwt.Token) (interface{}, error) {
+		return secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+type contextKey struct{}
+
+type principal struct {
+	claims *Claims
+	token  string
+}
+
+// FromContext returns the claims of the authenticated caller, if any
+func FromContext(ctx context.Context) (*Claims, bool) {
+	p, ok := ctx.Value(contextKey{}).(principal)
+	return p.claims, ok
+}
+
+// UserID returns the ID of the authenticated caller, or "" if anonymous
+func UserID(ctx context.Context) string {
+	if claims, ok := FromContext(ctx); ok {
+		return claims.UserID()
+	}
+	return ""
+}
+
+// Middleware verifies bearer tokens. A valid token puts the caller into the
+// request context and onto the request span; an invalid one is rejected with
+// 401. Requests without a token pass through anonymously, use Require to
+// reject them.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			unauthorized(w, "Invalid authorization header")
+			return
+		}
+
+		claims, err := ParseAccessToken(tokenString)
+		if err != nil {
+			trace.SpanFromContext(r.Context()).AddEvent("auth.invalid_token", trace.WithAttributes(
+				attribute.String("error", err.Error()),
+			))
+			unauthorized(w, "Invalid or expired token")
+			return
+		}
+
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("enduser.id", claims.UserID()),
+			attribute.String("enduser.role", claims.Role),
+		)
+
+		ctx := context.WithValue(r.Context(), contextKey{}, principal{claims: claims, token: tokenString})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Require rejects anonymous requests with 401
+func Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			if _, ok := FromContext(r.Context()); !ok {
+				unauthorized(w, "Authentication required")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// RequireRole rejects callers that have none of the given roles with 403
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return Require(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := FromContext(r.Context())
+		for _, role := range roles {
+			if claims.Role == role {
+				next(w, r)
+				return
+			}
+		}
+		Forbid(w, r, "role", strings.Join(roles, ","))
+	})
+}
+
+// CanAccess reports whether the caller may see and change a resource owned
+// by ownerID. Admins and other services may access every resource.
+func CanAccess(ctx context.Context, ownerID string) bool {
+	claims, ok := FromContext(ctx)
+	if !ok {
+		return false
+	}
+	if claims.Role == RoleAdmin || claims.Role == RoleService {
+		return true
+	}
+	return ownerID != "" && claims.UserID() == ownerID
+}
+
+// Forbid rejects the request with 403 and records the denial on the request
+// span
+func Forbid(w http.ResponseWriter, r *http.Request, resource, resourceID string) {
+	trace.SpanFromContext(r.Context()).AddEvent("auth.denied", trace.WithAttributes(
+		attribute.String("enduser.id", UserID(r.Context())),
+		attribute.String("auth.resource", resource),
+		attribute.String("auth.resource_id", resourceID),
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "{\"error\":%q}\n", "Access denied")
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, "{\"error\":%q}\n", message)
+}
+
+// Transport authenticates outgoing calls to other services. It forwards the
+// caller's token when the request context carries one and otherwise uses a
+// service token, e.g. for background jobs. With AsService set it always uses
+// a service token, for calls the caller is not allowed to make itself.
+type Transport struct {
+	Service   string
+	Base      http.RoundTripper
+	AsService bool
+}
+
+// NewTransport wraps base so that requests carry an Authorization header
+func NewTransport(service string, base http.RoundTripper) *Transport {
+	return &Transport{Service: service, Base: base}
+}
+
+// NewServiceTransport wraps base so that requests always carry a service token
+func NewServiceTransport(service string, base http.RoundTripper) *Transport {
+	return &Transport{Service: service, Base: base, AsService: true}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := ""
+	if p, ok := req.Context().Value(contextKey{}).(principal); ok && !t.AsService {
+		token = p.token
+	} else {
+		var err error
+		token, _, err = IssueAccessToken("service:"+t.Service, RoleService)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.Base.RoundTrip(req)
+}
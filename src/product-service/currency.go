@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"product-service/db"
+	"product-service/money"
+	"product-service/rates"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prices are stored in money.DefaultCurrency and served in the currency asked
+// for with the currency query parameter or the Accept-Currency header. Each
+// converted product carries the rate it was converted with, so that carts
+// can record it.
+
+var converter *rates.Converter
+
+// initRates sets up the rates source: EXCHANGE_RATES_FILE, or the built-in
+// rates, and optionally EXCHANGE_RATES_URL in front of it
+func initRates() {
+	static, err := rates.NewStatic(db.GetEnvOrDefault("EXCHANGE_RATES_FILE", ""))
+	if err != nil {
+		slog.Error("Failed to load exchange rates", "error", err)
+		os.Exit(1)
+	}
+	var source rates.Source = static
+
+	if url := db.GetEnvOrDefault("EXCHANGE_RATES_URL", ""); url != "" {
+		ttl, err := time.ParseDuration(db.GetEnvOrDefault("EXCHANGE_RATES_TTL", "1h"))
+		if err != nil {
+			slog.Warn("Invalid EXCHANGE_RATES_TTL, using 1h", "error", err)
+			ttl = time.Hour
+		}
+		source = rates.NewHTTP(url, ttl, static)
+	}
+
+	converter = rates.NewConverter(source)
+	slog.Info("Exchange rates loaded", "source", source.Name())
+}
+
+// requestedCurrency returns the currency prices should be served in. It
+// writes 400 and returns false for a currency without a rate.
+func requestedCurrency(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept-Currency")
+
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		// Only the first, preferred currency of the header is served
+		currency, _, _ = strings.Cut(r.Header.Get("Accept-Currency"), ",")
+		currency, _, _ = strings.Cut(currency, ";")
+	}
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return money.DefaultCurrency, true
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String("currency.requested", currency))
+
+	ok, err := converter.Supported(r.Context(), currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported currency " + currency})
+		return "", false
+	}
+	return currency, true
+}
+
+// convertPrices converts the prices of products to currency
+func convertPrices(ctx context.Context, products []db.Product, currency string) error {
+	if currency == money.DefaultCurrency {
+		return nil
+	}
+
+	rate, err := converter.Rate(ctx, money.DefaultCurrency, currency)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		products[i].Price = rate.Apply(products[i].Price)
+		products[i].ExchangeRate = rate
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("exchange_rate.source", rate.Source),
+		attribute.Float64("exchange_rate.value", rate.Rate),
+	)
+	return nil
+}
+
+func getCurrencies(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	currencies, err := converter.Currencies(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default":    money.DefaultCurrency,
+		"currencies": currencies,
+		"source":     converter.Source.Name(),
+	})
+}
+
+// toDefaultCurrency converts a price filter given in currency to the stored
+// currency. It fails with "invalid price" for amounts that are no valid
+// amount of currency.
+func toDefaultCurrency(ctx context.Context, price, currency string) (string, error) {
+	if price == "" || currency == money.DefaultCurrency {
+		return price, nil
+	}
+
+	amount, err := money.Parse(price, currency)
+	if err != nil {
+		return "", fmt.Errorf("invalid price")
+	}
+	converted, _, err := converter.Convert(ctx, amount, money.DefaultCurrency)
+	if err != nil {
+		return "", err
+	}
+	return converted.Decimal(), nil
+}
+
+func writePriceFilterError(w http.ResponseWriter, err error) {
+	if err.Error() == "invalid price" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "minPrice and maxPrice must be amounts of the requested currency"})
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
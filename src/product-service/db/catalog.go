@@ -0,0 +1,395 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"product-service/money"
+	"product-service/telemetry"
+
+	"github.com/lib/pq"
+)
+
+// Audit actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditArchive = "archive"
+	AuditRestore = "restore"
+	AuditDelete  = "delete"
+)
+
+// ProductInput holds the fields of a product an admin can set
+type ProductInput struct {
+	Name        string      `json:"name"`
+	Category    string      `json:"category"`
+	Price       money.Money `json:"price"`
+	Image       string      `json:"image"`
+	Description string      `json:"description"`
+	Rating      float64     `json:"rating"`
+	Reviews     int         `json:"reviews"`
+	Sizes       []string    `json:"sizes"`
+	Colors      []string    `json:"colors"`
+}
+
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	ProductID string          `json:"productId"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	Version   int             `json:"version"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+// ValidateProduct returns every problem with a product, or nil if it is valid
+func ValidateProduct(in ProductInput) []string {
+	var problems []string
+
+	if strings.TrimSpace(in.Name) == "" {
+		problems = append(problems, "name is required")
+	} else if len(in.Name) > 255 {
+		problems = append(problems, "name must be at most 255 characters")
+	}
+	if strings.TrimSpace(in.Category) == "" {
+		problems = append(problems, "category is required")
+	} else if len(in.Category) > 100 {
+		problems = append(problems, "category must be at most 100 characters")
+	}
+	if !in.Price.IsPositive() || in.Price.Cmp(money.New(1e10, in.Price.Currency)) >= 0 {
+		problems = append(problems, "price must be greater than 0 and less than 100000000")
+	}
+	if in.Price.Currency != money.DefaultCurrency {
+		problems = append(problems, "price must be in "+money.DefaultCurrency)
+	}
+	if in.Image != "" && !strings.HasPrefix(in.Image, "/") &&
+		!strings.HasPrefix(in.Image, "https://") && !strings.HasPrefix(in.Image, "http://") {
+		problems = append(problems, "image must be an absolute path or an http(s) URL")
+	}
+	if in.Rating < 0 || in.Rating > 5 {
+		problems = append(problems, "rating must be between 0 and 5")
+	}
+	if in.Reviews < 0 {
+		problems = append(problems, "reviews must not be negative")
+	}
+	problems = append(problems, validateOptions("sizes", in.Sizes, 20)...)
+	problems = append(problems, validateOptions("colors", in.Colors, 50)...)
+
+	return problems
+}
+
+func validateOptions(field string, options []string, maxLen int) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for _, o := range options {
+		switch {
+		case strings.TrimSpace(o) == "":
+			problems = append(problems, field+" must not contain empty values")
+		case len(o) > maxLen:
+			problems = append(problems, fmt.Sprintf("%s must be at most %d characters each", field, maxLen))
+		case seen[o]:
+			problems = append(problems, field+" must not contain duplicates: "+o)
+		}
+		seen[o] = true
+	}
+	return problems
+}
+
+// CreateProduct adds a product to the catalog. An empty id generates one.
+// Every size and color combination gets an inventory row with no stock.
+func CreateProduct(ctx context.Context, id string, in ProductInput, actor string) (*Product, error) {
+	if id == "" {
+		id = fmt.Sprintf("prod_%d", time.Now().UnixNano())
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO products (id, name, category, price, image, description, rating, reviews, sizes, colors)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		id, in.Name, in.Category, in.Price, in.Image, in.Description, in.Rating, in.Reviews,
+		pq.Array(in.Sizes), pq.Array(in.Colors))
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return nil, fmt.Errorf("product already exists")
+		}
+		return nil, err
+	}
+
+	if err = syncInventoryVariants(ctx, tx, id, in.Sizes, in.Colors); err != nil {
+		return nil, err
+	}
+
+	product, err := getProductTx(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = recordAudit(ctx, tx, AuditCreate, actor, nil, product); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// UpdateProduct replaces the editable fields of a product if it is still at
+// version. Otherwise it fails with "version conflict" and nothing changes.
+// Removing a size or color that has reserved stock is refused.
+func UpdateProduct(ctx context.Context, id string, version int, in ProductInput, actor string) (*Product, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := lockProduct(ctx, tx, id, version)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE products
+		SET name = $2, category = $3, price = $4, image = $5, description = $6,
+		    rating = $7, reviews = $8, sizes = $9, colors = $10, version = version + 1
+		WHERE id = $1`,
+		id, in.Name, in.Category, in.Price, in.Image, in.Description, in.Rating, in.Reviews,
+		pq.Array(in.Sizes), pq.Array(in.Colors))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syncInventoryVariants(ctx, tx, id, in.Sizes, in.Colors); err != nil {
+		return nil, err
+	}
+
+	return commitProductChange(ctx, tx, AuditUpdate, actor, before)
+}
+
+// ArchiveProduct hides a product from the catalog listings without deleting
+// it. Archived products stay readable by ID.
+func ArchiveProduct(ctx context.Context, id string, version int, actor string) (*Product, error) {
+	return setArchived(ctx, id, version, actor, true)
+}
+
+// RestoreProduct lists an archived product again
+func RestoreProduct(ctx context.Context, id string, version int, actor string) (*Product, error) {
+	return setArchived(ctx, id, version, actor, false)
+}
+
+func setArchived(ctx context.Context, id string, version int, actor string, archived bool) (*Product, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := lockProduct(ctx, tx, id, version)
+	if err != nil {
+		return nil, err
+	}
+
+	action, query := AuditRestore, `UPDATE products SET archived_at = NULL, version = version + 1 WHERE id = $1`
+	if archived {
+		action, query = AuditArchive, `UPDATE products SET archived_at = CURRENT_TIMESTAMP, version = version + 1 WHERE id = $1`
+	}
+	if _, err = tx.ExecContext(ctx, query, id); err != nil {
+		return nil, err
+	}
+
+	return commitProductChange(ctx, tx, action, actor, before)
+}
+
+// DeleteProduct removes a product and its inventory. Products that were ever
+// ordered or have reserved stock cannot be deleted, archive them instead.
+func DeleteProduct(ctx context.Context, id string, version int, actor string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := lockProduct(ctx, tx, id, version)
+	if err != nil {
+		return err
+	}
+
+	var ordered, reserved bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM order_items WHERE product_id = $1),
+		       EXISTS (SELECT 1 FROM inventory WHERE product_id = $1 AND reserved > 0)`, id,
+	).Scan(&ordered, &reserved)
+	if err != nil {
+		return err
+	}
+	if ordered {
+		return fmt.Errorf("product has orders")
+	}
+	if reserved {
+		return fmt.Errorf("product has reserved stock")
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM products WHERE id = $1`, id); err != nil {
+		return err
+	}
+
+	if err = recordAudit(ctx, tx, AuditDelete, actor, before, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetProductAudit retrieves the audit trail of a product, newest first. It is
+// kept after the product has been deleted.
+func GetProductAudit(ctx context.Context, productID string) ([]AuditEntry, error) {
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, product_id, action, actor, version, before, after, created_at
+		FROM product_audit_log
+		WHERE product_id = $1
+		ORDER BY id DESC`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		err := rows.Scan(&e.ID, &e.ProductID, &e.Action, &e.Actor, &e.Version, &before, &after, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		e.Before = before
+		e.After = after
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// lockProduct locks a product row for the rest of the transaction and checks
+// that it is still at the version the caller last read
+func lockProduct(ctx context.Context, tx *telemetry.Tx, id string, version int) (*Product, error) {
+	var current int
+	err := tx.QueryRowContext(ctx, `SELECT version FROM products WHERE id = $1 FOR UPDATE`, id).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("product not found")
+		}
+		return nil, err
+	}
+	if current != version {
+		return nil, fmt.Errorf("version conflict")
+	}
+	return getProductTx(ctx, tx, id)
+}
+
+// commitProductChange records the change from before to the current state of
+// the product and commits it
+func commitProductChange(ctx context.Context, tx *telemetry.Tx, action, actor string, before *Product) (*Product, error) {
+	after, err := getProductTx(ctx, tx, before.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = recordAudit(ctx, tx, action, actor, before, after); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return after, nil
+}
+
+func getProductTx(ctx context.Context, tx *telemetry.Tx, id string) (*Product, error) {
+	return scanProduct(tx.QueryRowContext(ctx, `SELECT `+productColumns+` FROM products WHERE id = $1`, id))
+}
+
+// syncInventoryVariants makes the inventory rows of a product match its sizes
+// and colors: new variants start without stock and dropped variants are
+// removed, unless they still have reserved units.
+func syncInventoryVariants(ctx context.Context, tx *telemetry.Tx, productID string, sizes, colors []string) error {
+	// Products without sizes or colors are stocked under the empty value,
+	// see validVariant
+	if len(sizes) == 0 {
+		sizes = []string{""}
+	}
+	if len(colors) == 0 {
+		colors = []string{""}
+	}
+
+	var reserved bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM inventory
+			WHERE product_id = $1 AND reserved > 0
+			  AND NOT (size = ANY($2) AND color = ANY($3))
+		)`, productID, pq.Array(sizes), pq.Array(colors)).Scan(&reserved)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return fmt.Errorf("variant has reserved stock")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM inventory
+		WHERE product_id = $1 AND NOT (size = ANY($2) AND color = ANY($3))`,
+		productID, pq.Array(sizes), pq.Array(colors))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO inventory (product_id, size, color)
+		SELECT $1, s.size, c.color
+		FROM unnest($2::text[]) AS s(size) CROSS JOIN unnest($3::text[]) AS c(color)
+		ON CONFLICT (product_id, size, color) DO NOTHING`,
+		productID, pq.Array(sizes), pq.Array(colors))
+	return err
+}
+
+// recordAudit appends a change to the audit log. before is nil for creations
+// and after is nil for deletions.
+func recordAudit(ctx context.Context, tx *telemetry.Tx, action, actor string, before, after *Product) error {
+	productID, version := "", 0
+	var beforeJSON, afterJSON interface{}
+	if before != nil {
+		productID, version = before.ID, before.Version
+		data, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		beforeJSON = string(data)
+	}
+	if after != nil {
+		productID, version = after.ID, after.Version
+		data, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		afterJSON = string(data)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO product_audit_log (product_id, action, actor, version, before, after)
+		VALUES ($1, $2, $3, $4, $5::jsonb, $6::jsonb)`,
+		productID, action, actor, version, beforeJSON, afterJSON)
+	return err
+}
@@ -1,16 +1,20 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"product-service/money"
+	"product-service/rates"
+	"product-service/telemetry"
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 )
 
 // DB is the global database connection
-var DB *sql.DB
+var DB *telemetry.DB
 
 // InitDB initializes the database connection
 func InitDB() {
@@ -27,17 +31,19 @@ func InitDB() {
 
 	// Open database connection
 	var err error
-	DB, err = sql.Open("postgres", psqlInfo)
+	DB, err = telemetry.OpenDB("postgres", psqlInfo, dbname)
 	if err != nil {
-		log.Fatal("Failed to open database:", err)
+		slog.Error("Failed to open database", "error", err)
+		os.Exit(1)
 	}
 
 	// Test the connection
-	if err = DB.Ping(); err != nil {
-		log.Fatal("Failed to ping database:", err)
+	if err = DB.PingContext(context.Background()); err != nil {
+		slog.Error("Failed to ping database", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Successfully connected to database!")
+	slog.Info("Successfully connected to database!")
 }
 
 // GetEnvOrDefault returns the environment variable value or a default value
@@ -56,24 +62,60 @@ func CloseDB() {
 }
 
 type Product struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	Category    string   `json:"category"`
-	Price       float64  `json:"price"`
-	Image       string   `json:"image"`
-	Description string   `json:"description"`
-	Rating      float64  `json:"rating"`
-	Reviews     int      `json:"reviews"`
-	Sizes       []string `json:"sizes"`
-	Colors      []string `json:"colors"`
-	InStock     bool     `json:"inStock"`
-	CreatedAt   string   `json:"createdAt"`
-	UpdatedAt   string   `json:"updatedAt"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Category    string      `json:"category"`
+	Price       money.Money `json:"price"`
+	Image       string      `json:"image"`
+	Description string      `json:"description"`
+	Rating      float64     `json:"rating"`
+	Reviews     int         `json:"reviews"`
+	Sizes       []string    `json:"sizes"`
+	Colors      []string    `json:"colors"`
+	InStock     bool        `json:"inStock"`
+	Version     int         `json:"version"`
+	ArchivedAt  string      `json:"archivedAt,omitempty"`
+	CreatedAt   string      `json:"createdAt"`
+	UpdatedAt   string      `json:"updatedAt"`
+	// ExchangeRate is set when Price was converted from the stored currency
+	ExchangeRate *rates.Rate `json:"exchangeRate,omitempty"`
 }
 
-// GetProducts retrieves products with optional category and search filters
-func GetProducts(category, search string) ([]Product, error) {
-	query := `SELECT id, name, category, price, image, description, rating, reviews, sizes, colors, in_stock, created_at, updated_at FROM products WHERE true`
+const productColumns = `id, name, category, price, image, description, rating, reviews, sizes, colors, ` + inStockColumn + `, version, archived_at, created_at, updated_at`
+
+// rowScanner is satisfied by both *telemetry.Row and *telemetry.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProduct(row rowScanner) (*Product, error) {
+	var p Product
+	var price string
+	var sizes, colors pq.StringArray
+	var archivedAt sql.NullString
+	err := row.Scan(
+		&p.ID, &p.Name, &p.Category, &price, &p.Image, &p.Description,
+		&p.Rating, &p.Reviews, &sizes, &colors, &p.InStock, &p.Version, &archivedAt,
+		&p.CreatedAt, &p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prices are stored in the default currency
+	if p.Price, err = money.Parse(price, money.DefaultCurrency); err != nil {
+		return nil, err
+	}
+	p.Sizes = []string(sizes)
+	p.Colors = []string(colors)
+	p.ArchivedAt = archivedAt.String
+	return &p, nil
+}
+
+// GetProducts retrieves products with optional category and search filters.
+// Archived products are not listed.
+func GetProducts(ctx context.Context, category, search string) ([]Product, error) {
+	query := `SELECT ` + productColumns + ` FROM products WHERE archived_at IS NULL`
 	var args []interface{}
 	argCount := 1
 
@@ -91,7 +133,7 @@ func GetProducts(category, search string) ([]Product, error) {
 
 	query += " ORDER BY created_at DESC"
 
-	rows, err := DB.Query(query, args...)
+	rows, err := DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -99,35 +141,22 @@ func GetProducts(category, search string) ([]Product, error) {
 
 	var products []Product
 	for rows.Next() {
-		var p Product
-		var sizes, colors pq.StringArray
-		err := rows.Scan(
-			&p.ID, &p.Name, &p.Category, &p.Price, &p.Image, &p.Description,
-			&p.Rating, &p.Reviews, &sizes, &colors, &p.InStock, &p.CreatedAt, &p.UpdatedAt,
-		)
+		p, err := scanProduct(rows)
 		if err != nil {
 			return nil, err
 		}
-
-		p.Sizes = []string(sizes)
-		p.Colors = []string(colors)
-
-		products = append(products, p)
+		products = append(products, *p)
 	}
 
 	return products, nil
 }
 
-// GetProductByID retrieves a product by its ID
-func GetProductByID(id string) (*Product, error) {
-	query := `SELECT id, name, category, price, image, description, rating, reviews, sizes, colors, in_stock, created_at, updated_at FROM products WHERE id = $1`
+// GetProductByID retrieves a product by its ID. Archived products are
+// returned too, since carts and orders may still refer to them.
+func GetProductByID(ctx context.Context, id string) (*Product, error) {
+	query := `SELECT ` + productColumns + ` FROM products WHERE id = $1`
 
-	var p Product
-	var sizes, colors pq.StringArray
-	err := DB.QueryRow(query, id).Scan(
-		&p.ID, &p.Name, &p.Category, &p.Price, &p.Image, &p.Description,
-		&p.Rating, &p.Reviews, &sizes, &colors, &p.InStock, &p.CreatedAt, &p.UpdatedAt,
-	)
+	p, err := scanProduct(DB.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("product not found")
@@ -135,17 +164,14 @@ func GetProductByID(id string) (*Product, error) {
 		return nil, err
 	}
 
-	p.Sizes = []string(sizes)
-	p.Colors = []string(colors)
-
-	return &p, nil
+	return p, nil
 }
 
 // GetCategories retrieves all unique categories
-func GetCategories() ([]string, error) {
-	query := `SELECT DISTINCT category FROM products ORDER BY category`
+func GetCategories(ctx context.Context) ([]string, error) {
+	query := `SELECT DISTINCT category FROM products WHERE archived_at IS NULL ORDER BY category`
 
-	rows, err := DB.Query(query)
+	rows, err := DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -164,28 +190,9 @@ func GetCategories() ([]string, error) {
 	return categories, nil
 }
 
-// UpdateStock updates the stock quantity for a product
-func UpdateStock(productID string, quantity int) error {
-	// For this implementation, we'll just check if the product exists
-	// In a real application, you'd want to update an inventory table
-	query := `SELECT id FROM products WHERE id = $1`
-	var id string
-	err := DB.QueryRow(query, productID).Scan(&id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("product not found")
-		}
-		return err
-	}
-
-	// In a real implementation, you would update the stock in a separate inventory table
-	// For now, we'll just return nil to indicate success
-	return nil
-}
-
 // SearchProducts searches for products based on query and price range
-func SearchProducts(query, minPrice, maxPrice string) ([]Product, error) {
-	baseQuery := `SELECT id, name, category, price, image, description, rating, reviews, sizes, colors, in_stock, created_at, updated_at FROM products WHERE true`
+func SearchProducts(ctx context.Context, query, minPrice, maxPrice string) ([]Product, error) {
+	baseQuery := `SELECT ` + productColumns + ` FROM products WHERE archived_at IS NULL`
 	var args []interface{}
 	argCount := 1
 
@@ -209,7 +216,7 @@ func SearchProducts(query, minPrice, maxPrice string) ([]Product, error) {
 
 	baseQuery += " ORDER BY created_at DESC"
 
-	rows, err := DB.Query(baseQuery, args...)
+	rows, err := DB.QueryContext(ctx, baseQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -217,20 +224,11 @@ func SearchProducts(query, minPrice, maxPrice string) ([]Product, error) {
 
 	var products []Product
 	for rows.Next() {
-		var p Product
-		var sizes, colors pq.StringArray
-		err := rows.Scan(
-			&p.ID, &p.Name, &p.Category, &p.Price, &p.Image, &p.Description,
-			&p.Rating, &p.Reviews, &sizes, &colors, &p.InStock, &p.CreatedAt, &p.UpdatedAt,
-		)
+		p, err := scanProduct(rows)
 		if err != nil {
 			return nil, err
 		}
-
-		p.Sizes = []string(sizes)
-		p.Colors = []string(colors)
-
-		products = append(products, p)
+		products = append(products, *p)
 	}
 
 	return products, nil
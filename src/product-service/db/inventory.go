@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// StockLevel is the inventory of a single product variant (size + color)
+type StockLevel struct {
+	ProductID string `json:"productId"`
+	Size      string `json:"size"`
+	Color     string `json:"color"`
+	OnHand    int    `json:"onHand"`
+	Reserved  int    `json:"reserved"`
+	Available int    `json:"available"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// inStockColumn derives products.in_stock from the inventory table: a product
+// is in stock when at least one of its variants has unreserved units left.
+const inStockColumn = `EXISTS (SELECT 1 FROM inventory i WHERE i.product_id = products.id AND i.on_hand > i.reserved)`
+
+// GetStockLevels retrieves the stock of every variant of a product
+func GetStockLevels(ctx context.Context, productID string) ([]StockLevel, error) {
+	if _, _, err := getProductVariants(ctx, productID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT product_id, size, color, on_hand, reserved, updated_at
+		FROM inventory
+		WHERE product_id = $1
+		ORDER BY size, color`
+
+	rows, err := DB.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := []StockLevel{}
+	for rows.Next() {
+		var s StockLevel
+		err := rows.Scan(&s.ProductID, &s.Size, &s.Color, &s.OnHand, &s.Reserved, &s.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		s.Available = s.OnHand - s.Reserved
+		levels = append(levels, s)
+	}
+
+	return levels, rows.Err()
+}
+
+// UpdateStock atomically adjusts the on-hand quantity of a product variant by
+// delta. A positive delta receives stock, a negative delta removes it. The
+// update is refused with "insufficient stock" if it would leave fewer units on
+// hand than are currently reserved.
+func UpdateStock(ctx context.Context, productID, size, color string, delta int) (*StockLevel, error) {
+	sizes, colors, err := getProductVariants(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if !validVariant(sizes, size) || !validVariant(colors, color) {
+		return nil, fmt.Errorf("invalid product variant")
+	}
+
+	var query string
+	if delta >= 0 {
+		query = `
+			INSERT INTO inventory (product_id, size, color, on_hand)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (product_id, size, color)
+			DO UPDATE SET on_hand = inventory.on_hand + EXCLUDED.on_hand
+			RETURNING product_id, size, color, on_hand, reserved, updated_at`
+	} else {
+		query = `
+			UPDATE inventory
+			SET on_hand = on_hand + $4
+			WHERE product_id = $1 AND size = $2 AND color = $3
+			  AND on_hand + $4 >= reserved
+			RETURNING product_id, size, color, on_hand, reserved, updated_at`
+	}
+
+	var s StockLevel
+	err = DB.QueryRowContext(ctx, query, productID, size, color, delta).Scan(
+		&s.ProductID, &s.Size, &s.Color, &s.OnHand, &s.Reserved, &s.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("insufficient stock")
+		}
+		return nil, err
+	}
+
+	s.Available = s.OnHand - s.Reserved
+	return &s, nil
+}
+
+// getProductVariants returns the sizes and colors a product is offered in
+func getProductVariants(ctx context.Context, productID string) ([]string, []string, error) {
+	query := `SELECT sizes, colors FROM products WHERE id = $1`
+
+	var sizes, colors pq.StringArray
+	err := DB.QueryRowContext(ctx, query, productID).Scan(&sizes, &colors)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("product not found")
+		}
+		return nil, nil, err
+	}
+
+	return []string(sizes), []string(colors), nil
+}
+
+// validVariant reports whether value is one of the allowed options. Products
+// without any options only accept the empty value.
+func validVariant(options []string, value string) bool {
+	if len(options) == 0 {
+		return value == ""
+	}
+	for _, o := range options {
+		if o == value {
+			return true
+		}
+	}
+	return false
+}
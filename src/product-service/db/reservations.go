@@ -0,0 +1,416 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"product-service/telemetry"
+)
+
+// Reservation statuses
+const (
+	ReservationActive    = "active"
+	ReservationConfirmed = "confirmed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+type ReservationItem struct {
+	ProductID string `json:"productId"`
+	Size      string `json:"size"`
+	Color     string `json:"color"`
+	Quantity  int    `json:"quantity"`
+}
+
+type Reservation struct {
+	ID        string            `json:"id"`
+	Reference string            `json:"reference"`
+	Status    string            `json:"status"`
+	Items     []ReservationItem `json:"items"`
+	ExpiresAt string            `json:"expiresAt"`
+	CreatedAt string            `json:"createdAt"`
+	UpdatedAt string            `json:"updatedAt"`
+}
+
+// CreateReservation holds stock for all items until ttl elapses. Either every
+// item is reserved or none is; the whole reservation fails with
+// "insufficient stock" if any variant cannot cover its quantity.
+func CreateReservation(ctx context.Context, reference string, items []ReservationItem, ttl time.Duration) (*Reservation, error) {
+	items, err := mergeReservationItems(items)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Items are sorted by primary key so concurrent reservations lock
+	// inventory rows in the same order and cannot deadlock.
+	for _, item := range items {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE inventory
+			SET reserved = reserved + $4
+			WHERE product_id = $1 AND size = $2 AND color = $3
+			  AND on_hand - reserved >= $4`,
+			item.ProductID, item.Size, item.Color, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, fmt.Errorf("insufficient stock")
+		}
+	}
+
+	reservation := Reservation{Items: items}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO stock_reservations (id, reference, status, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')
+		RETURNING id, reference, status, expires_at, created_at, updated_at`,
+		generateReservationID(), reference, ReservationActive, int64(ttl.Seconds()),
+	).Scan(
+		&reservation.ID, &reservation.Reference, &reservation.Status,
+		&reservation.ExpiresAt, &reservation.CreatedAt, &reservation.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO stock_reservation_items (reservation_id, product_id, size, color, quantity)
+			VALUES ($1, $2, $3, $4, $5)`,
+			reservation.ID, item.ProductID, item.Size, item.Color, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &reservation, nil
+}
+
+// GetReservation retrieves a reservation by its ID
+func GetReservation(ctx context.Context, id string) (*Reservation, error) {
+	query := `SELECT id, reference, status, expires_at, created_at, updated_at FROM stock_reservations WHERE id = $1`
+
+	var r Reservation
+	err := DB.QueryRowContext(ctx, query, id).Scan(
+		&r.ID, &r.Reference, &r.Status, &r.ExpiresAt, &r.CreatedAt, &r.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("reservation not found")
+		}
+		return nil, err
+	}
+
+	r.Items, err = getReservationItems(ctx, DB, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// ConfirmReservation turns a reservation into a permanent stock decrement.
+// Confirming an already confirmed reservation is a no-op. A reservation that
+// has expired but not yet been swept is released and reported as expired.
+func ConfirmReservation(ctx context.Context, id string) (*Reservation, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status, expired, err := lockReservation(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case status == ReservationConfirmed:
+		tx.Rollback()
+		return GetReservation(ctx, id)
+	case status != ReservationActive:
+		return nil, fmt.Errorf("reservation is not active")
+	case expired:
+		if err = releaseReservation(ctx, tx, id, ReservationExpired); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("reservation expired")
+	}
+
+	items, err := getReservationItems(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE inventory
+			SET on_hand = on_hand - $4, reserved = reserved - $4
+			WHERE product_id = $1 AND size = $2 AND color = $3`,
+			item.ProductID, item.Size, item.Color, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE stock_reservations SET status = $1 WHERE id = $2`, ReservationConfirmed, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetReservation(ctx, id)
+}
+
+// ExtendReservation holds the stock of an active reservation until ttl from
+// now. A reservation that has expired but not yet been swept is released and
+// reported as expired.
+func ExtendReservation(ctx context.Context, id string, ttl time.Duration) (*Reservation, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status, expired, err := lockReservation(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case status != ReservationActive:
+		return nil, fmt.Errorf("reservation is not active")
+	case expired:
+		if err = releaseReservation(ctx, tx, id, ReservationExpired); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("reservation expired")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE stock_reservations
+		SET expires_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+		WHERE id = $1`, id, int64(ttl.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetReservation(ctx, id)
+}
+
+// ReleaseReservation returns the held stock of an active reservation.
+// Releasing a reservation that is already released or expired is a no-op.
+func ReleaseReservation(ctx context.Context, id string) (*Reservation, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status, _, err := lockReservation(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case ReservationReleased, ReservationExpired:
+		tx.Rollback()
+		return GetReservation(ctx, id)
+	case ReservationConfirmed:
+		return nil, fmt.Errorf("reservation already confirmed")
+	}
+
+	if err = releaseReservation(ctx, tx, id, ReservationReleased); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetReservation(ctx, id)
+}
+
+// ReleaseExpiredReservations releases up to limit active reservations whose
+// TTL has elapsed and returns how many were released. Rows locked by another
+// replica's sweeper are skipped.
+func ReleaseExpiredReservations(ctx context.Context, limit int) (int, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM stock_reservations
+		WHERE status = $1 AND expires_at < CURRENT_TIMESTAMP
+		ORDER BY expires_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`, ReservationActive, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err = releaseReservation(ctx, tx, id, ReservationExpired); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
+
+// lockReservation locks a reservation row for the rest of the transaction and
+// returns its status and whether its TTL has elapsed
+func lockReservation(ctx context.Context, tx *telemetry.Tx, id string) (string, bool, error) {
+	var status string
+	var expired bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT status, expires_at < CURRENT_TIMESTAMP
+		FROM stock_reservations
+		WHERE id = $1
+		FOR UPDATE`, id).Scan(&status, &expired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, fmt.Errorf("reservation not found")
+		}
+		return "", false, err
+	}
+	return status, expired, nil
+}
+
+// releaseReservation gives the reserved units back to inventory and moves the
+// reservation to the given final status
+func releaseReservation(ctx context.Context, tx *telemetry.Tx, id, status string) error {
+	items, err := getReservationItems(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE inventory
+			SET reserved = reserved - $4
+			WHERE product_id = $1 AND size = $2 AND color = $3`,
+			item.ProductID, item.Size, item.Color, item.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE stock_reservations SET status = $1 WHERE id = $2`, status, id)
+	return err
+}
+
+// queryer is satisfied by both *telemetry.DB and *telemetry.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*telemetry.Rows, error)
+}
+
+// getReservationItems retrieves the items held by a reservation
+func getReservationItems(ctx context.Context, q queryer, reservationID string) ([]ReservationItem, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT product_id, size, color, quantity
+		FROM stock_reservation_items
+		WHERE reservation_id = $1
+		ORDER BY product_id, size, color`, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ReservationItem{}
+	for rows.Next() {
+		var item ReservationItem
+		if err := rows.Scan(&item.ProductID, &item.Size, &item.Color, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// mergeReservationItems validates the requested items, combines duplicates of
+// the same variant and sorts them by inventory primary key
+func mergeReservationItems(items []ReservationItem) ([]ReservationItem, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("reservation has no items")
+	}
+
+	type variant struct{ productID, size, color string }
+	merged := map[variant]int{}
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("invalid quantity")
+		}
+		merged[variant{item.ProductID, item.Size, item.Color}] += item.Quantity
+	}
+
+	result := make([]ReservationItem, 0, len(merged))
+	for v, qty := range merged {
+		result = append(result, ReservationItem{ProductID: v.productID, Size: v.size, Color: v.color, Quantity: qty})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.ProductID != b.ProductID {
+			return a.ProductID < b.ProductID
+		}
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+		return a.Color < b.Color
+	})
+
+	return result, nil
+}
+
+// generateReservationID generates a unique reservation ID
+func generateReservationID() string {
+	return fmt.Sprintf("res_%d", time.Now().UnixNano())
+}
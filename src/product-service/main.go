@@ -4,9 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"product-service/auth"
 	"product-service/db"
 	"product-service/telemetry"
 
@@ -14,13 +19,18 @@ import (
 	flagd "github.com/open-feature/go-sdk-contrib/providers/flagd/pkg"
 	"github.com/open-feature/go-sdk/openfeature"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, Accept-Currency")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -42,14 +52,23 @@ func getAllProducts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	currency, ok := requestedCurrency(w, r)
+	if !ok {
+		return
+	}
+
 	category := r.URL.Query().Get("category")
 	search := r.URL.Query().Get("search")
 
-	products, err := db.GetProducts(category, search)
+	products, err := db.GetProducts(r.Context(), category, search)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err = convertPrices(r.Context(), products, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	json.NewEncoder(w).Encode(products)
 }
@@ -59,7 +78,12 @@ func getProductByID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	product, err := db.GetProductByID(id)
+	currency, ok := requestedCurrency(w, r)
+	if !ok {
+		return
+	}
+
+	product, err := db.GetProductByID(r.Context(), id)
 	if err != nil {
 		if err.Error() == "product not found" {
 			w.WriteHeader(http.StatusNotFound)
@@ -69,14 +93,21 @@ func getProductByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	converted := []db.Product{*product}
+	if err = convertPrices(r.Context(), converted, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	product = &converted[0]
 
+	setETag(w, product)
 	json.NewEncoder(w).Encode(product)
 }
 
 func getCategories(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	categories, err := db.GetCategories()
+	categories, err := db.GetCategories(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -85,45 +116,275 @@ func getCategories(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(categories)
 }
 
+func getStockLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	levels, err := db.GetStockLevels(r.Context(), id)
+	if err != nil {
+		if err.Error() == "product not found" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(levels)
+}
+
 func updateStock(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	var req map[string]interface{}
-	json.NewDecoder(r.Body).Decode(&req)
+	// Quantity is a signed delta: positive to receive stock, negative to remove it
+	var req struct {
+		ProductID string `json:"productId"`
+		Size      string `json:"size"`
+		Color     string `json:"color"`
+		Quantity  int    `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	productID := req["productId"].(string)
-	quantity := int(req["quantity"].(float64))
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("product.id", req.ProductID),
+		attribute.String("product.size", req.Size),
+		attribute.String("product.color", req.Color),
+		attribute.Int("stock.delta", req.Quantity),
+	)
 
-	err := db.UpdateStock(productID, quantity)
+	level, err := db.UpdateStock(r.Context(), req.ProductID, req.Size, req.Color, req.Quantity)
 	if err != nil {
+		switch err.Error() {
+		case "product not found":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+		case "invalid product variant":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid size or color for this product"})
+		case "insufficient stock":
+			span.AddEvent("stock.insufficient")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient stock"})
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	span.SetAttributes(attribute.Int("stock.available", level.Available))
+	if level.Available == 0 {
+		span.AddEvent("stock.depleted")
+	}
+
+	json.NewEncoder(w).Encode(level)
+}
+
+// reservationTTL is how long stock stays reserved when the caller does not ask
+// for a specific TTL
+var reservationTTL = 15 * time.Minute
+
+// maxReservationTTL is the longest TTL a caller may ask for, so that stock
+// cannot be held indefinitely
+const maxReservationTTL = time.Hour
+
+// maxReservationExtension is the longest a reservation can be extended for,
+// e.g. while its checkout waits for a fraud review
+const maxReservationExtension = 7 * 24 * time.Hour
+
+func writeReservationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.Error() {
+	case "reservation not found":
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Reservation not found"})
+	case "reservation has no items", "invalid quantity":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	case "insufficient stock":
+		trace.SpanFromContext(r.Context()).AddEvent("stock.insufficient")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient stock"})
+	case "reservation expired", "reservation is not active", "reservation already confirmed":
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func createReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		Reference  string               `json:"reference"`
+		Items      []db.ReservationItem `json:"items"`
+		TTLSeconds int                  `json:"ttlSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := reservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(min(req.TTLSeconds, int(maxReservationTTL/time.Second))) * time.Second
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("reservation.reference", req.Reference),
+		attribute.Int("reservation.items", len(req.Items)),
+	)
+
+	reservation, err := db.CreateReservation(r.Context(), req.Reference, req.Items, ttl)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+
+	span.SetAttributes(attribute.String("reservation.id", reservation.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func getReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+
+	reservation, err := db.GetReservation(r.Context(), vars["reservationId"])
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func confirmReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("reservation.id", vars["reservationId"]))
+
+	reservation, err := db.ConfirmReservation(r.Context(), vars["reservationId"])
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func extendReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("reservation.id", vars["reservationId"]))
+
+	var req struct {
+		TTLSeconds int `json:"ttlSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLSeconds <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "ttlSeconds must be positive"})
+		return
+	}
+	ttl := time.Duration(min(req.TTLSeconds, int(maxReservationExtension/time.Second))) * time.Second
+
+	reservation, err := db.ExtendReservation(r.Context(), vars["reservationId"], ttl)
+	if err != nil {
+		writeReservationError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func releaseReservation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("reservation.id", vars["reservationId"]))
+
+	reservation, err := db.ReleaseReservation(r.Context(), vars["reservationId"])
+	if err != nil {
+		writeReservationError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	json.NewEncoder(w).Encode(reservation)
+}
+
+// sweepExpiredReservations periodically releases reservations whose TTL has
+// elapsed, e.g. from abandoned checkouts, until ctx is cancelled
+func sweepExpiredReservations(ctx context.Context, interval time.Duration) {
+	tracer := otel.Tracer("product-service")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sweepCtx, span := tracer.Start(ctx, "reservations.sweep")
+		released, err := db.ReleaseExpiredReservations(sweepCtx, 100)
+		if err != nil {
+			slog.ErrorContext(sweepCtx, "Reservation sweeper failed", "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if released > 0 {
+			slog.InfoContext(sweepCtx, "Reservation sweeper released expired reservations", "released", released)
+		}
+		span.SetAttributes(attribute.Int("reservations.released", released))
+		span.End()
+	}
 }
 
 func searchProducts(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	currency, ok := requestedCurrency(w, r)
+	if !ok {
+		return
+	}
+
+	// The price range is given in the requested currency
 	query := r.URL.Query().Get("q")
-	minPrice := r.URL.Query().Get("minPrice")
-	maxPrice := r.URL.Query().Get("maxPrice")
+	minPrice, err := toDefaultCurrency(r.Context(), r.URL.Query().Get("minPrice"), currency)
+	if err != nil {
+		writePriceFilterError(w, err)
+		return
+	}
+	maxPrice, err := toDefaultCurrency(r.Context(), r.URL.Query().Get("maxPrice"), currency)
+	if err != nil {
+		writePriceFilterError(w, err)
+		return
+	}
 
-	products, err := db.SearchProducts(query, minPrice, maxPrice)
+	products, err := db.SearchProducts(r.Context(), query, minPrice, maxPrice)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err = convertPrices(r.Context(), products, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	json.NewEncoder(w).Encode(products)
 }
 
 func main() {
-	// Initialize OpenTelemetry
+	// Initialize OpenTelemetry. Logs are JSON from here on, and scrubbed of
+	// card numbers whatever ends up in a message.
 	ctx := context.Background()
-	shutdownTracer := telemetry.InitTracer(ctx)
-	defer shutdownTracer(ctx)
+	shutdownTelemetry := telemetry.Init(ctx)
+	defer shutdownTelemetry(ctx)
 
 	// Initialize OpenFeature provider
 	provider, err := flagd.NewProvider(
@@ -131,7 +392,7 @@ func main() {
 		flagd.WithPort(8013),
 	)
 	if err != nil {
-		log.Printf("Warning: Failed to create flagd provider: %v", err)
+		slog.Warn("Failed to create flagd provider", "error", err)
 	} else {
 		openfeature.SetProvider(provider)
 	}
@@ -139,15 +400,52 @@ func main() {
 	db.InitDB()
 	defer db.CloseDB()
 
+	if err := auth.Init(); err != nil {
+		slog.Error("Failed to initialize auth", "error", err)
+		os.Exit(1)
+	}
+	initRates()
+
+	if ttl, err := time.ParseDuration(db.GetEnvOrDefault("RESERVATION_TTL", "15m")); err == nil {
+		reservationTTL = ttl
+	} else {
+		slog.Warn("Invalid RESERVATION_TTL, using the default", "ttl", reservationTTL.String(), "error", err)
+	}
+
+	sweepInterval, err := time.ParseDuration(db.GetEnvOrDefault("RESERVATION_SWEEP_INTERVAL", "30s"))
+	if err != nil {
+		slog.Warn("Invalid RESERVATION_SWEEP_INTERVAL, using 30s", "error", err)
+		sweepInterval = 30 * time.Second
+	}
+	sweepCtx, stopSweeper := context.WithCancel(ctx)
+	defer stopSweeper()
+	go sweepExpiredReservations(sweepCtx, sweepInterval)
+
 	r := mux.NewRouter()
 
 	r.Use(enableCORS)
+	r.Use(auth.Middleware)
 
 	r.HandleFunc("/api/products", getAllProducts).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/products/{id}", getProductByID).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/products/{id}/stock", getStockLevels).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/categories", getCategories).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/currencies", getCurrencies).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/search", searchProducts).Methods("GET", "OPTIONS")
-	r.HandleFunc("/api/stock/update", updateStock).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/stock/update", auth.RequireRole(updateStock, auth.RoleAdmin, auth.RoleService)).Methods("POST", "OPTIONS")
+
+	r.HandleFunc("/api/admin/products", auth.RequireRole(createProduct, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/admin/products/{id}", auth.RequireRole(updateProduct, auth.RoleAdmin)).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/api/admin/products/{id}", auth.RequireRole(deleteProduct, auth.RoleAdmin)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/admin/products/{id}/archive", auth.RequireRole(archiveProduct, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/admin/products/{id}/restore", auth.RequireRole(restoreProduct, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/admin/products/{id}/audit", auth.RequireRole(getProductAudit, auth.RoleAdmin)).Methods("GET", "OPTIONS")
+
+	r.HandleFunc("/api/reservations", auth.RequireRole(createReservation, auth.RoleService, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/reservations/{reservationId}", auth.RequireRole(getReservation, auth.RoleService, auth.RoleAdmin)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/reservations/{reservationId}/confirm", auth.RequireRole(confirmReservation, auth.RoleService, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/reservations/{reservationId}/extend", auth.RequireRole(extendReservation, auth.RoleService, auth.RoleAdmin)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/reservations/{reservationId}/release", auth.RequireRole(releaseReservation, auth.RoleService, auth.RoleAdmin)).Methods("POST", "OPTIONS")
 
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -155,7 +453,25 @@ func main() {
 	}).Methods("GET", "OPTIONS")
 
 	port := "8001"
-	fmt.Printf("Product Service running on http://localhost:%s\n", port)
+	slog.Info("Product Service running", "url", "http://localhost:"+port)
 	handler := otelhttp.NewHandler(r, "product-service")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), handler))
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGTERM finish the requests in flight, then flush logs, traces and
+	// metrics through the deferred shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down the server", "error", err)
+	}
 }
@@ -0,0 +1,102 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// HTTP fetches rates from an exchange-rate API such as frankfurter.app and
+// caches them for TTL. When the API fails, the last rates it returned are
+// served, or those of Fallback if it never answered.
+type HTTP struct {
+	URL        string
+	TTL        time.Duration
+	Fallback   Source
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	table     *Table
+	fetchedAt time.Time
+	failedAt  time.Time
+	lastErr   error
+}
+
+// retryInterval is how long the API is not asked again after it failed
+const retryInterval = time.Minute
+
+// NewHTTP creates an HTTP source for url, e.g.
+// https://api.frankfurter.app/latest?from=USD. Requests are traced.
+func NewHTTP(url string, ttl time.Duration, fallback Source) *HTTP {
+	return &HTTP{
+		URL:      url,
+		TTL:      ttl,
+		Fallback: fallback,
+		HTTPClient: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   5 * time.Second,
+		},
+	}
+}
+
+func (h *HTTP) Name() string { return "http:" + h.URL }
+
+func (h *HTTP) Table(ctx context.Context) (*Table, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.table != nil && time.Since(h.fetchedAt) < h.TTL {
+		return h.table, nil
+	}
+
+	// After a failure the API is left alone for a while rather than being
+	// asked again on every request
+	err := h.lastErr
+	if time.Since(h.failedAt) >= retryInterval {
+		var table *Table
+		if table, err = h.fetch(ctx); err == nil {
+			h.table, h.fetchedAt, h.lastErr = table, time.Now(), nil
+			return table, nil
+		}
+		slog.WarnContext(ctx, "Exchange rates: Failed to fetch", "url", h.URL, "error", err)
+		h.failedAt, h.lastErr = time.Now(), err
+	}
+
+	switch {
+	case h.table != nil:
+		return h.table, nil
+	case h.Fallback != nil:
+		return h.Fallback.Table(ctx)
+	default:
+		return nil, err
+	}
+}
+
+func (h *HTTP) fetch(ctx context.Context) (*Table, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := h.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseTable(data, h.Name())
+}
@@ -0,0 +1,166 @@
+// Package rates converts catalog prices, which are stored in
+// money.DefaultCurrency, to the currency a shopper asks for. Rates come from
+// a Source: Static reads them from a file and works offline, HTTP fetches
+// them from an exchange-rate API and falls back to another source when the
+// API cannot be reached.
+package rates
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"product-service/money"
+)
+
+// Table holds the rates of a source as units of each currency per unit of
+// Base
+type Table struct {
+	Base   string             `json:"base"`
+	Rates  map[string]float64 `json:"rates"`
+	Source string             `json:"-"`
+	AsOf   time.Time          `json:"-"`
+}
+
+// Source provides the current rates
+type Source interface {
+	// Name identifies the source in responses and spans
+	Name() string
+	Table(ctx context.Context) (*Table, error)
+}
+
+// Rate is the rate an amount was converted with, so that callers can record
+// it
+type Rate struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Rate   float64   `json:"rate"`
+	Source string    `json:"source"`
+	AsOf   time.Time `json:"asOf"`
+}
+
+// Converter converts amounts with the rates of a source
+type Converter struct {
+	Source Source
+}
+
+// NewConverter creates a converter for source
+func NewConverter(source Source) *Converter {
+	return &Converter{Source: source}
+}
+
+// Supported reports whether amounts can be converted to currency
+func (c *Converter) Supported(ctx context.Context, currency string) (bool, error) {
+	currency = strings.ToUpper(currency)
+	if currency == money.DefaultCurrency {
+		return true, nil
+	}
+	table, err := c.Source.Table(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, ok := table.rate(currency)
+	return ok, nil
+}
+
+// Currencies lists the currencies amounts can be converted to
+func (c *Converter) Currencies(ctx context.Context) ([]string, error) {
+	table, err := c.Source.Table(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	currencies := []string{table.Base}
+	for currency := range table.Rates {
+		if currency != table.Base {
+			currencies = append(currencies, currency)
+		}
+	}
+	sort.Strings(currencies)
+	return currencies, nil
+}
+
+// Rate returns the rate from one currency to another. It fails with
+// "unsupported currency" if the source has no rate for either.
+func (c *Converter) Rate(ctx context.Context, from, to string) (*Rate, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	table, err := c.Source.Table(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fromRate, ok := table.rate(from)
+	if !ok {
+		return nil, fmt.Errorf("unsupported currency")
+	}
+	toRate, ok := table.rate(to)
+	if !ok {
+		return nil, fmt.Errorf("unsupported currency")
+	}
+
+	return &Rate{
+		From:   from,
+		To:     to,
+		Rate:   toRate / fromRate,
+		Source: table.Source,
+		AsOf:   table.AsOf,
+	}, nil
+}
+
+// Convert converts amount to currency, rounding to the currency's minor unit.
+// The rate is nil when amount already is in currency.
+func (c *Converter) Convert(ctx context.Context, amount money.Money, currency string) (money.Money, *Rate, error) {
+	if strings.EqualFold(amount.Currency, currency) {
+		return amount, nil, nil
+	}
+	rate, err := c.Rate(ctx, amount.Currency, currency)
+	if err != nil {
+		return money.Money{}, nil, err
+	}
+	return rate.Apply(amount), rate, nil
+}
+
+// Apply converts amount, which must be in r.From
+func (r *Rate) Apply(amount money.Money) money.Money {
+	return money.FromFloat(amount.Float64()*r.Rate, r.To)
+}
+
+// rate returns the rate of currency against the base
+func (t *Table) rate(currency string) (float64, bool) {
+	if currency == t.Base {
+		return 1, true
+	}
+	rate, ok := t.Rates[currency]
+	return rate, ok
+}
+
+// validate normalizes the currency codes of a table and leaves out the
+// currencies prices cannot be served in. A rate that is not positive rejects
+// the table as a whole.
+func (t *Table) validate() error {
+	t.Base = strings.ToUpper(t.Base)
+	if !money.Supported(t.Base) {
+		return fmt.Errorf("unsupported base currency %q", t.Base)
+	}
+
+	rates := make(map[string]float64, len(t.Rates))
+	for currency, rate := range t.Rates {
+		currency = strings.ToUpper(currency)
+		// Carts and orders store prices in DECIMAL(10, 2) columns
+		if !money.Storable(currency) {
+			continue
+		}
+		if rate <= 0 {
+			return fmt.Errorf("rate of %s must be positive", currency)
+		}
+		rates[currency] = rate
+	}
+	t.Rates = rates
+
+	if _, ok := t.rate(money.DefaultCurrency); !ok {
+		return fmt.Errorf("no rate for %s", money.DefaultCurrency)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package rates
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultRates are the rates used when no rates file is configured, so the
+// catalog can be served in other currencies offline
+//
+//go:embed default_rates.json
+var defaultRates []byte
+
+// Static serves a fixed table of rates
+type Static struct {
+	name  string
+	table *Table
+}
+
+// NewStatic reads a rates file, or the built-in rates if path is empty. The
+// file has the format of the HTTP source:
+//
+//	{"base": "USD", "date": "2026-10-01", "rates": {"EUR": 0.92}}
+func NewStatic(path string) (*Static, error) {
+	data, name := defaultRates, "static:default"
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		name = "static:" + path
+	}
+
+	table, err := parseTable(data, name)
+	if err != nil {
+		return nil, fmt.Errorf("rates file %s: %w", name, err)
+	}
+	return &Static{name: name, table: table}, nil
+}
+
+func (s *Static) Name() string { return s.name }
+
+func (s *Static) Table(ctx context.Context) (*Table, error) {
+	return s.table, nil
+}
+
+// parseTable reads rates in the format of frankfurter.app and similar APIs
+func parseTable(data []byte, source string) (*Table, error) {
+	var in struct {
+		Table
+		Date string `json:"date"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+
+	table := in.Table
+	table.Source = source
+	if in.Date != "" {
+		asOf, err := time.Parse("2006-01-02", in.Date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", in.Date)
+		}
+		table.AsOf = asOf
+	}
+	if err := table.validate(); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
@@ -2,63 +2,78 @@ package telemetry
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"strings"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
-// InitTracer initializes the OpenTelemetry tracer with OTLP HTTP exporter.
-// It reads OTEL_SERVICE_NAME and OTEL_EXPORTER_OTLP_ENDPOINT from environment.
-// Returns a shutdown function that should be deferred in main().
-func InitTracer(ctx context.Context) func(context.Context) error {
-	serviceName := os.Getenv("OTEL_SERVICE_NAME")
-	if serviceName == "" {
-		serviceName = "unknown-service"
+// Init initializes logs, traces and metrics, see InitLogger, InitTracer and
+// InitMeter. The returned shutdown function flushes all three and should be
+// deferred in main().
+func Init(ctx context.Context) func(context.Context) error {
+	shutdownLogger := InitLogger(ctx)
+	shutdownTracer := InitTracer(ctx)
+	shutdownMeter := InitMeter(ctx)
+	return func(ctx context.Context) error {
+		return errors.Join(shutdownTracer(ctx), shutdownMeter(ctx), shutdownLogger(ctx))
 	}
+}
 
-	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "otel-collector-collector.observability:4318"
+// Trace exporters, see OTEL_TRACES_EXPORTER
+const (
+	exporterOTLP    = "otlp"
+	exporterConsole = "console"
+	exporterFile    = "file"
+	exporterNone    = "none"
+)
+
+// InitTracer initializes the OpenTelemetry tracer provider. Spans are
+// exported with the exporter of OTEL_TRACES_EXPORTER: otlp (default) over
+// OTEL_EXPORTER_OTLP_PROTOCOL, see otlp.go; console, which prints them to
+// stdout; file, which writes them as JSON lines to OTEL_TRACES_FILE
+// (traces.jsonl by default) for offline debugging; or none. The SDK samples
+// with OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG, e.g.
+// parentbased_traceidratio and 0.1 to keep a tenth of the traces started
+// here and follow the caller's decision otherwise; every trace is kept by
+// default. Returns a shutdown function that should be deferred in main().
+func InitTracer(ctx context.Context) func(context.Context) error {
+	name := strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER"))
+	if name == "" {
+		name = exporterOTLP
 	}
-	// Strip http:// or https:// prefix if present - WithEndpoint expects host:port
-	endpoint = strings.TrimPrefix(endpoint, "http://")
-	endpoint = strings.TrimPrefix(endpoint, "https://")
-
-	// Create OTLP HTTP exporter
-	exporter, err := otlptracehttp.New(ctx,
-		otlptracehttp.WithEndpoint(endpoint),
-		otlptracehttp.WithInsecure(),
-	)
+
+	protocol := otlpProtocol("traces")
+	exporter, err := newTraceExporter(ctx, name, protocol)
 	if err != nil {
-		log.Printf("Failed to create OTLP exporter: %v", err)
+		slog.Error("Failed to create trace exporter", "exporter", name, "error", err)
 		return func(context.Context) error { return nil }
 	}
 
-	// Create resource with service name
-	res, err := resource.Merge(
-		resource.Default(),
-		resource.NewWithAttributes(
-			"",
-			semconv.ServiceName(serviceName),
-		),
-	)
+	res, err := newResource()
 	if err != nil {
-		log.Printf("Failed to create resource: %v", err)
+		slog.Error("Failed to create resource", "error", err)
 		return func(context.Context) error { return nil }
 	}
 
-	// Create tracer provider
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),
-		sdktrace.WithResource(res),
-	)
+	// Create tracer provider; spans are scrubbed of card numbers on export.
+	// Without an exporter spans are still created, so that logs carry
+	// their IDs.
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(redactingExporter{exporter}))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
 
 	// Set global tracer provider and propagator
 	otel.SetTracerProvider(tp)
@@ -67,7 +82,92 @@ func InitTracer(ctx context.Context) func(context.Context) error {
 		propagation.Baggage{},
 	))
 
-	log.Printf("OpenTelemetry initialized for service: %s, endpoint: %s", serviceName, endpoint)
+	attrs := []any{"service", serviceName(), "exporter", name, "sampler", sampler()}
+	if name == exporterOTLP {
+		attrs = append(attrs, "protocol", protocol, "endpoint", otlpEndpoint("traces", protocol))
+	}
+	slog.Info("OpenTelemetry initialized", attrs...)
 
 	return tp.Shutdown
 }
+
+// newTraceExporter creates the exporter called name, nil for none. protocol
+// is that of the OTLP exporter.
+func newTraceExporter(ctx context.Context, name, protocol string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case exporterOTLP:
+		endpoint := defaultEndpoint("traces", protocol)
+		if protocol == protocolGRPC {
+			var opts []otlptracegrpc.Option
+			if endpoint != "" {
+				opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+			}
+			return otlptracegrpc.New(ctx, opts...)
+		}
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case exporterConsole:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case exporterFile:
+		path := os.Getenv("OTEL_TRACES_FILE")
+		if path == "" {
+			path = "traces.jsonl"
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return fileExporter{exporter, f}, nil
+	case exporterNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q, use otlp, console, file or none", name)
+}
+
+// fileExporter closes the file spans are written to when it is shut down
+type fileExporter struct {
+	sdktrace.SpanExporter
+	f *os.File
+}
+
+func (e fileExporter) Shutdown(ctx context.Context) error {
+	return errors.Join(e.SpanExporter.Shutdown(ctx), e.f.Close())
+}
+
+// sampler is the sampler the SDK uses, for the log
+func sampler() string {
+	name := os.Getenv("OTEL_TRACES_SAMPLER")
+	if name == "" {
+		return "parentbased_always_on"
+	}
+	if arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+		return name + ":" + arg
+	}
+	return name
+}
+
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "unknown-service"
+}
+
+// newResource describes the service in the telemetry it exports
+func newResource() (*resource.Resource, error) {
+	return resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(
+			"",
+			semconv.ServiceName(serviceName()),
+		),
+	)
+}